@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"slidescope/middlewares"
+	"slidescope/models"
+)
+
+// requestUser Get the authenticated user of the request, nil for anonymous requests
+func requestUser(c *gin.Context) *models.User {
+	u, ok := middlewares.CurrentUser(c)
+	if !ok {
+		return nil
+	}
+	return &u
+}
+
+// authorizeImage Check the request can read the image, and write a not found response otherwise,
+// so the existence of images is not revealed.
+func authorizeImage(c *gin.Context, image models.Image) bool {
+	if !canReadImage(c, image) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return false
+	}
+	return true
+}
+
+// authorizeManageImage Check the user of the request can change the image
+func authorizeManageImage(c *gin.Context, image models.Image) bool {
+	if !authorizeImage(c, image) {
+		return false
+	}
+	if !models.CanManageImage(requestUser(c), image) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return false
+	}
+	return true
+}
+
+// accessibleImages Restrict a query on images to those the request can read
+func accessibleImages(c *gin.Context, db *gorm.DB) *gorm.DB {
+	if link, ok := middlewares.CurrentShareLink(c); ok {
+		return db.Where("images.id = ?", link.ImageID)
+	}
+	return models.AccessibleImages(db, requestUser(c), models.PermissionRead)
+}
+
+// FindGroups Find all user groups and their members
+func FindGroups(c *gin.Context) {
+	var groups []models.Group
+	models.Database.Preload("Users").Order("name").Find(&groups)
+
+	for i := range groups {
+		for j := range groups[i].Users {
+			groups[i].Users[j].PrepareGive()
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": groups})
+}
+
+type CreateGroupInput struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// CreateGroup Create a new user group
+func CreateGroup(c *gin.Context) {
+	var input CreateGroupInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	group := models.Group{Name: input.Name}
+	if err := models.Database.Create(&group).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": group})
+}
+
+// DeleteGroup Delete a user group and the access rules granted to it
+func DeleteGroup(c *gin.Context) {
+	var group models.Group
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	err := models.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&group).Association("Users").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&models.AccessRule{}).Error; err != nil {
+			return err
+		}
+		// The name is unique, so the group is removed permanently to allow reusing the name
+		return tx.Unscoped().Delete(&group).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+type GroupUsersInput struct {
+	UserIDs []uint `json:"user_ids" binding:"required"`
+}
+
+// changeGroupUsers Add or remove users of a group
+func changeGroupUsers(c *gin.Context, add bool) {
+	var group models.Group
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var input GroupUsersInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var users []models.User
+	models.Database.Where("id IN ?", input.UserIDs).Find(&users)
+	if len(users) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no users found"})
+		return
+	}
+
+	var err error
+	if add {
+		err = models.Database.Model(&group).Association("Users").Append(users)
+	} else {
+		err = models.Database.Model(&group).Association("Users").Delete(users)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// AddGroupUsers Add users to a group
+func AddGroupUsers(c *gin.Context) {
+	changeGroupUsers(c, true)
+}
+
+// RemoveGroupUsers Remove users from a group
+func RemoveGroupUsers(c *gin.Context) {
+	changeGroupUsers(c, false)
+}
+
+// FindAccessRules Find the access rules, optionally only those of a user, group, image or collection
+func FindAccessRules(c *gin.Context) {
+	var rules []models.AccessRule
+
+	query := models.Database
+	for _, column := range []string{"user_id", "group_id", "image_id", "collection_id"} {
+		if value := c.Query(column); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	query.Find(&rules)
+
+	c.JSON(http.StatusOK, gin.H{"data": rules})
+}
+
+type CreateAccessRuleInput struct {
+	UserID           *uint  `json:"user_id"`
+	GroupID          *uint  `json:"group_id"`
+	ImageID          *uint  `json:"image_id"`
+	CollectionID     *uint  `json:"collection_id"`
+	IdentifierPrefix string `json:"identifier_prefix"`
+	Permission       string `json:"permission" binding:"required"`
+}
+
+// CreateAccessRule Grant a user or group read or manage rights on an image, collection or identifier prefix
+func CreateAccessRule(c *gin.Context) {
+	var input CreateAccessRuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := models.AccessRule{
+		UserID:           input.UserID,
+		GroupID:          input.GroupID,
+		ImageID:          input.ImageID,
+		CollectionID:     input.CollectionID,
+		IdentifierPrefix: input.IdentifierPrefix,
+		Permission:       input.Permission,
+	}
+	if err := rule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	models.Database.Create(&rule)
+
+	c.JSON(http.StatusOK, gin.H{"data": rule})
+}
+
+// DeleteAccessRule Revoke an access rule
+func DeleteAccessRule(c *gin.Context) {
+	var rule models.AccessRule
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&rule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+	models.Database.Delete(&rule)
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
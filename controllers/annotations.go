@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/NKI-AI/openslide-go/openslide"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"slidescope/deepzoom"
+	"slidescope/models"
+)
+
+// overlayCacheKey The key of an overlay in the deepzoom cache. Mask identifiers are only unique within an image.
+func overlayCacheKey(imageIdentifier string, maskIdentifier string) string {
+	return imageIdentifier + "/overlays/" + maskIdentifier
+}
+
+// detectMaskVendor Check the mask is a file in its storage root which can be read by openslide, and set its vendor.
+// Masks without a storage root are in the root of their image.
+func detectMaskVendor(maskAnnotation *models.MaskAnnotation, imageRoot string) error {
+	if maskAnnotation.StorageRoot == "" {
+		maskAnnotation.StorageRoot = imageRoot
+	}
+	root, path, location, err := models.CheckStoragePath(maskAnnotation.StorageRoot, maskAnnotation.Path)
+	if err != nil {
+		return err
+	}
+	maskAnnotation.StorageRoot, maskAnnotation.Path = root, path
+
+	vendor, err := openslide.DetectVendor(location)
+	if err != nil {
+		log.Info(fmt.Sprintf("Cannot detect vendor for mask %s: %s", maskAnnotation.Path, err.Error()))
+		return fmt.Errorf("cannot detect the vendor of mask %s", maskAnnotation.Path)
+	}
+	log.Info(fmt.Sprintf("Importing mask %s with vendor %s", maskAnnotation.Path, vendor))
+	maskAnnotation.Vendor = vendor
+	return nil
+}
+
+// prepareMaskAnnotations Validate a set of masks for a single image, and detect their vendors
+func prepareMaskAnnotations(maskAnnotations []models.MaskAnnotation, imageRoot string) error {
+	identifiers := make(map[string]bool)
+	for i := range maskAnnotations {
+		if maskAnnotations[i].Identifier == "" {
+			return errors.New("mask identifier cannot be empty")
+		}
+		if identifiers[maskAnnotations[i].Identifier] {
+			return fmt.Errorf("mask identifier %s is used more than once", maskAnnotations[i].Identifier)
+		}
+		identifiers[maskAnnotations[i].Identifier] = true
+
+		if err := detectMaskVendor(&maskAnnotations[i], imageRoot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMaskImage Get the image the mask routes refer to, the user of the request needs read access
+func findMaskImage(c *gin.Context) (models.Image, bool) {
+	var image models.Image
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return image, false
+	}
+	if !authorizeImage(c, image) {
+		return image, false
+	}
+	return image, true
+}
+
+// findAnnotatedImage Get the image the mask routes refer to, the user of the request needs to be able to annotate it
+func findAnnotatedImage(c *gin.Context) (models.Image, bool) {
+	image, ok := findMaskImage(c)
+	if !ok {
+		return image, false
+	}
+	if !models.CanAnnotateImage(requestUser(c), image) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return image, false
+	}
+	return image, true
+}
+
+// findMask Get the mask the route refers to, it has to belong to the image
+func findMask(c *gin.Context, image models.Image) (models.MaskAnnotation, bool) {
+	var maskAnnotation models.MaskAnnotation
+	if err := models.Database.Where("id = ? AND image_id = ?", c.Param("mask_id"), image.ID).First(&maskAnnotation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return maskAnnotation, false
+	}
+	return maskAnnotation, true
+}
+
+// maskIdentifierTaken Check if another mask of the image already uses the identifier
+func maskIdentifierTaken(imageID uint, identifier string, exceptID uint) bool {
+	var count int64
+	models.Database.Model(&models.MaskAnnotation{}).Where("image_id = ? AND identifier = ? AND id <> ?", imageID, identifier, exceptID).Count(&count)
+	return count > 0
+}
+
+// FindMasks Find all masks of an image
+func FindMasks(c *gin.Context) {
+	image, ok := findMaskImage(c)
+	if !ok {
+		return
+	}
+
+	var maskAnnotations []models.MaskAnnotation
+	models.Database.Where("image_id = ?", image.ID).Find(&maskAnnotations)
+
+	c.JSON(http.StatusOK, gin.H{"data": maskAnnotations})
+}
+
+// FindMask Find a single mask of an image
+func FindMask(c *gin.Context) {
+	image, ok := findMaskImage(c)
+	if !ok {
+		return
+	}
+	maskAnnotation, ok := findMask(c, image)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": maskAnnotation})
+}
+
+// CreateMaskInput The path is relative to the storage root, which is the root of the image when it is left out
+type CreateMaskInput struct {
+	StorageRoot string `json:"storage_root"`
+	Path        string `json:"path" binding:"required"`
+	Identifier  string `json:"identifier" binding:"required"`
+}
+
+// CreateMask Add a mask to an image
+func CreateMask(c *gin.Context) {
+	image, ok := findAnnotatedImage(c)
+	if !ok {
+		return
+	}
+
+	var input CreateMaskInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if maskIdentifierTaken(image.ID, input.Identifier, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("mask identifier %s already exists", input.Identifier)})
+		return
+	}
+
+	maskAnnotation := models.MaskAnnotation{
+		ImageID:     image.ID,
+		StorageRoot: input.StorageRoot,
+		Path:        input.Path,
+		Identifier:  input.Identifier,
+	}
+	if err := detectMaskVendor(&maskAnnotation, image.StorageRoot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	models.Database.Create(&maskAnnotation)
+	recordAudit(c, models.AuditMaskCreate, image, maskAnnotation.Identifier)
+
+	c.JSON(http.StatusOK, gin.H{"data": maskAnnotation})
+}
+
+// UpdateMaskInput Fields which are left out are not changed
+type UpdateMaskInput struct {
+	StorageRoot *string `json:"storage_root"`
+	Path        *string `json:"path"`
+	Identifier  *string `json:"identifier"`
+}
+
+// UpdateMask Update a mask of an image
+func UpdateMask(cache *deepzoom.LocalCache) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		image, ok := findAnnotatedImage(c)
+		if !ok {
+			return
+		}
+		maskAnnotation, ok := findMask(c, image)
+		if !ok {
+			return
+		}
+		originalIdentifier := maskAnnotation.Identifier
+
+		var input UpdateMaskInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.Identifier != nil && *input.Identifier != maskAnnotation.Identifier {
+			if *input.Identifier == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "mask identifier cannot be empty"})
+				return
+			}
+			if maskIdentifierTaken(image.ID, *input.Identifier, maskAnnotation.ID) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("mask identifier %s already exists", *input.Identifier)})
+				return
+			}
+			maskAnnotation.Identifier = *input.Identifier
+		}
+
+		if (input.Path != nil && *input.Path != maskAnnotation.Path) ||
+			(input.StorageRoot != nil && *input.StorageRoot != maskAnnotation.StorageRoot) {
+			if input.Path != nil {
+				maskAnnotation.Path = *input.Path
+			}
+			if input.StorageRoot != nil {
+				maskAnnotation.StorageRoot = *input.StorageRoot
+			}
+			if err := detectMaskVendor(&maskAnnotation, image.StorageRoot); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		models.Database.Save(&maskAnnotation)
+		cache.Invalidate(overlayCacheKey(image.Identifier, originalIdentifier))
+		recordAudit(c, models.AuditMaskUpdate, image, originalIdentifier)
+
+		c.JSON(http.StatusOK, gin.H{"data": maskAnnotation})
+	}
+	return fn
+}
+
+// DeleteMask Remove a mask from an image
+func DeleteMask(cache *deepzoom.LocalCache) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		image, ok := findAnnotatedImage(c)
+		if !ok {
+			return
+		}
+		maskAnnotation, ok := findMask(c, image)
+		if !ok {
+			return
+		}
+
+		models.Database.Delete(&maskAnnotation)
+		cache.Invalidate(overlayCacheKey(image.Identifier, maskAnnotation.Identifier))
+		recordAudit(c, models.AuditMaskDelete, image, maskAnnotation.Identifier)
+
+		c.JSON(http.StatusOK, gin.H{"data": true})
+	}
+	return fn
+}
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"slidescope/deepzoom"
+	"slidescope/middlewares"
+	"slidescope/models"
+)
+
+// auditActor Who made the request, for the audit log
+func auditActor(c *gin.Context) models.AuditActor {
+	actor := models.AuditActor{
+		ClientIP:  c.ClientIP(),
+		RequestID: c.Writer.Header().Get("X-Request-Id"),
+	}
+	if u, ok := middlewares.CurrentUser(c); ok {
+		actor.UserID = &u.ID
+		actor.Username = u.Username
+	}
+	if apiKey, ok := middlewares.CurrentAPIKey(c); ok {
+		actor.APIKeyID = &apiKey.ID
+	}
+	if link, ok := middlewares.CurrentShareLink(c); ok {
+		actor.ShareLinkID = &link.ID
+	}
+	return actor
+}
+
+// recordAudit Record the action of the request on the image in the audit log
+func recordAudit(c *gin.Context, action string, image models.Image, detail string) {
+	models.RecordAuditEvent(auditActor(c), action, image, detail)
+}
+
+// recordTileView Add the tile to the viewing session of the request in the audit log
+func recordTileView(c *gin.Context, deepZoom *deepzoom.DeepZoom, image models.Image, overlay string, level int, location [2]int) {
+	region, err := tileRegion(deepZoom, level, location)
+	if err != nil {
+		return
+	}
+	models.RecordTileView(auditActor(c), image, overlay, level, region.Location, region.Size)
+}
+
+// parseAuditFilter Parse the filters on the audit log from the query
+func parseAuditFilter(c *gin.Context) (models.AuditFilter, error) {
+	filter := models.AuditFilter{
+		Username:        c.Query("username"),
+		ImageIdentifier: c.Query("image_identifier"),
+		Action:          c.Query("action"),
+	}
+	if value := c.Query("user_id"); value != "" {
+		userID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, errors.New("user_id should be an id")
+		}
+		id := uint(userID)
+		filter.UserID = &id
+	}
+	if value := c.Query("image_id"); value != "" {
+		imageID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, errors.New("image_id should be an id")
+		}
+		id := uint(imageID)
+		filter.ImageID = &id
+	}
+	if value := c.Query("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("from should be an RFC3339 timestamp")
+		}
+		filter.From = &from
+	}
+	if value := c.Query("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("to should be an RFC3339 timestamp")
+		}
+		filter.To = &to
+	}
+	return filter, nil
+}
+
+// FindAuditEvents Query the audit log, newest first.
+// Supports filtering (user_id, username, image_id, image_identifier, action, from, to) and pagination (limit, offset).
+func FindAuditEvents(c *gin.Context) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit should be between 1 and %d", maxPageSize)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset should be a positive integer"})
+		return
+	}
+
+	var total int64
+	if err := filter.Apply(models.Database.Model(&models.AuditEvent{})).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var events []models.AuditEvent
+	if err := filter.Apply(models.Database).Order("created_at DESC").Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   events,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// formatOptional Format an optional value for the CSV export, empty when it is not set
+func formatOptional(value interface{}) string {
+	switch v := value.(type) {
+	case *uint:
+		if v != nil {
+			return strconv.FormatUint(uint64(*v), 10)
+		}
+	case *int:
+		if v != nil {
+			return strconv.Itoa(*v)
+		}
+	case *float64:
+		if v != nil {
+			return strconv.FormatFloat(*v, 'f', -1, 64)
+		}
+	case *time.Time:
+		if v != nil {
+			return v.Format(time.RFC3339)
+		}
+	}
+	return ""
+}
+
+// ExportAuditEvents Export all events matching the filters of FindAuditEvents as CSV, in the order they were written
+func ExportAuditEvents(c *gin.Context) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.csv", time.Now().Format("20060102-150405")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{
+		"id", "created_at", "ended_at", "action", "user_id", "username", "api_key_id", "share_link_id",
+		"image_id", "image_identifier", "detail", "tiles", "max_level",
+		"region_x", "region_y", "region_width", "region_height", "client_ip", "request_id",
+	})
+	var events []models.AuditEvent
+	filter.Apply(models.Database).FindInBatches(&events, 1000, func(tx *gorm.DB, batch int) error {
+		for _, e := range events {
+			w.Write([]string{
+				strconv.FormatUint(uint64(e.ID), 10),
+				e.CreatedAt.Format(time.RFC3339),
+				formatOptional(e.EndedAt),
+				e.Action,
+				formatOptional(e.UserID),
+				e.Username,
+				formatOptional(e.APIKeyID),
+				formatOptional(e.ShareLinkID),
+				formatOptional(e.ImageID),
+				e.ImageIdentifier,
+				e.Detail,
+				strconv.Itoa(e.Tiles),
+				formatOptional(e.MaxLevel),
+				formatOptional(e.RegionX),
+				formatOptional(e.RegionY),
+				formatOptional(e.RegionWidth),
+				formatOptional(e.RegionHeight),
+				e.ClientIP,
+				e.RequestID,
+			})
+		}
+		w.Flush()
+		return w.Error()
+	})
+	w.Flush()
+}
@@ -3,24 +3,21 @@ package controllers
 // Most of the code in this module is from https://seefnasrul.medium.com/create-your-first-go-rest-api-with-jwt-authentication-in-gin-framework-dbe5bda72817
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"slidescope/middlewares"
 	"slidescope/models"
-	"slidescope/utils/token"
+	"slidescope/utils"
+	"strconv"
+	"time"
 )
 
 func CurrentUser(c *gin.Context) {
-	userId, err := token.ExtractTokenID(c)
+	u, ok := middlewares.CurrentUser(c)
 
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	u, err := models.GetUserByID(userId)
-
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
@@ -46,41 +43,194 @@ func Login(c *gin.Context) {
 	u.Username = input.Username
 	u.Password = input.Password
 
-	token, err := models.LoginCheck(u.Username, u.Password)
+	u, err := models.LoginCheck(u.Username, u.Password)
+
+	if err != nil {
+		status, message := loginError(c, err)
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	pair, err := models.CreateSession(u, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, pair)
+
+}
+
+// loginError The status and message of a failed login. Locked accounts get a Retry-After header.
+func loginError(c *gin.Context, err error) (int, string) {
+	var locked models.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		c.Header("Retry-After", strconv.Itoa(locked.RetryAfter()))
+		return http.StatusTooManyRequests, locked.Error()
+	case errors.Is(err, models.ErrUserDisabled):
+		return http.StatusForbidden, err.Error()
+	}
+	return http.StatusBadRequest, "username or password is incorrect."
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// Refresh Exchange a refresh token for a new access token and refresh token
+func Refresh(c *gin.Context) {
+	var input RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
+	pair, err := models.RefreshSession(input.RefreshToken)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "username or password is incorrect."})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	c.JSON(http.StatusOK, pair)
+}
+
+// Logout End the session of the access token, its refresh token cannot be used anymore
+func Logout(c *gin.Context) {
+	session, ok := middlewares.CurrentSession(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "request is not authenticated with a session token"})
+		return
+	}
+
+	if err := session.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// RevokeUserSessions Log a user out everywhere, for instance when they leave the team
+func RevokeUserSessions(c *gin.Context) {
+	var u models.User
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&u).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	revoked, err := models.RevokeUserSessions(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "success", "revoked": revoked})
 }
 
 type RegisterInput struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Role     string `json:"role"`
+}
+
+// Register Create a new user, only admins are allowed to do this
+func Register(config *utils.Config) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		var input RegisterInput
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.Role == "" {
+			input.Role = config.Auth.DefaultRole
+		}
+		if !models.ValidRole(input.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role should be one of admin, annotator or viewer"})
+			return
+		}
+		if err := models.ValidatePassword(input.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		u := models.User{}
+
+		u.Username = input.Username
+		u.Password = input.Password
+		u.Role = input.Role
+
+		_, err := u.SaveUser()
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "registration success"})
+	}
+	return fn
+}
+
+// FindAPIKeys List the API keys of the current user
+func FindAPIKeys(c *gin.Context) {
+	u, _ := middlewares.CurrentUser(c)
+
+	var apiKeys []models.APIKey
+	models.Database.Where("user_id = ?", u.ID).Order("created_at DESC").Find(&apiKeys)
+
+	c.JSON(http.StatusOK, gin.H{"data": apiKeys})
+}
+
+type CreateAPIKeyInput struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
-func Register(c *gin.Context) {
-	var input RegisterInput
+// CreateAPIKey Create a scoped API key for the current user. The key is only returned in this response.
+func CreateAPIKey(c *gin.Context) {
+	u, _ := middlewares.CurrentUser(c)
 
+	var input CreateAPIKeyInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if input.ExpiresAt != nil && input.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at should be in the future"})
+		return
+	}
 
-	u := models.User{}
+	apiKey, key, err := models.CreateAPIKey(&u, input.Name, input.Scopes, input.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	u.Username = input.Username
-	u.Password = input.Password
+	c.JSON(http.StatusOK, gin.H{"data": apiKey, "key": key})
+}
 
-	_, err := u.SaveUser()
+// RevokeAPIKey Revoke an API key, users can revoke their own keys and admins can revoke all keys
+func RevokeAPIKey(c *gin.Context) {
+	u, _ := middlewares.CurrentUser(c)
 
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var apiKey models.APIKey
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&apiKey).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+	if apiKey.UserID != u.ID && !u.HasRole(models.RoleAdmin) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	if err := apiKey.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "registration success"})
+	c.JSON(http.StatusOK, gin.H{"data": apiKey})
 }
@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	uuid "github.com/twinj/uuid"
+	"gorm.io/gorm"
+	"net/http"
+	"slidescope/models"
+)
+
+// FindCases Find all cases
+func FindCases(c *gin.Context) {
+	var cases []models.Case
+	models.Database.Order("identifier").Find(&cases)
+
+	c.JSON(http.StatusOK, gin.H{"data": cases})
+}
+
+// FindCase Find a case with its complete specimen / block / slide tree
+func FindCase(c *gin.Context) {
+	var reqCase models.Case
+	if err := models.Database.
+		Preload("Specimens.Blocks.Images", func(db *gorm.DB) *gorm.DB { return accessibleImages(c, db) }).
+		Preload("Specimens.Blocks.Images.MaskAnnotations").
+		Where("id = ?", c.Param("id")).First(&reqCase).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": reqCase})
+}
+
+// FindCaseImages List all pyramids and their masks in a case, including the different stains.
+// Supports the same filtering, sorting and pagination as FindImages.
+func FindCaseImages(c *gin.Context) {
+	var reqCase models.Case
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&reqCase).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	filter, err := parseImageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.BlockIDs, err = models.CaseBlockIDs(reqCase.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeImagePage(c, filter)
+}
+
+type HierarchyInput struct {
+	Identifier  string `json:"identifier"`
+	Description string `json:"description"`
+}
+
+// CreateCase Create a new case. When no identifier is given a random pseudonym is generated.
+func CreateCase(c *gin.Context) {
+	var input HierarchyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Identifier == "" {
+		input.Identifier = uuid.NewV4().String()
+	}
+
+	var count int64
+	models.Database.Model(&models.Case{}).Where("identifier = ?", input.Identifier).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("case %s already exists", input.Identifier)})
+		return
+	}
+
+	reqCase := models.Case{Identifier: input.Identifier, Description: input.Description}
+	models.Database.Create(&reqCase)
+
+	c.JSON(http.StatusOK, gin.H{"data": reqCase})
+}
+
+// UpdateHierarchyInput Fields which are left out are not changed
+type UpdateHierarchyInput struct {
+	Identifier  *string `json:"identifier"`
+	Description *string `json:"description"`
+}
+
+// UpdateCase Update a case
+func UpdateCase(c *gin.Context) {
+	var reqCase models.Case
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&reqCase).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var input UpdateHierarchyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Identifier != nil && *input.Identifier != reqCase.Identifier {
+		var count int64
+		models.Database.Model(&models.Case{}).Where("identifier = ?", *input.Identifier).Count(&count)
+		if *input.Identifier == "" || count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "identifier is empty or already exists"})
+			return
+		}
+		reqCase.Identifier = *input.Identifier
+	}
+	if input.Description != nil {
+		reqCase.Description = *input.Description
+	}
+	models.Database.Save(&reqCase)
+
+	c.JSON(http.StatusOK, gin.H{"data": reqCase})
+}
+
+// DeleteCase Delete a case, which is only allowed when it has no specimens
+func DeleteCase(c *gin.Context) {
+	var reqCase models.Case
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&reqCase).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var count int64
+	models.Database.Model(&models.Specimen{}).Where("case_id = ?", reqCase.ID).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "case still has specimens"})
+		return
+	}
+	// Release the identifier, so it can be used again
+	models.Database.Unscoped().Delete(&reqCase)
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// CreateSpecimen Add a specimen to a case
+func CreateSpecimen(c *gin.Context) {
+	var reqCase models.Case
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&reqCase).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var input HierarchyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "identifier is required"})
+		return
+	}
+
+	specimen := models.Specimen{CaseID: reqCase.ID, Identifier: input.Identifier, Description: input.Description}
+	models.Database.Create(&specimen)
+
+	c.JSON(http.StatusOK, gin.H{"data": specimen})
+}
+
+// FindSpecimen Find a specimen with its blocks and slides
+func FindSpecimen(c *gin.Context) {
+	var specimen models.Specimen
+	if err := models.Database.
+		Preload("Blocks.Images", func(db *gorm.DB) *gorm.DB { return accessibleImages(c, db) }).
+		Preload("Blocks.Images.MaskAnnotations").
+		Where("id = ?", c.Param("id")).First(&specimen).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": specimen})
+}
+
+// UpdateSpecimen Update a specimen
+func UpdateSpecimen(c *gin.Context) {
+	var specimen models.Specimen
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&specimen).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var input UpdateHierarchyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Identifier != nil {
+		if *input.Identifier == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "identifier cannot be empty"})
+			return
+		}
+		specimen.Identifier = *input.Identifier
+	}
+	if input.Description != nil {
+		specimen.Description = *input.Description
+	}
+	models.Database.Save(&specimen)
+
+	c.JSON(http.StatusOK, gin.H{"data": specimen})
+}
+
+// DeleteSpecimen Delete a specimen, which is only allowed when it has no blocks
+func DeleteSpecimen(c *gin.Context) {
+	var specimen models.Specimen
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&specimen).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var count int64
+	models.Database.Model(&models.Block{}).Where("specimen_id = ?", specimen.ID).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "specimen still has blocks"})
+		return
+	}
+	models.Database.Delete(&specimen)
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// CreateBlock Add a block to a specimen
+func CreateBlock(c *gin.Context) {
+	var specimen models.Specimen
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&specimen).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var input HierarchyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "identifier is required"})
+		return
+	}
+
+	block := models.Block{SpecimenID: specimen.ID, Identifier: input.Identifier, Description: input.Description}
+	models.Database.Create(&block)
+
+	c.JSON(http.StatusOK, gin.H{"data": block})
+}
+
+// FindBlock Find a block with its slides
+func FindBlock(c *gin.Context) {
+	var block models.Block
+	if err := models.Database.
+		Preload("Images", func(db *gorm.DB) *gorm.DB { return accessibleImages(c, db) }).
+		Preload("Images.MaskAnnotations").
+		Where("id = ?", c.Param("id")).First(&block).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": block})
+}
+
+// UpdateBlock Update a block
+func UpdateBlock(c *gin.Context) {
+	var block models.Block
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&block).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	var input UpdateHierarchyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Identifier != nil {
+		if *input.Identifier == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "identifier cannot be empty"})
+			return
+		}
+		block.Identifier = *input.Identifier
+	}
+	if input.Description != nil {
+		block.Description = *input.Description
+	}
+	models.Database.Save(&block)
+
+	c.JSON(http.StatusOK, gin.H{"data": block})
+}
+
+// DeleteBlock Delete a block, the slides cut from it are kept but no longer part of the hierarchy
+func DeleteBlock(c *gin.Context) {
+	var block models.Block
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&block).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	models.Database.Model(&models.Image{}).Where("block_id = ?", block.ID).Update("block_id", nil)
+	models.Database.Delete(&block)
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
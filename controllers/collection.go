@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"net/url"
+	"slidescope/middlewares"
+	"slidescope/models"
+	"strconv"
+)
+
+// collectionScope Get the collections an image listing covers, including the nested collections unless ?recursive=false
+func collectionScope(c *gin.Context, collection models.Collection) ([]uint, error) {
+	recursive, err := strconv.ParseBool(c.DefaultQuery("recursive", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("recursive should be a boolean")
+	}
+	if !recursive {
+		return []uint{collection.ID}, nil
+	}
+	return collection.DescendantIDs()
+}
+
+// findCollection Get the collection the route refers to
+func findCollection(c *gin.Context) (models.Collection, bool) {
+	var collection models.Collection
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return collection, false
+	}
+	return collection, true
+}
+
+// FindCollections Find collections, by default only the top level ones. Pass ?parent_id= to list nested collections.
+func FindCollections(c *gin.Context) {
+	var collections []models.Collection
+
+	query := models.Database
+	if parentID := c.Query("parent_id"); parentID != "" {
+		query = query.Where("parent_id = ?", parentID)
+	} else {
+		query = query.Where("parent_id IS NULL")
+	}
+	query.Order("name").Find(&collections)
+
+	c.JSON(http.StatusOK, gin.H{"data": collections})
+}
+
+// FindCollection Find a collection and its direct children
+func FindCollection(c *gin.Context) {
+	var collection models.Collection
+	if err := models.Database.Preload("Children").Where("id = ?", c.Param("id")).First(&collection).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": collection})
+}
+
+type CreateCollectionInput struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	ParentID    *uint  `json:"parent_id"`
+}
+
+// CreateCollection Create a new collection
+func CreateCollection(c *gin.Context) {
+	var input CreateCollectionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := models.Collection{Name: input.Name, Description: input.Description}
+	if err := collection.SetParent(input.ParentID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	models.Database.Create(&collection)
+
+	c.JSON(http.StatusOK, gin.H{"data": collection})
+}
+
+// UpdateCollectionInput Fields which are left out are not changed. Moving a collection to the top level
+// is done by setting move_to_root.
+type UpdateCollectionInput struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	ParentID    *uint   `json:"parent_id"`
+	MoveToRoot  bool    `json:"move_to_root"`
+}
+
+// UpdateCollection Update a collection
+func UpdateCollection(c *gin.Context) {
+	collection, ok := findCollection(c)
+	if !ok {
+		return
+	}
+
+	var input UpdateCollectionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Name != nil {
+		if *input.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		collection.Name = *input.Name
+	}
+	if input.Description != nil {
+		collection.Description = *input.Description
+	}
+	if input.MoveToRoot {
+		collection.ParentID = nil
+	} else if input.ParentID != nil {
+		if err := collection.SetParent(input.ParentID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	models.Database.Save(&collection)
+
+	c.JSON(http.StatusOK, gin.H{"data": collection})
+}
+
+// DeleteCollection Delete a collection. The images are kept, and nested collections move up one level.
+func DeleteCollection(c *gin.Context) {
+	collection, ok := findCollection(c)
+	if !ok {
+		return
+	}
+
+	err := models.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Collection{}).Where("parent_id = ?", collection.ID).Update("parent_id", collection.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&collection).Association("Images").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&collection).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// FindCollectionImages List the images in a collection, with the same filtering, sorting and pagination as FindImages
+func FindCollectionImages(c *gin.Context) {
+	collection, ok := findCollection(c)
+	if !ok {
+		return
+	}
+
+	filter, err := parseImageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.CollectionIDs, err = collectionScope(c, collection)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	writeImagePage(c, filter)
+}
+
+type CollectionThumbnail struct {
+	ID         uint   `json:"id"`
+	Identifier string `json:"identifier"`
+	Thumbnail  string `json:"thumbnail"`
+}
+
+// FindCollectionThumbnails List the thumbnail URLs of the images in a collection, paginated with limit and offset
+func FindCollectionThumbnails(c *gin.Context) {
+	collection, ok := findCollection(c)
+	if !ok {
+		return
+	}
+
+	collectionIDs, err := collectionScope(c, collection)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit should be between 1 and %d", maxPageSize)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset should be a positive integer"})
+		return
+	}
+	size := c.DefaultQuery("size", "256")
+
+	var images []models.Image
+	filter := models.ImageFilter{CollectionIDs: collectionIDs}
+	accessibleImages(c, filter.Apply(models.Database.Model(&models.Image{}))).Order("images.identifier").Limit(limit).Offset(offset).Find(&images)
+
+	thumbnails := make([]CollectionThumbnail, 0, len(images))
+	for _, image := range images {
+		thumbnails = append(thumbnails, CollectionThumbnail{
+			ID:         image.ID,
+			Identifier: image.Identifier,
+			Thumbnail:  middlewares.URL(c, fmt.Sprintf("/deepzoom/%s/thumbnail.jpg?size=%s", url.PathEscape(image.Identifier), url.QueryEscape(size))),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": thumbnails})
+}
+
+type ImageIDsInput struct {
+	ImageIDs []uint `json:"image_ids" binding:"required"`
+}
+
+// AddCollectionImages Add images to a collection in bulk
+func AddCollectionImages(c *gin.Context) {
+	collection, ok := findCollection(c)
+	if !ok {
+		return
+	}
+
+	var input ImageIDsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	images, err := models.FindImagesByID(input.ImageIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.Database.Model(&collection).Association("Images").Append(images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// RemoveCollectionImages Remove images from a collection in bulk, the images themselves are kept
+func RemoveCollectionImages(c *gin.Context) {
+	collection, ok := findCollection(c)
+	if !ok {
+		return
+	}
+
+	var input ImageIDsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	images, err := models.FindImagesByID(input.ImageIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.Database.Model(&collection).Association("Images").Delete(images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
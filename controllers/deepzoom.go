@@ -3,18 +3,29 @@ package controllers
 import (
 	"errors"
 	"fmt"
+	"github.com/NKI-AI/openslide-go/openslide"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"image"
 	"image/jpeg"
 	"net/http"
 	"slidescope/deepzoom"
+	"slidescope/middlewares"
 	"slidescope/models"
 	"slidescope/utils"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
+// jpegQuality The quality of jpeg tiles and thumbnails, changed on a config reload while requests are served
+var jpegQuality int32 = 75
+
+// SetJPEGQuality Set the quality of jpeg tiles, and of thumbnails which do not ask for a quality
+func SetJPEGQuality(quality int) {
+	atomic.StoreInt32(&jpegQuality, int32(quality))
+}
+
 type DeepZoomCoordinates struct {
 	contentType string
 	level       int
@@ -31,18 +42,31 @@ func parseDeepZoomCoordinates(c *gin.Context) (DeepZoomCoordinates, error) {
 	level := c.Param("level")
 	location := c.Param("location")
 	s := strings.Split(location, ".")
+	if len(s) != 2 {
+		return DeepZoomCoordinates{}, errors.New("the location should be column_row.extension")
+	}
 
 	if s[1] != "png" && s[1] != "jpg" {
 		return DeepZoomCoordinates{}, errors.New("only jpg or png is allowed as an extension")
 	}
 
-	var contentType = "image/" + s[1]
+	// The extension is jpg, the media type is image/jpeg
+	var contentType = "image/png"
+	if s[1] == "jpg" {
+		contentType = "image/jpeg"
+	}
 
 	s = strings.Split(s[0], "_")
+	if len(s) != 2 {
+		return DeepZoomCoordinates{}, errors.New("the location should be column_row.extension")
+	}
 	row := s[1]
 	column := s[0]
 
 	levelInt, err := strconv.ParseInt(level, 10, 64)
+	if err != nil {
+		return DeepZoomCoordinates{}, errors.New("cannot parse level")
+	}
 
 	rowInt, err := strconv.ParseInt(row, 10, 64)
 	if err != nil {
@@ -69,15 +93,19 @@ func parseIdentifier(c *gin.Context) (models.Image, error) {
 	if err := models.Database.Where("Identifier = ?", imageId).First(&reqImage).Error; err != nil {
 		return models.Image{}, errors.New("image not found")
 	}
+	// Images the request has no access to are reported as not found
+	if !canReadImage(c, reqImage) {
+		return models.Image{}, errors.New("image not found")
+	}
 	return reqImage, nil
 }
 
-// writeTileToAPI Write the tile to the API output.
-func writeTileToAPI(c *gin.Context, header *http.Header, w gin.ResponseWriter, contentType string, tile image.Image) {
+// writeTileToAPI Write the tile to the API output, and report whether it was sent.
+func writeTileToAPI(c *gin.Context, header *http.Header, w gin.ResponseWriter, contentType string, tile image.Image) bool {
 	var tileBuffer *[]byte
 	var err error
 	if contentType == "image/jpeg" {
-		tileBuffer, err = utils.ImageToJpgBuffer(tile, &jpeg.Options{Quality: 75})
+		tileBuffer, err = utils.ImageToJpgBuffer(tile, &jpeg.Options{Quality: int(atomic.LoadInt32(&jpegQuality))})
 	} else { // PNG
 		tileBuffer, err = utils.ImageToPngBuffer(tile)
 	}
@@ -85,51 +113,69 @@ func writeTileToAPI(c *gin.Context, header *http.Header, w gin.ResponseWriter, c
 	if err != nil {
 		log.Warn(fmt.Sprintf("Error writing tile with content type %s to image buffer: %s", contentType, err.Error()))
 		c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
-		return
+		return false
 	}
+	header.Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(*tileBuffer)
 
 	if err != nil {
-		log.Warn(fmt.Sprintf("Error writing tile with content type %s to image buffer: %s", contentType, err.Error()))
-		c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
-		return
+		// The status is sent already, the client only misses the tile
+		log.Warn(fmt.Sprintf("Error writing tile with content type %s to the response: %s", contentType, err.Error()))
+		return false
 	}
-	header.Set("Content-Type", contentType)
-	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
+	return true
 }
 
 // writeTileFromCachedDeepZoom Write the tile to the output from a cached deepzoom object.
-func writeTileFromCachedDeepZoom(c *gin.Context, cache *deepzoom.LocalCache, Identifier string, Path string, tileSize int, tileOverlap int) {
+// The tile is added to the viewing session of the image, or of its overlay, in the audit log.
+func writeTileFromCachedDeepZoom(c *gin.Context, cache *deepzoom.LocalCache, Identifier string, locate func() (string, error), tileSize int, tileOverlap int, reqImage models.Image, overlay string) {
 	var deepZoom *deepzoom.DeepZoom
 
-	deepZoom, err := deepzoom.GetCachedDeepZoom(cache, Identifier, Path, tileSize, tileOverlap, true, "png")
+	deepZoom, release, err := deepzoom.GetCachedDeepZoom(cache, Identifier, locate, tileSize, tileOverlap, true, "png")
 
 	if err != nil {
-		log.Warn(fmt.Sprintf("Error getting cached deep zoom with identifier %s and path %s: %s", Identifier, Path, err.Error()))
+		log.Warn(fmt.Sprintf("Error getting cached deep zoom with identifier %s: %s", Identifier, err.Error()))
 		c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
 		return
 	}
+	defer release()
 	var coordinates DeepZoomCoordinates
 	coordinates, err = parseDeepZoomCoordinates(c)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"data": err.Error()})
+		return
 	}
 
 	var tile image.Image
 	var level = coordinates.level
 	var location = coordinates.location
 
+	if !shareRegionAllowsTile(c, deepZoom, level, location) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "tile is outside of the shared region"})
+		return
+	}
+
 	tile, err = deepZoom.GetTile(level, location)
 
 	if err != nil {
-		log.Warn(fmt.Sprintf("Error getting deep zoom tile with identifier %s and path %s: %s", Identifier, Path, err.Error()))
+		log.Warn(fmt.Sprintf("Error getting deep zoom tile with identifier %s: %s", Identifier, err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
+		return
+	}
+	tile, err = maskShareRegion(c, deepZoom, level, location, tile)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
+		return
 	}
 
 	w := c.Writer
 	header := w.Header()
-	writeTileToAPI(c, &header, w, coordinates.contentType, tile)
+	// Only tiles which were served are recorded in the audit log
+	if writeTileToAPI(c, &header, w, coordinates.contentType, tile) {
+		recordTileView(c, deepZoom, reqImage, overlay, level, location)
+	}
 }
 
 // GetOverlayTile Get a tile for an overlay
@@ -144,15 +190,24 @@ func GetOverlayTile(cache *deepzoom.LocalCache, config *utils.Config) gin.Handle
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
+		if !authorizeImage(c, reqImage) {
+			return
+		}
+		if len(reqImage.MaskAnnotations) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "overlay not found"})
+			return
+		}
 
 		mask := reqImage.MaskAnnotations[0]
 		writeTileFromCachedDeepZoom(
 			c,
 			cache,
-			mask.Identifier,
-			mask.Path,
+			overlayCacheKey(reqImage.Identifier, mask.Identifier),
+			mask.FilePath,
 			config.DeepZoom.TileSize,
-			config.DeepZoom.TileOverlap)
+			config.DeepZoom.TileOverlap,
+			reqImage,
+			mask.Identifier)
 	}
 	return fn
 }
@@ -169,14 +224,27 @@ func GetTile(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerFunc {
 			c,
 			cache,
 			parsedIdentifier.Identifier,
-			parsedIdentifier.Path,
+			parsedIdentifier.FilePath,
 			config.DeepZoom.TileSize,
-			config.DeepZoom.TileOverlap)
+			config.DeepZoom.TileOverlap,
+			parsedIdentifier,
+			"")
 	}
 	return fn
 }
 
+// associatedImageServed Check the slide has the associated image, and it is not hidden by the de-identification policy
+func associatedImageServed(slide openslide.Slide, name string, deidentification *deepzoom.Deidentification) bool {
+	for _, served := range deidentification.AssociatedImageNames(slide) {
+		if served == name {
+			return true
+		}
+	}
+	return false
+}
+
 // GetThumbnail Get the thumbnail of an image.
+// Pass ?associated= to get an associated image instead, such as the label or macro, after de-identification.
 func GetThumbnail(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerFunc {
 	// Format is ignored, as thumbnails are postfixed with png or jpg
 	tileSize := config.DeepZoom.TileSize
@@ -202,11 +270,16 @@ func GetThumbnail(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerF
 			c.JSON(http.StatusBadRequest, gin.H{"message": "Too large thumbnail requested."})
 			return
 		}
+		// A thumbnail shows the complete slide, which is not allowed when only a region is shared
+		if link, ok := middlewares.CurrentShareLink(c); ok && link.HasRegion() {
+			c.JSON(http.StatusForbidden, gin.H{"message": "Thumbnails are not available for a shared region."})
+			return
+		}
 		var quality = c.DefaultQuery("Q", "-1")
 		jpgQuality, err := strconv.ParseInt(quality, 10, 64)
 		if format == "jpg" {
 			if jpgQuality == -1 {
-				jpgQuality = 75
+				jpgQuality = int64(atomic.LoadInt32(&jpegQuality))
 			}
 
 			if jpgQuality < 0 || jpgQuality > 100 {
@@ -216,26 +289,46 @@ func GetThumbnail(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerF
 		}
 		if format == "png" && jpgQuality != -1 {
 			c.JSON(http.StatusBadRequest, gin.H{"message": "Compression quality only makes sense for jpg."})
+			return
 		}
 
-		deepZoom, err := deepzoom.GetCachedDeepZoom(
+		deepZoom, release, err := deepzoom.GetCachedDeepZoom(
 			cache,
 			parsedIdentifier.Identifier,
-			parsedIdentifier.Path,
+			parsedIdentifier.FilePath,
 			tileSize,
 			tileOverlap, true, config.DeepZoom.Format)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
 			return
 		}
+		defer release()
+
+		var thumbnail image.Image
+		associated := c.Query("associated")
+		if associated == "" {
+			thumbnail, err = deepZoom.Slide.GetThumbnail(int(sizeInt))
+		} else if _, ok := middlewares.CurrentShareLink(c); ok {
+			// A share link is for the tiles of the slide, the label and macro can show who the patient is
+			c.JSON(http.StatusForbidden, gin.H{"message": "Associated images are not available through a share link."})
+			return
+		} else if !associatedImageServed(*deepZoom.Slide, associated, parsedIdentifier.Deidentification()) {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Associated image not found."})
+			return
+		} else {
+			thumbnail, err = deepZoom.GetAssociatedThumbnail(associated, int(sizeInt), parsedIdentifier.Deidentification())
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
+			return
+		}
 
 		w := c.Writer
 		header := w.Header()
-		header.Set("Content-Type", "image/"+format)
-		w.WriteHeader(http.StatusOK)
-		thumbnail, err := deepZoom.Slide.GetThumbnail(int(sizeInt))
 		var thumbnailBuf *[]byte
-		if format == "jpeg" {
+		contentType := "image/png"
+		if format == "jpg" {
+			contentType = "image/jpeg"
 			thumbnailBuf, err = utils.ImageToJpgBuffer(thumbnail, &jpeg.Options{Quality: int(jpgQuality)})
 		} else {
 			thumbnailBuf, err = utils.ImageToPngBuffer(thumbnail)
@@ -244,6 +337,8 @@ func GetThumbnail(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerF
 			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
 			return
 		}
+		header.Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
 		_, err = w.Write(*thumbnailBuf)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
@@ -251,6 +346,7 @@ func GetThumbnail(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerF
 		}
 
 		w.(http.Flusher).Flush()
+		recordAudit(c, models.AuditThumbnail, parsedIdentifier, associated)
 	}
 	return fn
 }
@@ -264,28 +360,33 @@ func GetDzi(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerFunc {
 			return
 		}
 
-		var deepZoom *deepzoom.DeepZoom
-
-		deepZoom, err = deepzoom.GetCachedDeepZoom(
+		deepZoom, release, err := deepzoom.GetCachedDeepZoom(
 			cache,
 			parsedIdentifier.Identifier,
-			parsedIdentifier.Path,
+			parsedIdentifier.FilePath,
 			config.DeepZoom.TileSize,
 			config.DeepZoom.TileOverlap,
 			true,
 			config.DeepZoom.Format)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
+			return
+		}
+		defer release()
 
 		message, err := deepZoom.GetDzi()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
 			return
 		}
+		recordAudit(c, models.AuditOpenDzi, parsedIdentifier, c.Param("overlay_identifier"))
 		c.XML(200, &message)
 	}
 	return fn
 }
 
-// GetImageProperties Get all the properties given in the OpenSlide object
+// GetImageProperties Get the normalized metadata of the slide.
+// The raw OpenSlide properties are only included when ?all=true is passed.
 func GetImageProperties(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
 		tileSize := config.DeepZoom.TileSize
@@ -297,14 +398,97 @@ func GetImageProperties(cache *deepzoom.LocalCache, config *utils.Config) gin.Ha
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		deepZoom, err := deepzoom.GetCachedDeepZoom(cache, parsedIdentifier.Identifier, parsedIdentifier.Path, tileSize, tileOverlap, true, format)
+		deepZoom, release, err := deepzoom.GetCachedDeepZoom(cache, parsedIdentifier.Identifier, parsedIdentifier.FilePath, tileSize, tileOverlap, true, format)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
+			return
+		}
+		defer release()
+		all, err := strconv.ParseBool(c.DefaultQuery("all", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect value for all."})
+			return
+		}
+		// The slide is open anyway, so this is a good moment to update the stored metadata
+		if parsedIdentifier.MetadataStale() {
+			if err := parsedIdentifier.UpdateMetadata(*deepZoom.Slide); err != nil {
+				log.Warn(fmt.Sprintf("Cannot update metadata for slide %s: %s", parsedIdentifier.Path, err.Error()))
+			} else if err := parsedIdentifier.SaveMetadata(); err != nil {
+				log.Warn(fmt.Sprintf("Cannot store metadata for slide %s: %s", parsedIdentifier.Path, err.Error()))
+			}
+		}
+
+		metadata := deepzoom.GetSlideMetadata(*deepZoom.Slide, all, parsedIdentifier.Deidentification())
+		recordAudit(c, models.AuditProperties, parsedIdentifier, "")
+		c.IndentedJSON(http.StatusOK, &metadata)
+
+	}
+	return fn
+}
+
+type ConvertCoordinatesInput struct {
+	From    deepzoom.CoordinateSpace `json:"from" binding:"required"`
+	To      deepzoom.CoordinateSpace `json:"to" binding:"required"`
+	Points  [][2]float64             `json:"points"`
+	Regions []deepzoom.Region        `json:"regions"`
+}
+
+type ConvertCoordinatesOutput struct {
+	Points  [][2]float64      `json:"points"`
+	Regions []deepzoom.Region `json:"regions"`
+}
+
+// ConvertCoordinates Convert points and regions between DeepZoom, slide level, level 0 and micron coordinates
+func ConvertCoordinates(cache *deepzoom.LocalCache, config *utils.Config) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		parsedIdentifier, err := parseIdentifier(c)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		var input ConvertCoordinatesInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		deepZoom, release, err := deepzoom.GetCachedDeepZoom(
+			cache,
+			parsedIdentifier.Identifier,
+			parsedIdentifier.FilePath,
+			config.DeepZoom.TileSize,
+			config.DeepZoom.TileOverlap,
+			true,
+			config.DeepZoom.Format)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"data": err.Error()})
 			return
 		}
-		properties := deepZoom.Slide.Properties()
-		c.IndentedJSON(http.StatusOK, &properties)
+		defer release()
+
+		output := ConvertCoordinatesOutput{
+			Points:  make([][2]float64, 0, len(input.Points)),
+			Regions: make([]deepzoom.Region, 0, len(input.Regions)),
+		}
+		for _, point := range input.Points {
+			converted, err := deepZoom.ConvertPoint(point, input.From, input.To)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			output.Points = append(output.Points, converted)
+		}
+		for _, region := range input.Regions {
+			converted, err := deepZoom.ConvertRegion(region, input.From, input.To)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			output.Regions = append(output.Regions, converted)
+		}
 
+		c.JSON(http.StatusOK, gin.H{"data": output})
 	}
 	return fn
 }
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseDeepZoomCoordinates(t *testing.T) {
+	tests := []struct {
+		level, location string
+		want            DeepZoomCoordinates
+		wantErr         bool
+	}{
+		{level: "12", location: "3_4.png", want: DeepZoomCoordinates{contentType: "image/png", level: 12, location: [2]int{3, 4}}},
+		{level: "0", location: "0_0.jpg", want: DeepZoomCoordinates{contentType: "image/jpeg", location: [2]int{0, 0}}},
+		{level: "12", location: "3_4.jpeg", wantErr: true},
+		{level: "12", location: "abc", wantErr: true},
+		{level: "12", location: "3_4", wantErr: true},
+		{level: "12", location: "3_4.png.png", wantErr: true},
+		{level: "12", location: "12.png", wantErr: true},
+		{level: "12", location: "3_4_5.png", wantErr: true},
+		{level: "12", location: "x_4.png", wantErr: true},
+		{level: "12", location: "3_y.png", wantErr: true},
+		{level: "abc", location: "3_4.png", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.level+"/"+test.location, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Params = gin.Params{{Key: "level", Value: test.level}, {Key: "location", Value: test.location}}
+			got, err := parseDeepZoomCoordinates(c)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -1,27 +1,202 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"github.com/NKI-AI/openslide-go/openslide"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 	"net/http"
+	"slidescope/deepzoom"
 	"slidescope/models"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// FindImages Find all images with annotations
+// Columns the image list can be sorted on, prefix with - to sort descending
+var imageSortColumns = map[string]string{
+	"id":              "images.id",
+	"identifier":      "images.identifier",
+	"path":            "images.path",
+	"created_at":      "images.created_at",
+	"updated_at":      "images.updated_at",
+	"vendor":          "images.vendor",
+	"width":           "images.width",
+	"height":          "images.height",
+	"objective_power": "images.objective_power",
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// parseImageFilter Parse the filters on the image list from the query
+func parseImageFilter(c *gin.Context) (models.ImageFilter, error) {
+	filter := models.ImageFilter{
+		IdentifierPrefix: c.Query("identifier_prefix"),
+		PathPrefix:       c.Query("path_prefix"),
+		Search:           c.Query("q"),
+	}
+	if value := c.Query("created_after"); value != "" {
+		createdAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("created_after should be an RFC3339 timestamp")
+		}
+		filter.CreatedAfter = &createdAfter
+	}
+	if value := c.Query("created_before"); value != "" {
+		createdBefore, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("created_before should be an RFC3339 timestamp")
+		}
+		filter.CreatedBefore = &createdBefore
+	}
+	if value := c.Query("has_masks"); value != "" {
+		hasMasks, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, errors.New("has_masks should be a boolean")
+		}
+		filter.HasMasks = &hasMasks
+	}
+	if value := c.Query("collection"); value != "" {
+		var collection models.Collection
+		if err := models.Database.Where("id = ?", value).First(&collection).Error; err != nil {
+			return filter, errors.New("collection not found")
+		}
+		collectionIDs, err := collectionScope(c, collection)
+		if err != nil {
+			return filter, err
+		}
+		filter.CollectionIDs = collectionIDs
+	}
+	filter.Tags = c.QueryArray("tag")
+	if value := c.Query("case"); value != "" {
+		caseID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, errors.New("case should be an id")
+		}
+		filter.BlockIDs, err = models.CaseBlockIDs(uint(caseID))
+		if err != nil {
+			return filter, err
+		}
+	}
+	if value := c.Query("block"); value != "" {
+		blockID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return filter, errors.New("block should be an id")
+		}
+		filter.BlockIDs = []uint{uint(blockID)}
+	}
+	filter.Stain = c.Query("stain")
+	filter.StainMarker = c.Query("stain_marker")
+	return filter, nil
+}
+
+// FindImages Find images with annotations.
+// Supports filtering (identifier_prefix, path_prefix, created_after, created_before, has_masks, collection, tag,
+// case, block, stain, stain_marker),
+// full-text search (q), sorting (sort) and pagination with either offset or cursor, and limit.
 func FindImages(c *gin.Context) {
+	filter, err := parseImageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	writeImagePage(c, filter)
+}
+
+// writeImagePage Write a page of the images matching the filter, sorted and paginated as given in the query
+func writeImagePage(c *gin.Context, filter models.ImageFilter) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit should be between 1 and %d", maxPageSize)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset should be a positive integer"})
+		return
+	}
+
+	sort := c.DefaultQuery("sort", "id")
+	descending := strings.HasPrefix(sort, "-")
+	column, ok := imageSortColumns[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot sort on %s", sort)})
+		return
+	}
+	order := column
+	if descending {
+		order += " DESC"
+	}
+
+	var total int64
+	if err := accessibleImages(c, filter.Apply(models.Database.Model(&models.Image{}))).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := accessibleImages(c, filter.Apply(models.Database.Model(&models.Image{})))
+	// Cursor pagination continues after the last image id of the previous page, and only works on the id
+	if cursor := c.Query("cursor"); cursor != "" {
+		if column != "images.id" || offset != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor can only be used when sorting on id and without offset"})
+			return
+		}
+		cursorId, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		if descending {
+			query = query.Where("images.id < ?", cursorId)
+		} else {
+			query = query.Where("images.id > ?", cursorId)
+		}
+	}
+
 	var images []models.Image
+	// Sort on id as well, so pages are stable when the sort column has duplicate values
+	if err := query.Preload("MaskAnnotations").Preload("Tags").Order(order).Order("images.id").Limit(limit).Offset(offset).Find(&images).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	models.Database.Preload("MaskAnnotations").Find(&images)
+	var nextCursor *string
+	if column == "images.id" && len(images) == limit {
+		cursor := strconv.FormatUint(uint64(images[len(images)-1].ID), 10)
+		nextCursor = &cursor
+	}
 
-	c.JSON(http.StatusOK, gin.H{"data": images})
+	c.JSON(http.StatusOK, gin.H{
+		"data":        images,
+		"total":       total,
+		"limit":       limit,
+		"offset":      offset,
+		"next_cursor": nextCursor,
+	})
 }
 
+// CreateImageInput The path is relative to the storage root, which is the default root when it is left out
 type CreateImageInput struct {
+	StorageRoot     string                  `json:"storage_root"`
 	Path            string                  `json:"path" binding:"required"`
 	Identifier      string                  `json:"identifier" binding:"required"`
 	MaskAnnotations []models.MaskAnnotation `json:"mask_annotations"`
+	BlockID         *uint                   `json:"block_id"`
+	Stain           string                  `json:"stain"`
+	StainMarker     string                  `json:"stain_marker"`
+	Deidentify      *bool                   `json:"deidentify"`
+}
+
+// blockExists Check the block an image is assigned to exists
+func blockExists(blockID uint) bool {
+	var count int64
+	models.Database.Model(&models.Block{}).Where("id = ?", blockID).Count(&count)
+	return count > 0
 }
 
 // CreateImage Create a new image
@@ -33,79 +208,319 @@ func CreateImage(c *gin.Context) {
 		return
 	}
 
-	vendor, err := openslide.DetectVendor(input.Path)
+	if models.ImageIdentifierTaken(input.Identifier, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("identifier %s already exists", input.Identifier)})
+		return
+	}
+
+	root, path, location, err := models.CheckStoragePath(input.StorageRoot, input.Path)
 	if err != nil {
-		log.Println(fmt.Sprintf("Cannot detect vendor for slide %s", input.Path))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	log.Info(fmt.Sprintf("Importing %s with vendor %s", input.Path, vendor))
+	vendor, err := openslide.DetectVendor(location)
+	if err != nil {
+		// The error of openslide is not passed on, it contains the location on the server
+		log.Println(fmt.Sprintf("Cannot detect vendor for slide %s: %s", path, err.Error()))
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot detect the vendor of slide %s", path)})
+		return
+	}
+	log.Info(fmt.Sprintf("Importing %s with vendor %s", path, vendor))
 
-	if input.MaskAnnotations != nil {
-		for _, maskAnnotation := range input.MaskAnnotations {
-			vendor, err := openslide.DetectVendor(maskAnnotation.Path)
-			log.Info(fmt.Sprintf("Importing mask %s with vendor %s", maskAnnotation.Path, vendor))
-			if err != nil {
-				log.Info(fmt.Sprintf("Cannot detect vendor for mask %s", maskAnnotation.Path))
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
+	if err := prepareMaskAnnotations(input.MaskAnnotations, root); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The masks are new, ids sent by the client would take over the masks of other images
+	for i := range input.MaskAnnotations {
+		input.MaskAnnotations[i].ID = 0
+		input.MaskAnnotations[i].ImageID = 0
+	}
 
-		}
+	if input.BlockID != nil && !blockExists(*input.BlockID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "block not found"})
+		return
 	}
 
 	// Create image
-	image := models.Image{Path: input.Path, Identifier: input.Identifier, MaskAnnotations: input.MaskAnnotations}
-	models.Database.Create(&image)
+	image := models.Image{
+		StorageRoot:     root,
+		Path:            path,
+		Identifier:      input.Identifier,
+		MaskAnnotations: input.MaskAnnotations,
+		BlockID:         input.BlockID,
+		Stain:           input.Stain,
+		StainMarker:     input.StainMarker,
+		Deidentify:      input.Deidentify,
+	}
+	if err := image.ExtractMetadata(); err != nil {
+		log.Info(fmt.Sprintf("Cannot extract metadata for slide %s", path))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.Database.Create(&image).Error; err != nil {
+		if models.IsIdentifierConflict(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("identifier %s already exists", image.Identifier)})
+			return
+		}
+		log.Warn(fmt.Sprintf("Cannot create image %s: %s", image.Identifier, err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, models.AuditImageCreate, image, "")
 
-	c.JSON(http.StatusOK, gin.H{"data": image})
+	// A file registered more than once is flagged, not refused, as it can be intended
+	duplicates := duplicateIdentifiers(image)
+	if len(duplicates) > 0 {
+		log.Warn(fmt.Sprintf("Image %s has the same file as %s", image.Identifier, strings.Join(duplicates, ", ")))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": image, "duplicates": duplicates})
 }
 
 // FindImage Find an image
 func FindImage(c *gin.Context) { // Get model if exist
 	var image models.Image
 
-	if err := models.Database.Preload("MaskAnnotations").Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+	if err := models.Database.Preload("MaskAnnotations").Preload("Tags").Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Record not found!"})
 		return
 	}
+	if !authorizeImage(c, image) {
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"data": image})
 }
 
+// UpdateImageInput Fields which are left out are not changed. When mask_annotations is given, it replaces all masks.
+// An image is removed from its block by setting remove_from_block, and follows the global de-identification
+// setting again with reset_deidentify. Only admins can change the de-identification of an image.
 type UpdateImageInput struct {
-	Path            string                  `json:"path"`
-	Identifier      string                  `json:"identifier"`
-	MaskAnnotations []models.MaskAnnotation `json:"mask_annotations"`
+	StorageRoot     *string                  `json:"storage_root"`
+	Path            *string                  `json:"path"`
+	Identifier      *string                  `json:"identifier"`
+	MaskAnnotations *[]models.MaskAnnotation `json:"mask_annotations"`
+	BlockID         *uint                    `json:"block_id"`
+	RemoveFromBlock bool                     `json:"remove_from_block"`
+	Stain           *string                  `json:"stain"`
+	StainMarker     *string                  `json:"stain_marker"`
+	Deidentify      *bool                    `json:"deidentify"`
+	ResetDeidentify bool                     `json:"reset_deidentify"`
+}
+
+// changedFields The fields given in the update, for the audit log
+func (input UpdateImageInput) changedFields() string {
+	var fields []string
+	if input.StorageRoot != nil {
+		fields = append(fields, "storage_root")
+	}
+	if input.Path != nil {
+		fields = append(fields, "path")
+	}
+	if input.Identifier != nil {
+		fields = append(fields, "identifier")
+	}
+	if input.MaskAnnotations != nil {
+		fields = append(fields, "mask_annotations")
+	}
+	if input.BlockID != nil || input.RemoveFromBlock {
+		fields = append(fields, "block_id")
+	}
+	if input.Stain != nil {
+		fields = append(fields, "stain")
+	}
+	if input.StainMarker != nil {
+		fields = append(fields, "stain_marker")
+	}
+	if input.Deidentify != nil || input.ResetDeidentify {
+		fields = append(fields, "deidentify")
+	}
+	return strings.Join(fields, ",")
+}
+
+// invalidateImageCache Remove the deepzoom objects of an image and its overlays from the cache
+func invalidateImageCache(cache *deepzoom.LocalCache, image models.Image) {
+	cache.Invalidate(image.Identifier)
+	for _, mask := range image.MaskAnnotations {
+		cache.Invalidate(overlayCacheKey(image.Identifier, mask.Identifier))
+	}
 }
 
 // UpdateImage Update an image
-func UpdateImage(c *gin.Context) {
-	// Get model if exist
-	var image models.Image
-	if err := models.Database.Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Record not found!"})
-		return
+func UpdateImage(cache *deepzoom.LocalCache) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		// Get model if exist
+		var image models.Image
+		if err := models.Database.Preload("MaskAnnotations").Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Record not found!"})
+			return
+		}
+		if !authorizeManageImage(c, image) {
+			return
+		}
+		original := image
+
+		// Validate input
+		var input UpdateImageInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.Identifier != nil && *input.Identifier != image.Identifier {
+			if *input.Identifier == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "identifier cannot be empty"})
+				return
+			}
+			if models.ImageIdentifierTaken(*input.Identifier, image.ID) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("identifier %s already exists", *input.Identifier)})
+				return
+			}
+			image.Identifier = *input.Identifier
+		}
+
+		if (input.Path != nil && *input.Path != image.Path) || (input.StorageRoot != nil && *input.StorageRoot != image.StorageRoot) {
+			root, path := image.StorageRoot, image.Path
+			if input.StorageRoot != nil {
+				root = *input.StorageRoot
+			}
+			if input.Path != nil {
+				path = *input.Path
+			}
+			root, path, location, err := models.CheckStoragePath(root, path)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			vendor, err := openslide.DetectVendor(location)
+			if err != nil {
+				log.Info(fmt.Sprintf("Cannot detect vendor for slide %s: %s", path, err.Error()))
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot detect the vendor of slide %s", path)})
+				return
+			}
+			log.Info(fmt.Sprintf("Changing path of %s to %s with vendor %s", image.Identifier, path, vendor))
+			image.StorageRoot, image.Path = root, path
+			if err := image.ExtractMetadata(); err != nil {
+				log.Info(fmt.Sprintf("Cannot extract metadata for slide %s", image.Path))
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if input.RemoveFromBlock {
+			image.BlockID = nil
+		} else if input.BlockID != nil {
+			if !blockExists(*input.BlockID) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "block not found"})
+				return
+			}
+			image.BlockID = input.BlockID
+		}
+		if input.Stain != nil {
+			image.Stain = *input.Stain
+		}
+		if input.StainMarker != nil {
+			image.StainMarker = *input.StainMarker
+		}
+		if input.Deidentify != nil || input.ResetDeidentify {
+			if u := requestUser(c); u == nil || !u.HasRole(models.RoleAdmin) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "only admins can change the de-identification of an image"})
+				return
+			}
+			image.Deidentify = input.Deidentify
+			if input.ResetDeidentify {
+				image.Deidentify = nil
+			}
+		}
+
+		if input.MaskAnnotations != nil {
+			if err := prepareMaskAnnotations(*input.MaskAnnotations, image.StorageRoot); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		err := models.Database.Transaction(func(tx *gorm.DB) error {
+			if input.MaskAnnotations != nil {
+				if err := tx.Where("image_id = ?", image.ID).Delete(&models.MaskAnnotation{}).Error; err != nil {
+					return err
+				}
+				image.MaskAnnotations = *input.MaskAnnotations
+				for i := range image.MaskAnnotations {
+					image.MaskAnnotations[i].ID = 0
+					image.MaskAnnotations[i].ImageID = image.ID
+				}
+			}
+			return tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(&image).Error
+		})
+		if models.IsIdentifierConflict(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("identifier %s already exists", image.Identifier)})
+			return
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("Cannot update image %d: %s", image.ID, err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		invalidateImageCache(cache, original)
+		recordAudit(c, models.AuditImageUpdate, image, input.changedFields())
+
+		c.JSON(http.StatusOK, gin.H{"data": image})
 	}
+	return fn
+}
 
-	// Validate input
-	var input UpdateImageInput
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// RefreshImageMetadata Re-extract the metadata of an image from the slide
+func RefreshImageMetadata(cache *deepzoom.LocalCache) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		var image models.Image
+		if err := models.Database.Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Record not found!"})
+			return
+		}
+		if !authorizeManageImage(c, image) {
+			return
+		}
+
+		if err := image.ExtractMetadata(); err != nil {
+			log.Warn(fmt.Sprintf("Cannot extract metadata for slide %s: %s", image.Path, err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := models.Database.Save(&image).Error; err != nil {
+			log.Warn(fmt.Sprintf("Cannot update image %d: %s", image.ID, err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// The file might have changed, so the cached pyramid cannot be trusted anymore
+		cache.Invalidate(image.Identifier)
+		recordAudit(c, models.AuditMetadataUpdate, image, "")
+
+		c.JSON(http.StatusOK, gin.H{"data": image})
 	}
+	return fn
 }
 
 // DeleteImage Delete an image
-func DeleteImage(c *gin.Context) {
-	// Get model if exist
-	var image models.Image
-	if err := models.Database.Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Record not found!"})
-		return
-	}
+func DeleteImage(cache *deepzoom.LocalCache) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		// Get model if exist
+		var image models.Image
+		if err := models.Database.Preload("MaskAnnotations").Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Record not found!"})
+			return
+		}
+		if !authorizeManageImage(c, image) {
+			return
+		}
 
-	models.Database.Delete(&image)
+		models.Database.Delete(&image)
+		invalidateImageCache(cache, image)
+		recordAudit(c, models.AuditImageDelete, image, "")
 
-	c.JSON(http.StatusOK, gin.H{"data": true})
+		c.JSON(http.StatusOK, gin.H{"data": true})
+	}
+	return fn
 }
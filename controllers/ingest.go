@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"slidescope/ingest"
+	"slidescope/models"
+)
+
+// defaultImportBatchSize The number of images imported per transaction when the request does not set it
+const defaultImportBatchSize = 100
+
+// IngestStatus The watch folders, and the files which are waiting to be registered or could not be registered
+func IngestStatus(ingester *ingest.Ingester) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		if ingester == nil {
+			c.JSON(http.StatusOK, gin.H{"enabled": false})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"enabled": true, "data": ingester.Status()})
+	}
+	return fn
+}
+
+// RetryIngest Try to register the files which failed again, and scan the watch folders now
+func RetryIngest(ingester *ingest.Ingester) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		if ingester == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "watch folders are not enabled"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"retried": ingester.Retry()})
+	}
+	return fn
+}
+
+// ImportImages Import the images of a manifest in the background, CSV when the Content-Type is text/csv and JSON
+// otherwise. All entries are validated first. Pass dry_run=true to only validate them, atomic=true to import none of
+// them when one is invalid, and batch_size for the number of images per transaction. Responds with the import job,
+// whose report has the outcome of every row when it finishes.
+func ImportImages(c *gin.Context) {
+	format := ingest.FormatJSON
+	if strings.Contains(c.ContentType(), "csv") {
+		format = ingest.FormatCSV
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dry_run should be true or false"})
+		return
+	}
+	atomic, err := strconv.ParseBool(c.DefaultQuery("atomic", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "atomic should be true or false"})
+		return
+	}
+	batchSize, err := strconv.Atoi(c.DefaultQuery("batch_size", strconv.Itoa(defaultImportBatchSize)))
+	if err != nil || batchSize < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "batch_size should be a positive integer"})
+		return
+	}
+
+	entries, err := ingest.ParseManifest(c.Request.Body, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("the %s manifest has no images", format)})
+		return
+	}
+
+	actor := auditActor(c)
+	startJob(c, models.JobImport, func(job *models.Job) (interface{}, error) {
+		return ingest.ImportManifest(entries, ingest.ImportOptions{
+			DryRun:    dryRun,
+			Atomic:    atomic,
+			BatchSize: batchSize,
+			Actor:     actor,
+			Progress:  job.Progress,
+		}), nil
+	})
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"slidescope/models"
+)
+
+// startJob Run the job in the background and respond with it, the report can be read from the job when it finishes
+func startJob(c *gin.Context, kind string, run func(job *models.Job) (interface{}, error)) {
+	job, err := models.StartJob(kind, auditActor(c), run)
+	if errors.Is(err, models.ErrJobRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "a " + kind + " job is already running"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"data": job})
+}
+
+// FindJobs List the background jobs, newest first, optionally of one ?kind=. Reports are only in the single job.
+func FindJobs(c *gin.Context) {
+	jobs, err := models.FindJobs(c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": jobs})
+}
+
+// FindJob Find a background job with its progress, and its report once it has finished. When kind is set only jobs
+// of that kind are found.
+func FindJob(kind string) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		query := models.Database.Where("id = ?", c.Param("id"))
+		if kind != "" {
+			query = query.Where("kind = ?", kind)
+		}
+		var job models.Job
+		if err := query.First(&job).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": job})
+	}
+	return fn
+}
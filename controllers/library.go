@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"slidescope/deepzoom"
+	"slidescope/library"
+	"slidescope/models"
+)
+
+// duplicateIdentifiers The identifiers of the other images with the same file as the image
+func duplicateIdentifiers(image models.Image) []string {
+	identifiers := []string{}
+	duplicates, err := models.FindDuplicates(image)
+	if err != nil {
+		return identifiers
+	}
+	for _, duplicate := range duplicates {
+		identifiers = append(identifiers, duplicate.Identifier)
+	}
+	return identifiers
+}
+
+// FindDuplicateImages The images which are registered more than once for the same file, grouped by file
+func FindDuplicateImages(c *gin.Context) {
+	groups, err := models.FindDuplicateGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": groups})
+}
+
+type RelinkInput struct {
+	Folders []library.Folder `json:"folders" binding:"required,min=1,dive"`
+	DryRun  bool             `json:"dry_run"`
+}
+
+// RelinkImages Find the files of images which are missing in the folders by their fingerprint, and fix their paths
+// and the paths of their masks which moved along. Runs in the background, responds with the relink job.
+func RelinkImages(cache *deepzoom.LocalCache) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		var input RelinkInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := library.CheckFolders(input.Folders); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		actor := auditActor(c)
+		startJob(c, models.JobRelink, func(job *models.Job) (interface{}, error) {
+			report, err := library.Relink(library.RelinkOptions{
+				Folders:  input.Folders,
+				DryRun:   input.DryRun,
+				Actor:    actor,
+				Progress: job.Progress,
+			})
+			// The cache can still hold slides and overlays which were opened before they were moved
+			if !input.DryRun {
+				for _, relinked := range report.Relinked {
+					cache.Invalidate(relinked.Identifier)
+				}
+				for _, mask := range report.RelinkedMasks {
+					cache.Invalidate(overlayCacheKey(mask.ImageIdentifier, mask.Identifier))
+				}
+			}
+			return report, err
+		})
+	}
+	return fn
+}
+
+type VerifyInput struct {
+	Unregistered bool `json:"unregistered"`
+}
+
+// VerifyLibrary Check the files of all images and masks, and optionally find slide files which are not registered.
+// Runs in the background, responds with the verify job which has the report when it finishes.
+func VerifyLibrary(extensions []string) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		var input VerifyInput
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&input); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		startJob(c, models.JobVerify, func(job *models.Job) (interface{}, error) {
+			return library.Verify(library.VerifyOptions{
+				Unregistered: input.Unregistered,
+				Extensions:   extensions,
+				Progress:     job.Progress,
+			})
+		})
+	}
+	return fn
+}
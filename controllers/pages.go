@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"slidescope/middlewares"
+	"slidescope/models"
+)
+
+// pageData The values every page template gets: the title, the logged in user, the CSRF token for forms and the
+// base path to build URLs with
+func pageData(c *gin.Context, title string) (gin.H, error) {
+	csrfToken, err := middlewares.CSRFToken(c)
+	if err != nil {
+		return nil, err
+	}
+	data := gin.H{"title": title, "csrf_token": csrfToken, "base_path": middlewares.URL(c, "")}
+	if u, ok := middlewares.CurrentUser(c); ok {
+		data["user"] = u
+	}
+	return data, nil
+}
+
+// Page Render a page of the web frontend
+func Page(template string, title string) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		data, err := pageData(c, title)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.HTML(http.StatusOK, template, data)
+	}
+	return fn
+}
+
+// LoginPage Show the login form, browsers that are already logged in continue to the page they came for
+func LoginPage(c *gin.Context) {
+	next := middlewares.SafeRedirect(c, c.Query("next"))
+	if _, ok := middlewares.CurrentUser(c); ok {
+		c.Redirect(http.StatusSeeOther, next)
+		return
+	}
+
+	data, err := pageData(c, "Login")
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	data["next"] = next
+	c.HTML(http.StatusOK, "login.tmpl", data)
+}
+
+type LoginFormInput struct {
+	Username string `form:"username" binding:"required"`
+	Password string `form:"password" binding:"required"`
+	Next     string `form:"next"`
+}
+
+// loginFailed Show the login form again with an error
+func loginFailed(c *gin.Context, input LoginFormInput, status int, message string) {
+	data, err := pageData(c, "Login")
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	data["next"] = middlewares.SafeRedirect(c, input.Next)
+	data["username"] = input.Username
+	data["error"] = message
+	c.HTML(status, "login.tmpl", data)
+}
+
+// LoginForm Log the browser in with the login form, the session is kept in a cookie
+func LoginForm(c *gin.Context) {
+	var input LoginFormInput
+	if err := c.ShouldBind(&input); err != nil {
+		loginFailed(c, input, http.StatusUnauthorized, "Username or password is incorrect.")
+		return
+	}
+
+	u, err := models.LoginCheck(input.Username, input.Password)
+	if err != nil {
+		status, message := loginError(c, err)
+		if status == http.StatusBadRequest {
+			status, message = http.StatusUnauthorized, "Username or password is incorrect."
+		}
+		loginFailed(c, input, status, message)
+		return
+	}
+
+	session, err := models.CreateBrowserSession(u, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := middlewares.StartCookieSession(c, session); err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, middlewares.SafeRedirect(c, input.Next))
+}
+
+// LogoutForm End the session of the browser and return to the login page
+func LogoutForm(c *gin.Context) {
+	if session, ok := middlewares.CurrentSession(c); ok {
+		if err := session.Revoke(); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := middlewares.EndCookieSession(c); err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, middlewares.URL(c, "/login"))
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"net/http"
+	"net/url"
+	"slidescope/deepzoom"
+	"slidescope/middlewares"
+	"slidescope/models"
+	"time"
+)
+
+// maxShareLifetime Share links cannot be valid for longer than this
+const maxShareLifetime = 90 * 24 * time.Hour
+
+// canReadImage Check the request may read the image, either through a share link or as the user of the request
+func canReadImage(c *gin.Context, image models.Image) bool {
+	if link, ok := middlewares.CurrentShareLink(c); ok {
+		if link.ImageID != image.ID {
+			return false
+		}
+		// Overlays are only visible when the link includes them
+		return c.Param("overlay_identifier") == "" || link.IncludeOverlays
+	}
+	return models.CanAccessImage(requestUser(c), image, models.PermissionRead)
+}
+
+// tileRegion The region of a tile in level 0 coordinates
+func tileRegion(deepZoom *deepzoom.DeepZoom, level int, location [2]int) (deepzoom.Region, error) {
+	tile := deepzoom.Region{Location: [2]float64{float64(location[0]), float64(location[1])}, Size: [2]float64{1, 1}}
+	return deepZoom.ConvertRegion(
+		tile,
+		deepzoom.CoordinateSpace{System: deepzoom.SystemTile, Level: level},
+		deepzoom.CoordinateSpace{System: deepzoom.SystemLevel0})
+}
+
+// shareRegionAllowsTile Check a tile overlaps with the region the share link of the request is restricted to
+func shareRegionAllowsTile(c *gin.Context, deepZoom *deepzoom.DeepZoom, level int, location [2]int) bool {
+	link, ok := middlewares.CurrentShareLink(c)
+	if !ok || !link.HasRegion() {
+		return true
+	}
+	region, err := tileRegion(deepZoom, level, location)
+	if err != nil {
+		return false
+	}
+	return link.RegionIntersects(region.Location, region.Size)
+}
+
+// maskShareRegion Hide the part of a tile which is outside of the region the share link of the request is restricted
+// to. A tile at a low level covers much more than the region, and would otherwise show the complete slide.
+func maskShareRegion(c *gin.Context, deepZoom *deepzoom.DeepZoom, level int, location [2]int, tile image.Image) (image.Image, error) {
+	link, ok := middlewares.CurrentShareLink(c)
+	if !ok || !link.HasRegion() {
+		return tile, nil
+	}
+	region := deepzoom.Region{
+		Location: [2]float64{float64(*link.RegionX), float64(*link.RegionY)},
+		Size:     [2]float64{float64(*link.RegionWidth), float64(*link.RegionHeight)},
+	}
+	return deepZoom.MaskTile(tile, level, location, region)
+}
+
+// shareLinkURL The viewer URL for a share link
+func shareLinkURL(c *gin.Context, image models.Image, link models.ShareLink) string {
+	return middlewares.URL(c, "/viewer") + fmt.Sprintf("?id=%s&share=%s", url.QueryEscape(image.Identifier), url.QueryEscape(link.Token()))
+}
+
+type ShareRegionInput struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width" binding:"required"`
+	Height int `json:"height" binding:"required"`
+}
+
+type CreateShareLinkInput struct {
+	ExpiresAt       time.Time         `json:"expires_at" binding:"required"`
+	Description     string            `json:"description"`
+	IncludeOverlays bool              `json:"include_overlays"`
+	Region          *ShareRegionInput `json:"region"`
+}
+
+type ShareLinkOutput struct {
+	models.ShareLink
+	URL string `json:"url"`
+}
+
+// CreateShareLink Create a signed link to view a single image without an account
+func CreateShareLink(c *gin.Context) {
+	var image models.Image
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+	if !authorizeManageImage(c, image) {
+		return
+	}
+
+	var input CreateShareLinkInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateShareExpiry(input.ExpiresAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u := requestUser(c)
+	link := models.ShareLink{
+		ImageID:         image.ID,
+		CreatedByID:     u.ID,
+		Description:     input.Description,
+		IncludeOverlays: input.IncludeOverlays,
+		ExpiresAt:       input.ExpiresAt,
+	}
+	if input.Region != nil {
+		if input.Region.Width <= 0 || input.Region.Height <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "region should have a positive width and height"})
+			return
+		}
+		if input.Region.X < 0 || input.Region.Y < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "region should not start before the slide"})
+			return
+		}
+		// The region is in level 0 pixels, and checked against the dimensions when they have been extracted
+		if (image.Width > 0 && input.Region.Width > image.Width-input.Region.X) ||
+			(image.Height > 0 && input.Region.Height > image.Height-input.Region.Y) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("region should be within the slide of %dx%d pixels", image.Width, image.Height)})
+			return
+		}
+		link.RegionX = &input.Region.X
+		link.RegionY = &input.Region.Y
+		link.RegionWidth = &input.Region.Width
+		link.RegionHeight = &input.Region.Height
+	}
+	if err := models.Database.Create(&link).Error; err != nil {
+		log.Warn(fmt.Sprintf("Cannot create share link for image %d: %s", image.ID, err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": ShareLinkOutput{ShareLink: link, URL: shareLinkURL(c, image, link)}})
+}
+
+// validateShareExpiry Check the expiry is in the future, and not too far
+func validateShareExpiry(expiresAt time.Time) error {
+	if expiresAt.Before(time.Now()) {
+		return errors.New("expires_at should be in the future")
+	}
+	if expiresAt.After(time.Now().Add(maxShareLifetime)) {
+		return fmt.Errorf("share links can be valid for at most %d days", int(maxShareLifetime.Hours()/24))
+	}
+	return nil
+}
+
+// FindShareLinks List the share links of an image
+func FindShareLinks(c *gin.Context) {
+	var image models.Image
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&image).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+	if !authorizeManageImage(c, image) {
+		return
+	}
+
+	var links []models.ShareLink
+	models.Database.Where("image_id = ?", image.ID).Order("created_at DESC").Find(&links)
+
+	output := make([]ShareLinkOutput, 0, len(links))
+	for _, link := range links {
+		output = append(output, ShareLinkOutput{ShareLink: link, URL: shareLinkURL(c, image, link)})
+	}
+	c.JSON(http.StatusOK, gin.H{"data": output})
+}
+
+// FindAllShareLinks List all share links which have not expired or been revoked
+func FindAllShareLinks(c *gin.Context) {
+	var links []models.ShareLink
+	models.Database.Where("revoked_at IS NULL AND expires_at > ?", time.Now()).Order("created_at DESC").Find(&links)
+
+	c.JSON(http.StatusOK, gin.H{"data": links})
+}
+
+// RevokeShareLink Revoke a share link, it stops working immediately
+func RevokeShareLink(c *gin.Context) {
+	var link models.ShareLink
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&link).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+	var image models.Image
+	if err := models.Database.Unscoped().First(&image, link.ImageID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return
+	}
+	if !authorizeManageImage(c, image) {
+		return
+	}
+
+	if err := link.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": link})
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"slidescope/models"
+)
+
+// findTag Get the tag the route refers to
+func findTag(c *gin.Context) (models.Tag, bool) {
+	var tag models.Tag
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&tag).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return tag, false
+	}
+	return tag, true
+}
+
+// tagNameTaken Check if another tag already has this name
+func tagNameTaken(name string, exceptID uint) bool {
+	var count int64
+	models.Database.Model(&models.Tag{}).Where("name = ? AND id <> ?", name, exceptID).Count(&count)
+	return count > 0
+}
+
+// FindTags Find all tags
+func FindTags(c *gin.Context) {
+	var tags []models.Tag
+	models.Database.Order("name").Find(&tags)
+
+	c.JSON(http.StatusOK, gin.H{"data": tags})
+}
+
+type TagInput struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// CreateTag Create a new tag
+func CreateTag(c *gin.Context) {
+	var input TagInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if tagNameTaken(input.Name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("tag %s already exists", input.Name)})
+		return
+	}
+
+	tag := models.Tag{Name: input.Name}
+	models.Database.Create(&tag)
+
+	c.JSON(http.StatusOK, gin.H{"data": tag})
+}
+
+// UpdateTag Rename a tag
+func UpdateTag(c *gin.Context) {
+	tag, ok := findTag(c)
+	if !ok {
+		return
+	}
+
+	var input TagInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if tagNameTaken(input.Name, tag.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("tag %s already exists", input.Name)})
+		return
+	}
+
+	tag.Name = input.Name
+	models.Database.Save(&tag)
+
+	c.JSON(http.StatusOK, gin.H{"data": tag})
+}
+
+// DeleteTag Delete a tag and remove it from all images
+func DeleteTag(c *gin.Context) {
+	tag, ok := findTag(c)
+	if !ok {
+		return
+	}
+
+	err := models.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&tag).Association("Images").Clear(); err != nil {
+			return err
+		}
+		// The name is unique, so the tag is removed permanently to allow reusing the name
+		return tx.Unscoped().Delete(&tag).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// AddTagImages Tag images in bulk
+func AddTagImages(c *gin.Context) {
+	tag, ok := findTag(c)
+	if !ok {
+		return
+	}
+
+	var input ImageIDsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	images, err := models.FindImagesByID(input.ImageIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.Database.Model(&tag).Association("Images").Append(images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
+
+// RemoveTagImages Remove a tag from images in bulk
+func RemoveTagImages(c *gin.Context) {
+	tag, ok := findTag(c)
+	if !ok {
+		return
+	}
+
+	var input ImageIDsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	images, err := models.FindImagesByID(input.ImageIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.Database.Model(&tag).Association("Images").Delete(images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
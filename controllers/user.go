@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"slidescope/middlewares"
+	"slidescope/models"
+)
+
+// findUser Find the user in the id parameter, and write a not found response otherwise
+func findUser(c *gin.Context) (models.User, bool) {
+	var u models.User
+	if err := models.Database.Where("id = ?", c.Param("id")).First(&u).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found!"})
+		return u, false
+	}
+	return u, true
+}
+
+// notSelf Admins cannot disable, delete or demote their own account, so there is always an admin left
+func notSelf(c *gin.Context, u models.User) bool {
+	if current, ok := middlewares.CurrentUser(c); ok && current.ID == u.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot change your own account"})
+		return false
+	}
+	return true
+}
+
+// FindUsers List all users, pass ?q= to search on username
+func FindUsers(c *gin.Context) {
+	var users []models.User
+
+	query := models.Database
+	if q := c.Query("q"); q != "" {
+		query = query.Where("username LIKE ?", "%"+q+"%")
+	}
+	query.Order("username").Find(&users)
+
+	c.JSON(http.StatusOK, gin.H{"data": users})
+}
+
+// FindUser Find a user
+func FindUser(c *gin.Context) {
+	u, ok := findUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": u})
+}
+
+type UpdateUserInput struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// UpdateUser Assign a role to a user. The role of directory users is updated from their groups on every login.
+func UpdateUser(c *gin.Context) {
+	u, ok := findUser(c)
+	if !ok {
+		return
+	}
+
+	var input UpdateUserInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.ValidRole(input.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role should be one of admin, annotator or viewer"})
+		return
+	}
+	if input.Role != models.RoleAdmin && !notSelf(c, u) {
+		return
+	}
+
+	u.Role = input.Role
+	models.Database.Model(&u).Update("role", u.Role)
+
+	c.JSON(http.StatusOK, gin.H{"data": u})
+}
+
+// DisableUser Disable a user, they cannot log in anymore and their sessions end
+func DisableUser(c *gin.Context) {
+	u, ok := findUser(c)
+	if !ok || !notSelf(c, u) {
+		return
+	}
+
+	if err := u.SetDisabled(true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": u})
+}
+
+// EnableUser Enable a disabled or locked user
+func EnableUser(c *gin.Context) {
+	u, ok := findUser(c)
+	if !ok {
+		return
+	}
+
+	if err := u.SetDisabled(false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	u.FailedLogins = 0
+	u.LockedUntil = nil
+
+	c.JSON(http.StatusOK, gin.H{"data": u})
+}
+
+type ResetPasswordInput struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// ResetPassword Set a new password for a local user, their sessions end
+func ResetPassword(c *gin.Context) {
+	u, ok := findUser(c)
+	if !ok {
+		return
+	}
+
+	var input ResetPasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := u.SetPassword(input.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password changed"})
+}
+
+// DeleteUser Delete a user, their sessions end and their API keys are revoked
+func DeleteUser(c *gin.Context) {
+	u, ok := findUser(c)
+	if !ok || !notSelf(c, u) {
+		return
+	}
+
+	if err := models.DeleteUser(&u); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
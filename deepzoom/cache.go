@@ -18,6 +18,8 @@ type NamedDeepZoom struct {
 type cachedDeepZoom struct {
 	NamedDeepZoom
 	expireAtTimestamp int64
+	readers           int  // Requests which use the deepzoom, its slide is only closed when there are none
+	removed           bool // The deepzoom is no longer in the cache, the last reader closes its slide
 }
 
 type LocalCache struct {
@@ -25,15 +27,21 @@ type LocalCache struct {
 
 	wg        sync.WaitGroup
 	mu        sync.RWMutex
-	deepzooms map[string]cachedDeepZoom
+	deepzooms map[string]*cachedDeepZoom
+	lifetime  time.Duration // How long a deepzoom is kept after it was added
+	maxSlides int           // Number of deepzooms kept, 0 does not limit it
 }
 
+// defaultCacheLifetime How long a deepzoom is kept when SetLimits is not called
+const defaultCacheLifetime = 500 * time.Second
+
 // NewLocalCache Create a new local cache
 func NewLocalCache(cleanupInterval time.Duration) *LocalCache {
 	log.Info("Creating new cache with cleanup interval ", cleanupInterval)
 	lc := &LocalCache{
-		deepzooms: make(map[string]cachedDeepZoom),
+		deepzooms: make(map[string]*cachedDeepZoom),
 		stop:      make(chan struct{}),
+		lifetime:  defaultCacheLifetime,
 	}
 
 	lc.wg.Add(1)
@@ -59,9 +67,7 @@ func (lc *LocalCache) cleanupLoop(interval time.Duration) {
 			for uid, cu := range lc.deepzooms {
 				if cu.expireAtTimestamp <= time.Now().Unix() {
 					log.Info("Deepzoom Expired: ", uid)
-					// Close underlying slide
-					lc.deepzooms[uid].DeepZoom.Slide.Close()
-					delete(lc.deepzooms, uid)
+					lc.delete(uid)
 				}
 			}
 			lc.mu.Unlock()
@@ -69,51 +75,121 @@ func (lc *LocalCache) cleanupLoop(interval time.Duration) {
 	}
 }
 
+// SetLimits Set how long deepzooms are kept and how many, 0 does not limit the number.
+// The limits can be changed while the cache is in use, deepzooms over the new limit are removed.
+func (lc *LocalCache) SetLimits(lifetime time.Duration, maxSlides int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.lifetime = lifetime
+	lc.maxSlides = maxSlides
+	for lc.maxSlides > 0 && len(lc.deepzooms) > lc.maxSlides {
+		lc.deleteOldest()
+	}
+}
+
+// Lifetime How long a deepzoom added now is kept
+func (lc *LocalCache) Lifetime() time.Duration {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.lifetime
+}
+
+// deleteOldest Delete the deepzoom which expires first, the caller should hold the lock
+func (lc *LocalCache) deleteOldest() {
+	oldest := ""
+	var oldestExpiry int64
+	for id, cu := range lc.deepzooms {
+		if oldest == "" || cu.expireAtTimestamp < oldestExpiry {
+			oldest, oldestExpiry = id, cu.expireAtTimestamp
+		}
+	}
+	lc.delete(oldest)
+}
+
 func (lc *LocalCache) stopCleanup() {
 	close(lc.stop)
 	lc.wg.Wait()
 }
 
-// Update Add deepzoom to cache
-func (lc *LocalCache) Update(u NamedDeepZoom, expireAtTimestamp int64) error {
+// Update Add deepzoom to cache, and use it until release is called. When another request added the same deepzoom
+// first, the slide of u is closed and the cached deepzoom is returned instead.
+func (lc *LocalCache) Update(u NamedDeepZoom, expireAtTimestamp int64) (NamedDeepZoom, func(), error) {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
 	log.Debug(fmt.Sprintf("Updating %s in cache", u.Id))
 
-	lc.deepzooms[u.Id] = cachedDeepZoom{
+	if cu, ok := lc.deepzooms[u.Id]; ok {
+		u.DeepZoom.Slide.Close()
+		return cu.NamedDeepZoom, lc.acquire(cu), nil
+	}
+	for lc.maxSlides > 0 && len(lc.deepzooms) >= lc.maxSlides {
+		lc.deleteOldest()
+	}
+	cu := &cachedDeepZoom{
 		NamedDeepZoom:     u,
 		expireAtTimestamp: expireAtTimestamp,
 	}
-	log.Debug(fmt.Sprintf("There are now %s items in cache", len(lc.deepzooms)))
-	return nil
+	lc.deepzooms[u.Id] = cu
+	log.Debug(fmt.Sprintf("There are now %d items in cache", len(lc.deepzooms)))
+	return u, lc.acquire(cu), nil
 }
 
 var (
 	errImageNotInCache = errors.New("the deepzoom isn't in cache")
 )
 
-// Read Read deepzoom from cache
-func (lc *LocalCache) Read(id string) (NamedDeepZoom, error) {
-	lc.mu.RLock()
-	defer lc.mu.RUnlock()
+// Read Read deepzoom from cache, and use it until release is called
+func (lc *LocalCache) Read(id string) (NamedDeepZoom, func(), error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
 	log.Debug("Reading from cache with ID ", id)
 	cu, ok := lc.deepzooms[id]
 	if !ok {
 		log.Debug("ID not found ", id)
-		return NamedDeepZoom{}, errImageNotInCache
+		return NamedDeepZoom{}, nil, errImageNotInCache
 	}
 
-	return cu.NamedDeepZoom, nil
+	return cu.NamedDeepZoom, lc.acquire(cu), nil
+}
+
+// acquire Count a reader of the deepzoom, and return the function which releases it. The caller should hold the lock.
+func (lc *LocalCache) acquire(cu *cachedDeepZoom) func() {
+	cu.readers++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lc.mu.Lock()
+			defer lc.mu.Unlock()
+			cu.readers--
+			if cu.removed && cu.readers == 0 {
+				log.Debug("Closing slide with ID ", cu.Id)
+				cu.DeepZoom.Slide.Close()
+			}
+		})
+	}
 }
 
-// delete Delete item from cache
+// delete Delete item from cache, the caller should hold the lock. The slide is closed now, or by the last request
+// which still reads from it.
 func (lc *LocalCache) delete(id string) {
+	cu, ok := lc.deepzooms[id]
+	if !ok {
+		return
+	}
+	delete(lc.deepzooms, id)
+	cu.removed = true
+	if cu.readers == 0 {
+		log.Debug("Closing slide with ID ", id)
+		cu.DeepZoom.Slide.Close()
+	}
+}
+
+// Invalidate Remove a deepzoom from the cache, for instance when the path changed. Its slide is closed once the
+// requests which still read from it are done, new requests open the slide again.
+func (lc *LocalCache) Invalidate(id string) {
 	lc.mu.Lock()
 	defer lc.mu.Unlock()
-	// Close underlying slide
-	log.Debug("Closing slide with ID ", id)
-	lc.deepzooms[id].DeepZoom.Slide.Close()
-	delete(lc.deepzooms, id)
+	lc.delete(id)
 }
 
 // EmptyCache Remove all elements from cache and close all file handlers
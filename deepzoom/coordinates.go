@@ -0,0 +1,135 @@
+package deepzoom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CoordinateSystem The coordinate systems a point in a slide can be expressed in
+type CoordinateSystem string
+
+const (
+	// SystemDeepZoom Pixel coordinates at a DeepZoom level
+	SystemDeepZoom CoordinateSystem = "deepzoom"
+	// SystemTile Tile column and row at a DeepZoom level, fractional values address pixels within a tile
+	SystemTile CoordinateSystem = "tile"
+	// SystemSlide Pixel coordinates at an openslide level
+	SystemSlide CoordinateSystem = "slide"
+	// SystemLevel0 Pixel coordinates at openslide level 0, as used by ReadRegion
+	SystemLevel0 CoordinateSystem = "level0"
+	// SystemBounds Pixel coordinates at level 0, relative to the top-left corner of the bounds (active area)
+	SystemBounds CoordinateSystem = "bounds"
+	// SystemMicron Physical coordinates in microns, relative to the level 0 origin
+	SystemMicron CoordinateSystem = "micron"
+)
+
+// CoordinateSpace A coordinate system together with the level it refers to.
+// The level is ignored for systems which do not have one (level0, bounds and micron).
+type CoordinateSpace struct {
+	System CoordinateSystem `json:"system"`
+	Level  int              `json:"level"`
+}
+
+// Region A rectangle given by its top-left location and size
+type Region struct {
+	Location [2]float64 `json:"location"`
+	Size     [2]float64 `json:"size"`
+}
+
+// toLevel0Scale Get the factor to multiply coordinates in space with to obtain level 0 pixels.
+func (deepZoom DeepZoom) toLevel0Scale(space CoordinateSpace) ([2]float64, error) {
+	switch space.System {
+	case SystemDeepZoom, SystemTile:
+		if space.Level < 0 || space.Level >= deepZoom.levelCount {
+			return [2]float64{}, fmt.Errorf("invalid deepzoom level %d", space.Level)
+		}
+		downsample := deepZoom.level0zDownsamples[space.Level]
+		if space.System == SystemTile {
+			downsample *= float64(deepZoom.tileSize)
+		}
+		return [2]float64{downsample, downsample}, nil
+	case SystemSlide:
+		if space.Level < 0 || space.Level >= deepZoom.Slide.LevelCount() {
+			return [2]float64{}, fmt.Errorf("invalid slide level %d", space.Level)
+		}
+		downsample := deepZoom.Slide.LevelDownsample(space.Level)
+		return [2]float64{downsample, downsample}, nil
+	case SystemLevel0, SystemBounds:
+		return [2]float64{1.0, 1.0}, nil
+	case SystemMicron:
+		mpp, err := deepZoom.Slide.GetSpacing()
+		if err != nil {
+			return [2]float64{}, errors.New("slide has no mpp, cannot convert to or from microns")
+		}
+		if mpp[0] <= 0 || mpp[1] <= 0 {
+			return [2]float64{}, errors.New("slide has an invalid mpp, cannot convert to or from microns")
+		}
+		return [2]float64{1.0 / mpp[0], 1.0 / mpp[1]}, nil
+	}
+	return [2]float64{}, fmt.Errorf("unknown coordinate system %s", space.System)
+}
+
+// toLevel0Offset Get the level 0 location of the origin of space.
+func (deepZoom DeepZoom) toLevel0Offset(space CoordinateSpace) [2]float64 {
+	switch space.System {
+	case SystemDeepZoom, SystemTile, SystemBounds:
+		// The DeepZoom pyramid is built on the active area of the slide
+		return [2]float64{float64(deepZoom.level0Offset[0]), float64(deepZoom.level0Offset[1])}
+	}
+	return [2]float64{0, 0}
+}
+
+// ConvertPoint Convert a point from one coordinate space to another
+func (deepZoom DeepZoom) ConvertPoint(point [2]float64, from CoordinateSpace, to CoordinateSpace) ([2]float64, error) {
+	fromScale, err := deepZoom.toLevel0Scale(from)
+	if err != nil {
+		return [2]float64{}, err
+	}
+	toScale, err := deepZoom.toLevel0Scale(to)
+	if err != nil {
+		return [2]float64{}, err
+	}
+	fromOffset := deepZoom.toLevel0Offset(from)
+	toOffset := deepZoom.toLevel0Offset(to)
+
+	var output [2]float64
+	for i := 0; i < 2; i++ {
+		level0 := point[i]*fromScale[i] + fromOffset[i]
+		output[i] = (level0 - toOffset[i]) / toScale[i]
+	}
+	return output, nil
+}
+
+// ConvertRegion Convert a region from one coordinate space to another.
+// Only the location is shifted by the offset of the active area, the size is only rescaled.
+func (deepZoom DeepZoom) ConvertRegion(region Region, from CoordinateSpace, to CoordinateSpace) (Region, error) {
+	location, err := deepZoom.ConvertPoint(region.Location, from, to)
+	if err != nil {
+		return Region{}, err
+	}
+	fromScale, _ := deepZoom.toLevel0Scale(from)
+	toScale, _ := deepZoom.toLevel0Scale(to)
+
+	var size [2]float64
+	for i := 0; i < 2; i++ {
+		size[i] = region.Size[i] * fromScale[i] / toScale[i]
+	}
+	return Region{Location: location, Size: size}, nil
+}
+
+// TileForPoint Get the DeepZoom level and tile location containing a point.
+func (deepZoom DeepZoom) TileForPoint(point [2]float64, from CoordinateSpace, dzLevel int) ([2]int, error) {
+	tile, err := deepZoom.ConvertPoint(point, from, CoordinateSpace{System: SystemTile, Level: dzLevel})
+	if err != nil {
+		return [2]int{}, err
+	}
+	var location [2]int
+	for i := 0; i < 2; i++ {
+		location[i] = int(math.Floor(tile[i]))
+		if location[i] < 0 || location[i] >= deepZoom.levelTiles[dzLevel][i] {
+			return [2]int{}, errors.New("point is outside of the pyramid")
+		}
+	}
+	return location, nil
+}
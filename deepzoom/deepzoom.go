@@ -22,6 +22,7 @@ type DeepZoom struct {
 	levelCount          int
 	dzLevelToSlideLevel []int // List which maps the index of the dz level to the level in the underlying image
 	lzDownsamples       []float64
+	level0zDownsamples  []float64 // Downsample of each dz level with respect to level 0
 	level0Offset        [2]int
 	tileSize            int              // Tile size of the resulting pyramid
 	tileOverlap         int              // Amount the tiles should overlap
@@ -130,34 +131,39 @@ func CreateDeepZoom(slide openslide.Slide, tileSize int, tileOverlap int, respec
 	return dz, err
 }
 
-// GetCachedDeepZoom Get DeepZoom object from cache
-func GetCachedDeepZoom(cache *LocalCache, imageIdentifier string, imagePath string, tileSize int, tileOverlap int, respectLimits bool, format string) (*DeepZoom, error) {
+// GetCachedDeepZoom Get DeepZoom object from cache. The slide is only located on disk when it is not in the cache.
+// Call release when the DeepZoom is no longer used, its slide is not closed before that.
+func GetCachedDeepZoom(cache *LocalCache, imageIdentifier string, locate func() (string, error), tileSize int, tileOverlap int, respectLimits bool, format string) (*DeepZoom, func(), error) {
 	var cacheDeepZoom NamedDeepZoom
-	cacheDeepZoom, err := cache.Read(imageIdentifier)
+	cacheDeepZoom, release, err := cache.Read(imageIdentifier)
 	if err != nil {
 		// create the deepZoom in cache
 		log.Info(fmt.Sprintf("Not in cache, will add: %s", imageIdentifier))
+		imagePath, err := locate()
+		if err != nil {
+			return nil, nil, err
+		}
 		slide, err := openslide.Open(imagePath)
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, nil, errors.New(err.Error())
 		}
 		deepZoom, err := CreateDeepZoom(slide, tileSize, tileOverlap, respectLimits, format)
 		if err != nil {
-			return nil, errors.New(err.Error())
+			slide.Close()
+			return nil, nil, errors.New(err.Error())
 		}
 		// Caching the DeepZoom
-		cacheDeepZoom = NamedDeepZoom{
+		cacheDeepZoom, release, err = cache.Update(NamedDeepZoom{
 			Id:       imageIdentifier,
 			DeepZoom: &deepZoom,
-		}
-		err = cache.Update(cacheDeepZoom, time.Now().Unix()+500)
+		}, time.Now().Add(cache.Lifetime()).Unix())
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, nil, errors.New(err.Error())
 		}
 
 	}
 	deepZoom := cacheDeepZoom.DeepZoom
-	return deepZoom, nil
+	return deepZoom, release, nil
 }
 
 // createDeepZoom Helper function to create DeepZoom objects
@@ -231,6 +237,7 @@ func createDeepZoom(
 		LevelDimensions:     levelDimensions,
 		dzLevelToSlideLevel: dzLevelToSlideLevel,
 		lzDownsamples:       lzDownsamples,
+		level0zDownsamples:  level0zDownsamples,
 		level0Offset:        level0Offset,
 		tileSize:            tileSize,
 		tileOverlap:         tileOverlap,
@@ -308,11 +315,14 @@ func (deepZoom DeepZoom) GetDzi() (*DziImage, error) {
 }
 
 // GetAssociatedDzi Create DeepZoom XML for the associated images.
-func (deepZoom DeepZoom) GetAssociatedDzi(associatedName string) (*DziImage, error) {
+func (deepZoom DeepZoom) GetAssociatedDzi(associatedName string, deidentification *Deidentification) (*DziImage, error) {
 	dimensions, ok := deepZoom.Slide.AssociatedImageDimensions()[associatedName]
 	if !ok {
 		return nil, errors.New("associated image does not exist")
 	}
+	if deidentification != nil && deidentification.label == LabelHide && associatedName == AssociatedLabel {
+		return nil, ErrAssociatedImageHidden
+	}
 	v, _ := deepZoom._getDzi(dimensions)
 	return v, nil
 }
@@ -331,13 +341,16 @@ func rescaleIfNeeded(tile image.Image, tileInfo TileInfo) image.Image {
 	return newTile
 }
 
-// GetAssociatedTile Get a DeepZoom tile for an associated image
-func (deepZoom DeepZoom) GetAssociatedTile(associatedName string, dzLevel int, tLocation [2]int) (image.Image, error) {
+// GetAssociatedTile Get a DeepZoom tile for an associated image, de-identified by the policy
+func (deepZoom DeepZoom) GetAssociatedTile(associatedName string, dzLevel int, tLocation [2]int, deidentification *Deidentification) (image.Image, error) {
 	if tLocation[0] < 0 || tLocation[1] < 0 {
 		return nil, errors.New("negative locations are not supported")
 	}
 
-	associatedImage, _ := deepZoom.Slide.ReadAssociatedImage(associatedName)
+	associatedImage, err := deidentification.ReadAssociatedImage(*deepZoom.Slide, associatedName)
+	if err != nil {
+		return nil, err
+	}
 
 	associatedDeepZoom, _ := CreateAssociatedDeepZoom(
 		*deepZoom.Slide,
@@ -382,6 +395,24 @@ func (deepZoom DeepZoom) GetAssociatedTile(associatedName string, dzLevel int, t
 	return newTile, nil
 }
 
+// GetAssociatedThumbnail Get an associated image, de-identified by the policy, scaled so its longest side is at most size
+func (deepZoom DeepZoom) GetAssociatedThumbnail(associatedName string, size int, deidentification *Deidentification) (image.Image, error) {
+	associatedImage, err := deidentification.ReadAssociatedImage(*deepZoom.Slide, associatedName)
+	if err != nil {
+		return nil, err
+	}
+	bounds := associatedImage.Bounds()
+	scale := math.Min(float64(size)/float64(bounds.Dx()), float64(size)/float64(bounds.Dy()))
+	if scale >= 1 {
+		return associatedImage, nil
+	}
+	width := int(math.Max(1, math.Round(float64(bounds.Dx())*scale)))
+	height := int(math.Max(1, math.Round(float64(bounds.Dy())*scale)))
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(thumbnail, thumbnail.Bounds(), associatedImage, bounds, draw.Src, nil)
+	return thumbnail, nil
+}
+
 // GetTile Return a DeepZoom tile
 func (deepZoom DeepZoom) GetTile(dzLevel int, location [2]int) (image.Image, error) {
 	tileInfo, err := deepZoom.getTileInfo(dzLevel, location)
@@ -425,9 +456,46 @@ func (deepZoom DeepZoom) GetTile(dzLevel int, location [2]int) (image.Image, err
 	return output, err
 }
 
+// MaskTile Fill the pixels of a tile outside of a level 0 region with the background color. Pixels which are only
+// partly inside the region are filled too, so at low levels, where a pixel covers more than the region, nothing of
+// the slide is shown.
+func (deepZoom DeepZoom) MaskTile(tile image.Image, dzLevel int, tLocation [2]int, region Region) (image.Image, error) {
+	zRegion, err := deepZoom.ConvertRegion(
+		region,
+		CoordinateSpace{System: SystemLevel0},
+		CoordinateSpace{System: SystemDeepZoom, Level: dzLevel})
+	if err != nil {
+		return nil, err
+	}
+
+	// The first pixel of a tile which is not in the first row or column is in the overlap with the previous tile
+	var zOrigin [2]int
+	for i := 0; i < 2; i++ {
+		zOrigin[i] = deepZoom.tileSize * tLocation[i]
+		if tLocation[i] != 0 {
+			zOrigin[i] -= deepZoom.tileOverlap
+		}
+	}
+	visible := image.Rect(
+		int(math.Ceil(zRegion.Location[0]))-zOrigin[0],
+		int(math.Ceil(zRegion.Location[1]))-zOrigin[1],
+		int(math.Floor(zRegion.Location[0]+zRegion.Size[0]))-zOrigin[0],
+		int(math.Floor(zRegion.Location[1]+zRegion.Size[1]))-zOrigin[1],
+	)
+
+	bounds := tile.Bounds()
+	visible = visible.Add(bounds.Min).Intersect(bounds)
+	masked := image.NewRGBA(bounds)
+	draw.Draw(masked, bounds, image.NewUniform(deepZoom.bgColor), image.Point{}, draw.Src)
+	if !visible.Empty() {
+		draw.Draw(masked, visible, tile, visible.Min, draw.Src)
+	}
+	return masked, nil
+}
+
 // getTileInfo Return information requires to generate a DeepZoom tile
 func (deepZoom DeepZoom) getTileInfo(dzLevel int, tLocation [2]int) (TileInfo, error) {
-	if dzLevel < 0 || dzLevel > deepZoom.levelCount {
+	if dzLevel < 0 || dzLevel >= deepZoom.levelCount {
 		log.Info("Invalid level")
 		return TileInfo{}, errors.New("invalid level")
 	}
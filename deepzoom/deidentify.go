@@ -0,0 +1,211 @@
+package deepzoom
+
+import (
+	"errors"
+	"fmt"
+	"github.com/NKI-AI/openslide-go/openslide"
+	"image"
+	"image/color"
+	"image/draw"
+	"regexp"
+	"strings"
+)
+
+// Associated images which can show patient information
+const (
+	AssociatedLabel = "label"
+	AssociatedMacro = "macro"
+)
+
+// How the label is served after de-identification
+const (
+	LabelShow = "show"
+	LabelBlur = "blur"
+	LabelHide = "hide"
+)
+
+// blurBlocks The label is averaged over this many blocks along its longest side, which makes text unreadable
+const blurBlocks = 12
+
+// descriptionProperties Properties which hold the complete header of the slide. The Aperio ImageDescription has
+// fields such as Filename, User and the barcode, which are also served as properties of their own.
+var descriptionProperties = map[string]bool{
+	"openslide.comment":     true,
+	"tiff.ImageDescription": true,
+}
+
+// ErrAssociatedImageHidden The associated image is not served after de-identification
+var ErrAssociatedImageHidden = errors.New("associated image is hidden by the de-identification policy")
+
+// Deidentification How patient information is removed from a slide before it is served.
+// A nil policy serves the slide as it is.
+type Deidentification struct {
+	redactProperties  []*regexp.Regexp
+	label             string
+	macroLabelRegions map[string][4]float64
+}
+
+// NewDeidentification Create a policy which leaves out properties with a key matching one of the expressions, and
+// serves the label and the label area of the macro image as given by label
+func NewDeidentification(redactProperties []string, label string, macroLabelRegions map[string][4]float64) (*Deidentification, error) {
+	policy := &Deidentification{label: label, macroLabelRegions: macroLabelRegions}
+	switch label {
+	case "":
+		policy.label = LabelHide
+	case LabelShow, LabelBlur, LabelHide:
+	default:
+		return nil, fmt.Errorf("label should be one of show, blur or hide, not %s", label)
+	}
+	for _, expression := range redactProperties {
+		compiled, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile property expression %s: %w", expression, err)
+		}
+		policy.redactProperties = append(policy.redactProperties, compiled)
+	}
+	for vendor, region := range macroLabelRegions {
+		if region[0] < 0 || region[1] < 0 || region[2] <= 0 || region[3] <= 0 || region[0]+region[2] > 1 || region[1]+region[3] > 1 {
+			return nil, fmt.Errorf("macro label region of %s should be fractions of the macro image", vendor)
+		}
+	}
+	return policy, nil
+}
+
+// Properties The properties without the redacted keys. The redacted fields are also removed from the descriptions
+// which hold the complete header of the slide.
+func (policy *Deidentification) Properties(properties map[string]string) map[string]string {
+	if policy == nil {
+		return properties
+	}
+	filtered := make(map[string]string, len(properties))
+	for key, value := range properties {
+		if policy.redacted(key) {
+			continue
+		}
+		if descriptionProperties[key] {
+			value = policy.scrubDescription(value, properties[propVendor])
+		}
+		filtered[key] = value
+	}
+	return filtered
+}
+
+// scrubDescription Remove the name = value fields of a description, separated by | or newlines, whose name is
+// redacted on its own or as a property of the vendor, such as Filename as aperio.Filename
+func (policy *Deidentification) scrubDescription(description string, vendor string) string {
+	lines := strings.Split(description, "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, "|")
+		kept := fields[:0]
+		for _, field := range fields {
+			name, _, ok := strings.Cut(field, "=")
+			name = strings.TrimSpace(name)
+			if ok && name != "" && (policy.redacted(name) || policy.redacted(vendor+"."+name)) {
+				continue
+			}
+			kept = append(kept, field)
+		}
+		lines[i] = strings.Join(kept, "|")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redacted Check if the property should be left out
+func (policy *Deidentification) redacted(key string) bool {
+	for _, expression := range policy.redactProperties {
+		if expression.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssociatedImageNames The associated images of the slide which are served
+func (policy *Deidentification) AssociatedImageNames(slide openslide.Slide) []string {
+	names := slide.AssociatedImageNames()
+	if policy == nil || policy.label != LabelHide {
+		return names
+	}
+	var served []string
+	for _, name := range names {
+		if name != AssociatedLabel {
+			served = append(served, name)
+		}
+	}
+	return served
+}
+
+// ReadAssociatedImage Read an associated image of the slide, with the label blurred or hidden.
+// Returns ErrAssociatedImageHidden for the label when it is hidden.
+func (policy *Deidentification) ReadAssociatedImage(slide openslide.Slide, name string) (image.Image, error) {
+	if policy != nil && policy.label == LabelHide && name == AssociatedLabel {
+		return nil, ErrAssociatedImageHidden
+	}
+	associatedImage, err := slide.ReadAssociatedImage(name)
+	if err != nil || policy == nil || policy.label == LabelShow {
+		return associatedImage, err
+	}
+
+	bounds := associatedImage.Bounds()
+	switch name {
+	case AssociatedLabel:
+		return policy.redact(associatedImage, bounds), nil
+	case AssociatedMacro:
+		region, ok := policy.macroLabelRegions[slide.PropertyValue(propVendor)]
+		if !ok {
+			region, ok = policy.macroLabelRegions["default"]
+		}
+		if !ok {
+			// Without a known label area the complete macro image can show the label
+			return policy.redact(associatedImage, bounds), nil
+		}
+		width, height := float64(bounds.Dx()), float64(bounds.Dy())
+		labelArea := image.Rect(
+			bounds.Min.X+int(region[0]*width),
+			bounds.Min.Y+int(region[1]*height),
+			bounds.Min.X+int((region[0]+region[2])*width+0.5),
+			bounds.Min.Y+int((region[1]+region[3])*height+0.5),
+		).Intersect(bounds)
+		return policy.redact(associatedImage, labelArea), nil
+	}
+	return associatedImage, nil
+}
+
+// redact Blur or blank the area of the image
+func (policy *Deidentification) redact(img image.Image, area image.Rectangle) image.Image {
+	output := image.NewRGBA(img.Bounds())
+	draw.Draw(output, output.Bounds(), img, img.Bounds().Min, draw.Src)
+	if area.Empty() {
+		return output
+	}
+	if policy.label == LabelHide {
+		draw.Draw(output, area, &image.Uniform{C: color.Black}, image.Point{}, draw.Src)
+		return output
+	}
+
+	// Replace blocks of the area by their average color
+	blockSize := area.Dx()
+	if area.Dy() > blockSize {
+		blockSize = area.Dy()
+	}
+	blockSize = (blockSize + blurBlocks - 1) / blurBlocks
+	for y := area.Min.Y; y < area.Max.Y; y += blockSize {
+		for x := area.Min.X; x < area.Max.X; x += blockSize {
+			block := image.Rect(x, y, x+blockSize, y+blockSize).Intersect(area)
+			var r, g, b, a, n uint64
+			for by := block.Min.Y; by < block.Max.Y; by++ {
+				for bx := block.Min.X; bx < block.Max.X; bx++ {
+					pixel := output.RGBAAt(bx, by)
+					r += uint64(pixel.R)
+					g += uint64(pixel.G)
+					b += uint64(pixel.B)
+					a += uint64(pixel.A)
+					n++
+				}
+			}
+			average := color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)}
+			draw.Draw(output, block, &image.Uniform{C: average}, image.Point{}, draw.Src)
+		}
+	}
+	return output
+}
@@ -0,0 +1,234 @@
+package deepzoom
+
+import (
+	"github.com/NKI-AI/openslide-go/openslide"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Property keys which are not exported by openslide-go
+const (
+	propVendor         = "openslide.vendor"
+	propQuickhash      = "openslide.quickhash-1"
+	propICCSize        = "openslide.icc-size"
+	propTiffXRes       = "tiff.XResolution"
+	propTiffYRes       = "tiff.YResolution"
+	propTiffResUnit    = "tiff.ResolutionUnit"
+	propTiffDateTime   = "tiff.DateTime"
+	propTiffModel      = "tiff.Model"
+	propTiffMake       = "tiff.Make"
+	propAperioMPP      = "aperio.MPP"
+	propAperioDate     = "aperio.Date"
+	propAperioTime     = "aperio.Time"
+	propPhilipsSpacing = "philips.DICOM_PIXEL_SPACING"
+)
+
+// Vendor specific property keys, in order of preference. The normalized openslide key always comes first.
+var (
+	objectivePowerKeys = []string{
+		openslide.PropObjectivePower,
+		"aperio.AppMag",
+		"hamamatsu.SourceLens",
+		"leica.objective",
+		"mirax.GENERAL.OBJECTIVE_MAGNIFICATION",
+		"ventana.Magnification",
+		"sakura.NominalLensMagnification",
+	}
+	scannerModelKeys = []string{
+		"aperio.ScanScope ID",
+		"hamamatsu.Product",
+		"leica.device-model",
+		"mirax.NONHIERLAYER_0_SECTION.SCANNER_HARDWARE_VERSION",
+		"philips.DICOM_MANUFACTURERS_MODEL_NAME",
+		"ventana.ScannerModel",
+		"sakura.ScannerModel",
+		propTiffModel,
+	}
+	acquisitionDateKeys = []string{
+		"hamamatsu.Created",
+		"leica.aperture-date",
+		"mirax.GENERAL.SLIDE_CREATIONDATETIME",
+		"philips.DICOM_ACQUISITION_DATETIME",
+		"ventana.ScanDate",
+		propTiffDateTime,
+	}
+	manufacturerKeys = []string{
+		"philips.DICOM_MANUFACTURER",
+		propTiffMake,
+	}
+)
+
+// LevelMetadata Dimensions and downsample of a single level in the slide
+type LevelMetadata struct {
+	Dimensions [2]int  `json:"dimensions"`
+	Downsample float64 `json:"downsample"`
+}
+
+// BoundsMetadata The active area of the slide in level 0 coordinates
+type BoundsMetadata struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// SlideMetadata Normalized metadata of a slide, independent of the vendor
+type SlideMetadata struct {
+	Vendor           string            `json:"vendor"`
+	Manufacturer     string            `json:"manufacturer,omitempty"`
+	ScannerModel     string            `json:"scanner_model,omitempty"`
+	AcquisitionDate  string            `json:"acquisition_date,omitempty"`
+	Dimensions       [2]int            `json:"dimensions"`
+	LevelCount       int               `json:"level_count"`
+	Levels           []LevelMetadata   `json:"levels"`
+	Mpp              *[2]float64       `json:"mpp"`
+	ObjectivePower   *float64          `json:"objective_power"`
+	Bounds           BoundsMetadata    `json:"bounds"`
+	BackgroundColor  string            `json:"background_color"`
+	AssociatedImages []string          `json:"associated_images"`
+	HasICCProfile    bool              `json:"has_icc_profile"`
+	Quickhash        string            `json:"quickhash,omitempty"`
+	Properties       map[string]string `json:"properties,omitempty"`
+}
+
+// GetSlideMetadata Read the normalized metadata from a slide. If withProperties is set the raw
+// openslide properties are included as well. Redacted properties and hidden associated images are left out.
+func GetSlideMetadata(slide openslide.Slide, withProperties bool, deidentification *Deidentification) SlideMetadata {
+	properties := deidentification.Properties(slide.Properties())
+
+	metadata := SlideMetadata{
+		Vendor:           properties[propVendor],
+		Manufacturer:     firstProperty(properties, manufacturerKeys),
+		ScannerModel:     firstProperty(properties, scannerModelKeys),
+		AcquisitionDate:  parseAcquisitionDate(properties),
+		Dimensions:       slide.LargestLevelDimensions(),
+		LevelCount:       slide.LevelCount(),
+		Mpp:              parseMpp(properties),
+		ObjectivePower:   parseObjectivePower(properties),
+		Bounds:           parseBounds(properties, slide.LargestLevelDimensions()),
+		BackgroundColor:  properties[openslide.PropBackgroundColor],
+		AssociatedImages: deidentification.AssociatedImageNames(slide),
+		HasICCProfile:    properties[propICCSize] != "" && properties[propICCSize] != "0",
+		Quickhash:        properties[propQuickhash],
+	}
+	if metadata.BackgroundColor == "" {
+		metadata.BackgroundColor = "ffffff"
+	}
+	if metadata.AssociatedImages == nil {
+		metadata.AssociatedImages = []string{}
+	}
+	sort.Strings(metadata.AssociatedImages)
+
+	for i := 0; i < slide.LevelCount(); i++ {
+		metadata.Levels = append(metadata.Levels, LevelMetadata{
+			Dimensions: slide.LevelDimensions(i),
+			Downsample: slide.LevelDownsample(i),
+		})
+	}
+
+	if withProperties {
+		metadata.Properties = properties
+	}
+	return metadata
+}
+
+// firstProperty Return the first non-empty value of the keys
+func firstProperty(properties map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value := strings.TrimSpace(properties[key]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parsePositiveFloat Parse a float, and only accept values larger than zero
+func parsePositiveFloat(value string) (float64, bool) {
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || parsed <= 0 {
+		return 0, false
+	}
+	return parsed, true
+}
+
+// parseMpp Get the microns per pixel in x and y direction from the properties.
+// Falls back to vendor specific keys and the TIFF resolution when openslide does not report it.
+func parseMpp(properties map[string]string) *[2]float64 {
+	mppX, okX := parsePositiveFloat(properties[openslide.PropMPPX])
+	mppY, okY := parsePositiveFloat(properties[openslide.PropMPPY])
+	if okX && okY {
+		return &[2]float64{mppX, mppY}
+	}
+
+	if mpp, ok := parsePositiveFloat(properties[propAperioMPP]); ok {
+		return &[2]float64{mpp, mpp}
+	}
+
+	// Philips reports the spacing in millimeters as "y x"
+	if spacing := strings.Fields(strings.Trim(properties[propPhilipsSpacing], "\"")); len(spacing) == 2 {
+		spacingY, okY := parsePositiveFloat(strings.Trim(spacing[0], "\""))
+		spacingX, okX := parsePositiveFloat(strings.Trim(spacing[1], "\""))
+		if okX && okY {
+			return &[2]float64{spacingX * 1000, spacingY * 1000}
+		}
+	}
+
+	// Generic TIFF: resolution is given in pixels per unit
+	var unitMicrons float64
+	switch strings.ToLower(properties[propTiffResUnit]) {
+	case "centimeter":
+		unitMicrons = 10000
+	case "inch":
+		unitMicrons = 25400
+	default:
+		return nil
+	}
+	resX, okX := parsePositiveFloat(properties[propTiffXRes])
+	resY, okY := parsePositiveFloat(properties[propTiffYRes])
+	if okX && okY {
+		return &[2]float64{unitMicrons / resX, unitMicrons / resY}
+	}
+	return nil
+}
+
+// parseObjectivePower Get the objective power from the properties, for instance 20 or 40.
+func parseObjectivePower(properties map[string]string) *float64 {
+	for _, key := range objectivePowerKeys {
+		value := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(properties[key])), "x")
+		if power, ok := parsePositiveFloat(value); ok {
+			return &power
+		}
+	}
+	return nil
+}
+
+// parseAcquisitionDate Get the date the slide was scanned, as reported by the scanner.
+func parseAcquisitionDate(properties map[string]string) string {
+	// Aperio splits date and time over two keys
+	if date := strings.TrimSpace(properties[propAperioDate]); date != "" {
+		if time := strings.TrimSpace(properties[propAperioTime]); time != "" {
+			return date + " " + time
+		}
+		return date
+	}
+	return firstProperty(properties, acquisitionDateKeys)
+}
+
+// parseBounds Get the bounds of the active area, which defaults to the full level 0 image.
+func parseBounds(properties map[string]string, level0Dimensions [2]int) BoundsMetadata {
+	bounds := BoundsMetadata{Width: level0Dimensions[0], Height: level0Dimensions[1]}
+	values := []*int{&bounds.X, &bounds.Y, &bounds.Width, &bounds.Height}
+	keys := []string{
+		openslide.PropBoundsX,
+		openslide.PropBoundsY,
+		openslide.PropBoundsWidth,
+		openslide.PropBoundsHeight,
+	}
+	for i, key := range keys {
+		if parsed, err := strconv.Atoi(properties[key]); err == nil {
+			*values[i] = parsed
+		}
+	}
+	return bounds
+}
@@ -6,11 +6,12 @@ import {ScaleLine, defaults as defaultControls} from 'ol/control';
 
 
 function loadUrl ( url,
-                   opt_options  // attributions (defaults to undefined), crossOrigin (defaults to 'anonymous')
+                   opt_options  // attributions (defaults to undefined), crossOrigin (defaults to 'anonymous'), query (defaults to '')
 ) {
 
     let options = opt_options || {};
     let crossOrigin = options.crossOrigin === undefined ? 'anonymous' : options.crossOrigin;
+    let query = options.query === undefined ? '' : options.query;
 
     let layer = new TileLayer({});
 
@@ -18,7 +19,7 @@ function loadUrl ( url,
     let path = url.slice(0, last);
 
     let xhr = new XMLHttpRequest();
-    xhr.open('GET', url);
+    xhr.open('GET', url + query);
     xhr.onload = function() {
 
         let parser = new DOMParser();
@@ -29,7 +30,7 @@ function loadUrl ( url,
         let format = elements[0].getAttribute('Format');
         let width = Number(elements[0].getElementsByTagName('Size')[0].getAttribute('Width'));
         let height = Number(elements[0].getElementsByTagName('Size')[0].getAttribute('Height'));
-        let url = path + '_files/{z}/{x}_{y}.' + format;
+        let url = path + '_files/{z}/{x}_{y}.' + format + query;
 
         let source = new Zoomify({
             attributions: options.attributions,
@@ -83,9 +84,15 @@ if (searchParams.has('id') === true) {
     dziUrl = 'deepzoom/' + imageId + '/slide.dzi'
     console.log("Loading deepzoom %s", dziUrl)
 
+    // Pass on the share link, so the viewer works without logging in
+    let query = searchParams.has('share') ? '?share=' + encodeURIComponent(searchParams.get('share')) : ''
+
     let layer = loadUrl(
         dziUrl,
-        { attributions: '&copy 2022, <a href="https://aiforoncology.nl/" target="_blank">AI for Oncology</a>' }
+        {
+            attributions: '&copy 2022, <a href="https://aiforoncology.nl/" target="_blank">AI for Oncology</a>',
+            query: query
+        }
     );
 
     layer.on('change:source', function(evt) {
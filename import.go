@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slidescope/ingest"
+	"strings"
+	"text/tabwriter"
+)
+
+// importUsage How the import subcommand is used
+const importUsage = "usage: slidescope [-config config.yaml] import [-dry-run] [-atomic] [-batch-size 100] manifest.csv|manifest.json"
+
+// runImport Run the import subcommand: import the images of a manifest, and print the outcome of every row
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate the manifest")
+	atomic := flags.Bool("atomic", false, "import none of the images when one of them is invalid")
+	batchSize := flags.Int("batch-size", 100, "images imported per transaction")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errors.New(importUsage)
+	}
+	if *batchSize < 1 {
+		return errors.New("batch-size should be a positive integer")
+	}
+
+	manifestPath := flags.Arg(0)
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(manifestPath)), ".")
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries, err := ingest.ParseManifest(file, format)
+	if err != nil {
+		return err
+	}
+
+	report := ingest.ImportManifest(entries, ingest.ImportOptions{DryRun: *dryRun, Atomic: *atomic, BatchSize: *batchSize, Actor: commandActor()})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROW\tIDENTIFIER\tPATH\tRESULT")
+	for _, row := range report.Rows {
+		result := row.Error
+		switch {
+		case row.Imported:
+			result = "imported (" + row.Vendor + ")"
+		case row.Error == "":
+			result = "valid (" + row.Vendor + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", row.Row, row.Identifier, row.Path, result)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d images, %d valid, %d imported, %d failed\n", report.Total, report.Valid, report.Imported, report.Failed)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d rows of the manifest failed", report.Failed)
+	}
+	return nil
+}
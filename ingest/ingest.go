@@ -0,0 +1,438 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NKI-AI/openslide-go/openslide"
+	log "github.com/sirupsen/logrus"
+	"slidescope/models"
+	"slidescope/storage"
+	"slidescope/utils"
+)
+
+// auditDetail The detail of the audit events of images and masks registered from a watch folder
+const auditDetail = "watch folder"
+
+// errWaiting The file is complete, but cannot be registered yet
+var errWaiting = errors.New("waiting")
+
+// fileState A file in a watch folder which is not registered yet
+type fileState struct {
+	root     string
+	path     string
+	size     int64
+	modTime  time.Time
+	since    time.Time // The size and modification time did not change since
+	mask     bool
+	detail   string // Why a complete file is still waiting
+	err      string // Why registering failed, the file is tried again when it changes
+	failedAt time.Time
+}
+
+// FileStatus A file in a watch folder which is waiting to be registered, or could not be registered
+type FileStatus struct {
+	StorageRoot string     `json:"storage_root"`
+	Path        string     `json:"path"`
+	Size        int64      `json:"size"`
+	Since       time.Time  `json:"since"` // The file did not change since
+	Detail      string     `json:"detail,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+}
+
+// Status The state of the watch folders
+type Status struct {
+	Folders  []utils.IngestFolder `json:"folders"`
+	LastScan *time.Time           `json:"last_scan"`
+	Ingested int                  `json:"ingested"` // Images and masks registered since SlideScope started
+	Pending  []FileStatus         `json:"pending"`
+	Failures []FileStatus         `json:"failures"`
+}
+
+// Ingester Registers the slides which appear in the watch folders as images, and their masks next to them.
+// The folders are polled, as network shares do not report changes.
+type Ingester struct {
+	config            utils.IngestConfig
+	roots             *storage.Roots
+	extensions        map[string]bool
+	identifierPattern *regexp.Regexp
+	maskPattern       *regexp.Regexp
+
+	mu       sync.Mutex
+	files    map[string]*fileState // By location on disk
+	lastScan time.Time
+	ingested int
+
+	scanNow chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New Create an ingester for the watch folders in the config, which have to be in the storage roots
+func New(config utils.IngestConfig, roots *storage.Roots) (*Ingester, error) {
+	ingester := &Ingester{
+		config:     config,
+		roots:      roots,
+		extensions: map[string]bool{},
+		files:      map[string]*fileState{},
+		scanNow:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	for _, extension := range config.Extensions {
+		ingester.extensions[strings.ToLower(extension)] = true
+	}
+
+	var err error
+	ingester.identifierPattern, err = regexp.Compile(config.IdentifierPattern)
+	if err != nil || ingester.identifierPattern.SubexpIndex("identifier") < 0 {
+		return nil, fmt.Errorf("identifier pattern %s should be an expression with an identifier group", config.IdentifierPattern)
+	}
+	if config.MaskPattern != "" {
+		ingester.maskPattern, err = regexp.Compile(config.MaskPattern)
+		if err != nil || ingester.maskPattern.SubexpIndex("identifier") < 0 || ingester.maskPattern.SubexpIndex("mask") < 0 {
+			return nil, fmt.Errorf("mask pattern %s should be an expression with identifier and mask groups", config.MaskPattern)
+		}
+	}
+	for _, folder := range config.Folders {
+		if _, err := roots.Resolve(folder.Root, folder.Path); err != nil {
+			return nil, fmt.Errorf("watch folder %s in %s: %w", folder.Path, folder.Root, err)
+		}
+	}
+	return ingester, nil
+}
+
+// Start Scan the watch folders in the background
+func (ingester *Ingester) Start() {
+	ingester.wg.Add(1)
+	go ingester.run()
+}
+
+// Stop Stop scanning, a registration in progress is finished first
+func (ingester *Ingester) Stop() {
+	close(ingester.done)
+	ingester.wg.Wait()
+}
+
+// run Scan the folders every poll interval, or when asked to
+func (ingester *Ingester) run() {
+	defer ingester.wg.Done()
+	ticker := time.NewTicker(time.Duration(ingester.config.PollSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		ingester.scan()
+		select {
+		case <-ingester.done:
+			return
+		case <-ticker.C:
+		case <-ingester.scanNow:
+		}
+	}
+}
+
+// Retry Try the files which failed again, and scan now
+func (ingester *Ingester) Retry() int {
+	ingester.mu.Lock()
+	retried := 0
+	for _, state := range ingester.files {
+		if state.err != "" {
+			state.err = ""
+			retried++
+		}
+	}
+	ingester.mu.Unlock()
+
+	select {
+	case ingester.scanNow <- struct{}{}:
+	default:
+	}
+	return retried
+}
+
+// Status The files which are waiting or failed, sorted by path
+func (ingester *Ingester) Status() Status {
+	ingester.mu.Lock()
+	defer ingester.mu.Unlock()
+
+	status := Status{
+		Folders:  ingester.config.Folders,
+		Ingested: ingester.ingested,
+		Pending:  []FileStatus{},
+		Failures: []FileStatus{},
+	}
+	if !ingester.lastScan.IsZero() {
+		lastScan := ingester.lastScan
+		status.LastScan = &lastScan
+	}
+	for _, state := range ingester.files {
+		file := FileStatus{
+			StorageRoot: state.root,
+			Path:        state.path,
+			Size:        state.size,
+			Since:       state.since,
+			Detail:      state.detail,
+		}
+		if state.err == "" {
+			status.Pending = append(status.Pending, file)
+			continue
+		}
+		failedAt := state.failedAt
+		file.Error = state.err
+		file.FailedAt = &failedAt
+		status.Failures = append(status.Failures, file)
+	}
+	for _, files := range [][]FileStatus{status.Pending, status.Failures} {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].StorageRoot+"/"+files[i].Path < files[j].StorageRoot+"/"+files[j].Path
+		})
+	}
+	return status
+}
+
+// isMask Check the filename is a mask by the naming convention
+func (ingester *Ingester) isMask(name string) bool {
+	return ingester.maskPattern != nil && ingester.maskPattern.MatchString(name)
+}
+
+// isSlide Check the filename has one of the slide extensions
+func (ingester *Ingester) isSlide(name string) bool {
+	return ingester.extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// registeredPaths The images and masks in the storage root, including deleted ones, so they do not come back
+func registeredPaths(root string) (map[string]bool, error) {
+	registered := map[string]bool{}
+	for _, model := range []interface{}{&models.Image{}, &models.MaskAnnotation{}} {
+		var paths []string
+		if err := models.Database.Model(model).Unscoped().Where("storage_root = ?", root).Pluck("path", &paths).Error; err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			registered[p] = true
+		}
+	}
+	return registered, nil
+}
+
+// scan Find the new files in the watch folders, and register the ones which are complete
+func (ingester *Ingester) scan() {
+	now := time.Now()
+	seen := map[string]bool{}
+	registered := map[string]map[string]bool{}
+
+	for _, folder := range ingester.config.Folders {
+		if _, ok := registered[folder.Root]; !ok {
+			paths, err := registeredPaths(folder.Root)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Cannot scan watch folders: %s", err.Error()))
+				return
+			}
+			registered[folder.Root] = paths
+		}
+		directory, err := ingester.roots.Resolve(folder.Root, folder.Path)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Cannot scan watch folder %s in %s: %s", folder.Path, folder.Root, err.Error()))
+			continue
+		}
+		folderPath, _ := storage.CleanPath(folder.Path)
+
+		filepath.WalkDir(directory, func(location string, entry fs.DirEntry, err error) error {
+			// Folders which cannot be read are skipped, they are tried again on the next scan
+			if err != nil || entry.IsDir() {
+				return nil
+			}
+			mask := ingester.isMask(entry.Name())
+			if !mask && !ingester.isSlide(entry.Name()) {
+				return nil
+			}
+			relative, err := filepath.Rel(directory, location)
+			if err != nil {
+				return nil
+			}
+			filePath := path.Join(folderPath, filepath.ToSlash(relative))
+			if registered[folder.Root][filePath] || seen[location] {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			seen[location] = true
+			ingester.observe(location, folder.Root, filePath, mask, info, now)
+			return nil
+		})
+	}
+
+	// Files which were removed or registered otherwise are forgotten. Slides are registered before masks, so a mask
+	// which arrived together with its slide is attached in the same scan.
+	var ready []*fileState
+	var locations []string
+	ingester.mu.Lock()
+	for location, state := range ingester.files {
+		if !seen[location] {
+			delete(ingester.files, location)
+			continue
+		}
+		if state.err == "" && ingester.complete(location, state, now) {
+			ready = append(ready, state)
+			locations = append(locations, location)
+		}
+	}
+	ingester.lastScan = now
+	ingester.mu.Unlock()
+
+	for _, slides := range []bool{true, false} {
+		for i, state := range ready {
+			if state.mask == slides {
+				continue
+			}
+			ingester.register(locations[i], state)
+		}
+	}
+}
+
+// observe Keep track of the size and modification time of a file, a change makes it wait again
+func (ingester *Ingester) observe(location string, root string, filePath string, mask bool, info fs.FileInfo, now time.Time) {
+	ingester.mu.Lock()
+	defer ingester.mu.Unlock()
+
+	state, ok := ingester.files[location]
+	if ok && state.size == info.Size() && state.modTime.Equal(info.ModTime()) {
+		return
+	}
+	ingester.files[location] = &fileState{
+		root:    root,
+		path:    filePath,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		since:   now,
+		mask:    mask,
+	}
+}
+
+// complete Check the scanner is done with the file: the marker next to it exists, or without markers, the file
+// did not change for the stable time
+func (ingester *Ingester) complete(location string, state *fileState, now time.Time) bool {
+	if ingester.config.MarkerSuffix != "" {
+		_, err := os.Stat(location + ingester.config.MarkerSuffix)
+		return err == nil
+	}
+	return now.Sub(state.since) >= time.Duration(ingester.config.StableSeconds)*time.Second
+}
+
+// register Register a complete file, and remember why it failed
+func (ingester *Ingester) register(location string, state *fileState) {
+	var err error
+	if state.mask {
+		err = ingester.attachMask(state)
+	} else {
+		err = ingester.registerSlide(state)
+	}
+
+	ingester.mu.Lock()
+	defer ingester.mu.Unlock()
+	switch {
+	case err == nil:
+		ingester.ingested++
+		delete(ingester.files, location)
+	case errors.Is(err, errWaiting):
+		state.detail = err.Error()
+	default:
+		log.Warn(fmt.Sprintf("Cannot register %s from watch folder in %s: %s", state.path, state.root, err.Error()))
+		state.detail = ""
+		state.err = err.Error()
+		state.failedAt = time.Now()
+	}
+}
+
+// registerSlide Register a slide as an image, with the identifier from its filename
+func (ingester *Ingester) registerSlide(state *fileState) error {
+	match := ingester.identifierPattern.FindStringSubmatch(path.Base(state.path))
+	if match == nil || match[ingester.identifierPattern.SubexpIndex("identifier")] == "" {
+		return errors.New("the filename does not match the identifier pattern")
+	}
+	identifier := match[ingester.identifierPattern.SubexpIndex("identifier")]
+	if models.ImageIdentifierTaken(identifier, 0) {
+		return fmt.Errorf("identifier %s already exists", identifier)
+	}
+
+	root, filePath, location, err := models.CheckStoragePath(state.root, state.path)
+	if err != nil {
+		return err
+	}
+	vendor, err := openslide.DetectVendor(location)
+	if err != nil {
+		return fmt.Errorf("cannot detect the vendor: %w", err)
+	}
+	image := models.Image{StorageRoot: root, Path: filePath, Identifier: identifier}
+	if err := image.ExtractMetadata(); err != nil {
+		return fmt.Errorf("cannot extract metadata: %w", err)
+	}
+	if err := models.Database.Create(&image).Error; err != nil {
+		if models.IsIdentifierConflict(err) {
+			return fmt.Errorf("identifier %s already exists", identifier)
+		}
+		return err
+	}
+	log.Info(fmt.Sprintf("Registered %s from watch folder as %s with vendor %s", filePath, identifier, vendor))
+	if duplicates, err := models.FindDuplicates(image); err == nil && len(duplicates) > 0 {
+		log.Warn(fmt.Sprintf("Image %s from watch folder has the same file as %s", identifier, duplicates[0].Identifier))
+	}
+	models.RecordAuditEvent(models.AuditActor{}, models.AuditImageCreate, image, auditDetail)
+	return nil
+}
+
+// attachMask Add a mask to the image in the same folder it is named after
+func (ingester *Ingester) attachMask(state *fileState) error {
+	match := ingester.maskPattern.FindStringSubmatch(path.Base(state.path))
+	imageIdentifier := match[ingester.maskPattern.SubexpIndex("identifier")]
+	maskIdentifier := match[ingester.maskPattern.SubexpIndex("mask")]
+	if imageIdentifier == "" || maskIdentifier == "" {
+		return errors.New("the filename does not match the mask pattern")
+	}
+
+	var image models.Image
+	if err := models.Database.Where("identifier = ?", imageIdentifier).First(&image).Error; err != nil {
+		return fmt.Errorf("%w for image %s", errWaiting, imageIdentifier)
+	}
+	if image.StorageRoot != state.root || path.Dir(image.Path) != path.Dir(state.path) {
+		return fmt.Errorf("image %s is in another folder", imageIdentifier)
+	}
+	var count int64
+	models.Database.Model(&models.MaskAnnotation{}).Where("image_id = ? AND identifier = ?", image.ID, maskIdentifier).Count(&count)
+	if count > 0 {
+		return fmt.Errorf("image %s already has a mask %s", imageIdentifier, maskIdentifier)
+	}
+
+	root, filePath, location, err := models.CheckStoragePath(state.root, state.path)
+	if err != nil {
+		return err
+	}
+	vendor, err := openslide.DetectVendor(location)
+	if err != nil {
+		return fmt.Errorf("cannot detect the vendor: %w", err)
+	}
+	mask := models.MaskAnnotation{
+		ImageID:     image.ID,
+		StorageRoot: root,
+		Path:        filePath,
+		Identifier:  maskIdentifier,
+		Vendor:      vendor,
+	}
+	if err := models.Database.Create(&mask).Error; err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Attached mask %s from watch folder to %s", maskIdentifier, imageIdentifier))
+	models.RecordAuditEvent(models.AuditActor{}, models.AuditMaskCreate, image, maskIdentifier)
+	return nil
+}
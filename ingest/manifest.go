@@ -0,0 +1,337 @@
+package ingest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/NKI-AI/openslide-go/openslide"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"slidescope/models"
+)
+
+// Formats of a manifest
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// manifestColumns The columns of a CSV manifest, identifier and path are required
+var manifestColumns = []string{"identifier", "storage_root", "path", "stain", "stain_marker", "masks"}
+
+// ManifestMask A mask of an image in a manifest, in the storage root of its image when it does not name one
+type ManifestMask struct {
+	Identifier  string `json:"identifier"`
+	StorageRoot string `json:"storage_root"`
+	Path        string `json:"path"`
+}
+
+// ManifestEntry An image in a manifest, in the default storage root when it does not name one
+type ManifestEntry struct {
+	Identifier  string         `json:"identifier"`
+	StorageRoot string         `json:"storage_root"`
+	Path        string         `json:"path"`
+	Stain       string         `json:"stain"`
+	StainMarker string         `json:"stain_marker"`
+	Masks       []ManifestMask `json:"masks"`
+
+	invalid string // Why the row of a CSV manifest cannot be read
+}
+
+// ParseManifest Read the images in a manifest. A JSON manifest is a list of entries. A CSV manifest has a header
+// with the columns identifier, path and optionally storage_root, stain, stain_marker and masks, in any order.
+// The masks are given as identifier=path pairs separated by semicolons.
+func ParseManifest(r io.Reader, format string) ([]ManifestEntry, error) {
+	switch format {
+	case FormatJSON:
+		var entries []ManifestEntry
+		if err := json.NewDecoder(r).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("cannot read the manifest: %w", err)
+		}
+		return entries, nil
+	case FormatCSV:
+		return parseCSVManifest(r)
+	}
+	return nil, fmt.Errorf("manifest should be csv or json, not %s", format)
+}
+
+// parseCSVManifest Read the images in a CSV manifest
+func parseCSVManifest(r io.Reader) ([]ManifestEntry, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the manifest header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, column := range manifestColumns {
+			known = known || column == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown manifest column %s, the columns are %s", name, strings.Join(manifestColumns, ", "))
+		}
+		columns[name] = i
+	}
+	for _, required := range []string{"identifier", "path"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the manifest needs a %s column", required)
+		}
+	}
+
+	var entries []ManifestEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the manifest: %w", err)
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		entry := ManifestEntry{
+			Identifier:  value("identifier"),
+			StorageRoot: value("storage_root"),
+			Path:        value("path"),
+			Stain:       value("stain"),
+			StainMarker: value("stain_marker"),
+		}
+		for _, pair := range strings.Split(value("masks"), ";") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				entry.invalid = fmt.Sprintf("masks should be identifier=path pairs, not %s", pair)
+				break
+			}
+			entry.Masks = append(entry.Masks, ManifestMask{Identifier: strings.TrimSpace(parts[0]), Path: strings.TrimSpace(parts[1])})
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ImportOptions How a manifest is imported
+type ImportOptions struct {
+	// DryRun only validates the entries
+	DryRun bool
+	// Atomic imports all entries or, when one of them is invalid, none
+	Atomic bool
+	// BatchSize is the number of images imported per transaction when the import is not atomic
+	BatchSize int
+	// Actor is who imports, for the audit log
+	Actor models.AuditActor
+	// Progress is called with the number of entries which have been validated, when it is set
+	Progress func(done int, total int)
+}
+
+// RowResult The outcome of one entry of the manifest
+type RowResult struct {
+	Row        int    `json:"row"` // Position in the manifest, from 1
+	Identifier string `json:"identifier"`
+	Path       string `json:"path"`
+	Vendor     string `json:"vendor,omitempty"`
+	Imported   bool   `json:"imported"`
+	Error      string `json:"error,omitempty"`
+	// DuplicateOf are the identifiers of images with the same file, in the library or earlier in the manifest.
+	// Duplicates are imported, they are only flagged.
+	DuplicateOf []string `json:"duplicate_of,omitempty"`
+}
+
+// ImportReport The outcome of importing a manifest
+type ImportReport struct {
+	DryRun   bool        `json:"dry_run"`
+	Atomic   bool        `json:"atomic"`
+	Total    int         `json:"total"`
+	Valid    int         `json:"valid"`
+	Imported int         `json:"imported"`
+	Failed   int         `json:"failed"`
+	Rows     []RowResult `json:"rows"`
+}
+
+// prepareEntry Check the slide and masks of an entry can be read, and extract the metadata of the slide
+func prepareEntry(entry ManifestEntry) (models.Image, string, error) {
+	if entry.Identifier == "" {
+		return models.Image{}, "", errors.New("identifier cannot be empty")
+	}
+	if models.ImageIdentifierTaken(entry.Identifier, 0) {
+		return models.Image{}, "", fmt.Errorf("identifier %s already exists", entry.Identifier)
+	}
+	root, path, location, err := models.CheckStoragePath(entry.StorageRoot, entry.Path)
+	if err != nil {
+		return models.Image{}, "", err
+	}
+	vendor, err := openslide.DetectVendor(location)
+	if err != nil {
+		return models.Image{}, "", fmt.Errorf("cannot detect the vendor of slide %s", path)
+	}
+	image := models.Image{
+		StorageRoot: root,
+		Path:        path,
+		Identifier:  entry.Identifier,
+		Stain:       entry.Stain,
+		StainMarker: entry.StainMarker,
+	}
+	if err := image.ExtractMetadata(); err != nil {
+		return models.Image{}, "", fmt.Errorf("cannot extract metadata of slide %s", path)
+	}
+
+	masks := map[string]bool{}
+	for _, mask := range entry.Masks {
+		if mask.Identifier == "" {
+			return models.Image{}, "", errors.New("mask identifier cannot be empty")
+		}
+		if masks[mask.Identifier] {
+			return models.Image{}, "", fmt.Errorf("mask identifier %s is used more than once", mask.Identifier)
+		}
+		masks[mask.Identifier] = true
+		maskRoot := mask.StorageRoot
+		if maskRoot == "" {
+			maskRoot = root
+		}
+		maskRoot, maskPath, maskLocation, err := models.CheckStoragePath(maskRoot, mask.Path)
+		if err != nil {
+			return models.Image{}, "", err
+		}
+		maskVendor, err := openslide.DetectVendor(maskLocation)
+		if err != nil {
+			return models.Image{}, "", fmt.Errorf("cannot detect the vendor of mask %s", maskPath)
+		}
+		image.MaskAnnotations = append(image.MaskAnnotations, models.MaskAnnotation{
+			StorageRoot: maskRoot,
+			Path:        maskPath,
+			Identifier:  mask.Identifier,
+			Vendor:      maskVendor,
+		})
+	}
+	return image, vendor, nil
+}
+
+// ImportManifest Validate all entries first, then import the valid ones. An atomic import stops when any entry is
+// invalid, otherwise the images are imported in batches, and a batch which cannot be stored fails on its own.
+func ImportManifest(entries []ManifestEntry, options ImportOptions) ImportReport {
+	report := ImportReport{DryRun: options.DryRun, Atomic: options.Atomic, Total: len(entries), Rows: make([]RowResult, len(entries))}
+	images := make([]*models.Image, len(entries))
+	identifiers := map[string]int{}
+	files := map[string]string{} // Identifier of the first row with a fingerprint and size
+
+	for i, entry := range entries {
+		if options.Progress != nil {
+			options.Progress(i, len(entries))
+		}
+		row := &report.Rows[i]
+		*row = RowResult{Row: i + 1, Identifier: entry.Identifier, Path: entry.Path}
+		if first, ok := identifiers[entry.Identifier]; ok && entry.Identifier != "" {
+			row.Error = fmt.Sprintf("identifier %s is also used in row %d", entry.Identifier, first)
+			continue
+		}
+		identifiers[entry.Identifier] = i + 1
+		if entry.invalid != "" {
+			row.Error = entry.invalid
+			continue
+		}
+
+		image, vendor, err := prepareEntry(entry)
+		if err != nil {
+			row.Error = err.Error()
+			continue
+		}
+		row.Vendor = vendor
+		if duplicates, err := models.FindDuplicates(image); err == nil {
+			for _, duplicate := range duplicates {
+				row.DuplicateOf = append(row.DuplicateOf, duplicate.Identifier)
+			}
+		}
+		file := fmt.Sprintf("%s/%d", image.Fingerprint, image.FileSize)
+		if first, ok := files[file]; ok {
+			row.DuplicateOf = append(row.DuplicateOf, first)
+		} else {
+			files[file] = image.Identifier
+		}
+		images[i] = &image
+		report.Valid++
+	}
+
+	if options.Progress != nil {
+		options.Progress(len(entries), len(entries))
+	}
+
+	report.Failed = report.Total - report.Valid
+	if options.DryRun || (options.Atomic && report.Failed > 0) {
+		return report
+	}
+
+	batchSize := options.BatchSize
+	if options.Atomic || batchSize <= 0 {
+		batchSize = len(entries)
+	}
+	for start := 0; start < len(entries); start += batchSize {
+		end := start + batchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		// An identifier which was registered since the rows were validated only fails its own row, unless the import
+		// is atomic. Each row is stored in a savepoint, as some databases refuse any statement after an error.
+		conflicts := map[int]bool{}
+		err := models.Database.Transaction(func(tx *gorm.DB) error {
+			for i := start; i < end; i++ {
+				if images[i] == nil {
+					continue
+				}
+				err := tx.Transaction(func(tx *gorm.DB) error {
+					return tx.Create(images[i]).Error
+				})
+				if models.IsIdentifierConflict(err) {
+					conflicts[i] = true
+					if options.Atomic {
+						return fmt.Errorf("identifier %s already exists", images[i].Identifier)
+					}
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("cannot store %s: %w", images[i].Identifier, err)
+				}
+			}
+			return nil
+		})
+
+		for i := start; i < end; i++ {
+			if images[i] == nil {
+				continue
+			}
+			if conflicts[i] {
+				report.Rows[i].Error = fmt.Sprintf("identifier %s already exists", images[i].Identifier)
+				report.Failed++
+				continue
+			}
+			if err != nil {
+				report.Rows[i].Error = err.Error()
+				report.Failed++
+				continue
+			}
+			report.Rows[i].Imported = true
+			report.Imported++
+			models.RecordAuditEvent(options.Actor, models.AuditImageCreate, *images[i], "bulk import")
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("Cannot import rows %d to %d of the manifest: %s", start+1, end, err.Error()))
+			if options.Atomic {
+				break
+			}
+		}
+	}
+	log.Info(fmt.Sprintf("Imported %d of %d images from a manifest", report.Imported, report.Total))
+	return report
+}
@@ -0,0 +1,298 @@
+package library
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"slidescope/models"
+	"slidescope/storage"
+)
+
+// Folder A folder in a storage root, including its subfolders. The path . is the complete root.
+type Folder struct {
+	StorageRoot string `json:"storage_root"`
+	Path        string `json:"path" binding:"required"`
+}
+
+// RelinkOptions Where the files of missing images are looked for
+type RelinkOptions struct {
+	// Folders are searched, with their subfolders, for files with the fingerprint of a missing image
+	Folders []Folder
+	// DryRun only reports which images and masks would be relinked
+	DryRun bool
+	// Actor is who relinks, for the audit log
+	Actor models.AuditActor
+	// Progress is called with the number of files fingerprinted, when it is set. The total is not known in advance.
+	Progress func(done int, total int)
+}
+
+// Relinked An image or mask whose file was found at another path
+type Relinked struct {
+	ID              uint   `json:"id"`
+	Identifier      string `json:"identifier"`
+	ImageIdentifier string `json:"image_identifier,omitempty"` // The image of a mask
+	OldStorageRoot  string `json:"old_storage_root"`
+	OldPath         string `json:"old_path"`
+	StorageRoot     string `json:"storage_root"`
+	Path            string `json:"path"`
+}
+
+// Ambiguous A missing image whose file was found more than once
+type Ambiguous struct {
+	Identifier string   `json:"identifier"`
+	Candidates []string `json:"candidates"` // As root/path
+}
+
+// RelinkReport The outcome of a relink
+type RelinkReport struct {
+	DryRun        bool        `json:"dry_run"`
+	Missing       int         `json:"missing"`        // Images whose file was not at its path
+	Scanned       int         `json:"scanned"`        // Files in the folders with the size of a missing image, which were fingerprinted
+	Relinked      []Relinked  `json:"relinked"`       // Images whose file was found, also in a dry run
+	Ambiguous     []Ambiguous `json:"ambiguous"`      // Images whose file was found more than once, these are not changed
+	NotFound      []string    `json:"not_found"`      // Identifiers of images whose file is still missing
+	NoFingerprint []string    `json:"no_fingerprint"` // Identifiers of missing images without a fingerprint to find them by
+	// RelinkedMasks are masks of relinked images which were found at the same place relative to the new path of the
+	// image. MasksNotFound are the other missing masks of relinked images, as image/mask.
+	RelinkedMasks []Relinked `json:"relinked_masks"`
+	MasksNotFound []string   `json:"masks_not_found"`
+}
+
+// fileKey A file by fingerprint and size
+type fileKey struct {
+	fingerprint string
+	size        int64
+}
+
+// fileMissing Check the file of the image cannot be found at its path
+func fileMissing(image models.Image) bool {
+	// Resolving fails when the file or the root does not exist
+	_, err := image.FilePath()
+	return err != nil
+}
+
+// CheckFolders Check the folders exist in their storage roots
+func CheckFolders(folders []Folder) error {
+	roots := models.StorageRoots()
+	for _, folder := range folders {
+		root := folder.StorageRoot
+		if root == "" {
+			root = storage.DefaultRoot
+		}
+		if _, err := roots.Resolve(root, folder.Path); err != nil {
+			return fmt.Errorf("folder %s in %s: %w", folder.Path, root, err)
+		}
+	}
+	return nil
+}
+
+// movedMasks Find the missing masks of an image which moved, at the same place relative to the new path of the image,
+// so masks which were moved along with their slide are relinked as well. Masks in another root than the old path of
+// the image, or whose file is not found, are left unchanged.
+func movedMasks(image Relinked) (moved []Relinked, notFound []string, err error) {
+	var masks []models.MaskAnnotation
+	if err := models.Database.Where("image_id = ?", image.ID).Order("id").Find(&masks).Error; err != nil {
+		return nil, nil, err
+	}
+	roots := models.StorageRoots()
+	for _, mask := range masks {
+		if _, err := mask.FilePath(); err == nil {
+			continue
+		}
+		candidate := ""
+		if mask.StorageRoot == image.OldStorageRoot {
+			oldFolder := filepath.FromSlash(path.Dir(image.OldPath))
+			if relative, err := filepath.Rel(oldFolder, filepath.FromSlash(mask.Path)); err == nil {
+				candidate = path.Join(path.Dir(image.Path), filepath.ToSlash(relative))
+			}
+		}
+		if candidate == "" {
+			notFound = append(notFound, image.Identifier+"/"+mask.Identifier)
+			continue
+		}
+		// Resolving fails when the candidate goes above the root or does not exist
+		if _, err := roots.Resolve(image.StorageRoot, candidate); err != nil {
+			notFound = append(notFound, image.Identifier+"/"+mask.Identifier)
+			continue
+		}
+		moved = append(moved, Relinked{
+			ID:              mask.ID,
+			Identifier:      mask.Identifier,
+			ImageIdentifier: image.Identifier,
+			OldStorageRoot:  mask.StorageRoot,
+			OldPath:         mask.Path,
+			StorageRoot:     image.StorageRoot,
+			Path:            candidate,
+		})
+	}
+	return moved, notFound, nil
+}
+
+// storeRelink Store the new paths of the image and its masks at once
+func storeRelink(image models.Image, relinked Relinked, masks []Relinked) error {
+	return models.Database.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&image).Updates(map[string]interface{}{
+			"storage_root": relinked.StorageRoot,
+			"path":         relinked.Path,
+		}).Error
+		if err != nil {
+			return err
+		}
+		for _, mask := range masks {
+			err := tx.Model(&models.MaskAnnotation{}).Where("id = ?", mask.ID).Updates(map[string]interface{}{
+				"storage_root": mask.StorageRoot,
+				"path":         mask.Path,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Relink Find the files of images which are missing in the folders, by fingerprint, and store their new paths.
+// Only files with the size of a missing image are fingerprinted, so the folders can be large. The missing masks of
+// a relinked image are looked for at the same place relative to its new path.
+func Relink(options RelinkOptions) (RelinkReport, error) {
+	report := RelinkReport{
+		DryRun:        options.DryRun,
+		Relinked:      []Relinked{},
+		Ambiguous:     []Ambiguous{},
+		NotFound:      []string{},
+		NoFingerprint: []string{},
+		RelinkedMasks: []Relinked{},
+		MasksNotFound: []string{},
+	}
+	roots := models.StorageRoots()
+	progress := options.Progress
+	if progress == nil {
+		progress = func(int, int) {}
+	}
+
+	var images []models.Image
+	if err := models.Database.Order("id").Find(&images).Error; err != nil {
+		return report, err
+	}
+	missing := map[fileKey][]models.Image{}
+	for _, image := range images {
+		if !fileMissing(image) {
+			continue
+		}
+		report.Missing++
+		if image.Fingerprint == "" {
+			report.NoFingerprint = append(report.NoFingerprint, image.Identifier)
+			continue
+		}
+		key := fileKey{image.Fingerprint, image.FileSize}
+		missing[key] = append(missing[key], image)
+	}
+	if len(missing) == 0 {
+		return report, nil
+	}
+	sizes := map[int64]bool{}
+	for key := range missing {
+		sizes[key.size] = true
+	}
+
+	// The files in the folders which have the fingerprint of a missing image, as root and path
+	found := map[fileKey][][2]string{}
+	for _, folder := range options.Folders {
+		root := folder.StorageRoot
+		if root == "" {
+			root = storage.DefaultRoot
+		}
+		directory, err := roots.Resolve(root, folder.Path)
+		if err != nil {
+			return report, fmt.Errorf("folder %s in %s: %w", folder.Path, root, err)
+		}
+		folderPath, _ := storage.CleanPath(folder.Path)
+		filepath.WalkDir(directory, func(location string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil || !sizes[info.Size()] {
+				return nil
+			}
+			fingerprint, size, err := storage.Fingerprint(location)
+			if err != nil {
+				return nil
+			}
+			report.Scanned++
+			progress(report.Scanned, 0)
+			key := fileKey{fingerprint, size}
+			if _, ok := missing[key]; !ok {
+				return nil
+			}
+			relative, err := filepath.Rel(directory, location)
+			if err != nil {
+				return nil
+			}
+			candidate := [2]string{root, path.Join(folderPath, filepath.ToSlash(relative))}
+			for _, seen := range found[key] {
+				if seen == candidate {
+					return nil
+				}
+			}
+			found[key] = append(found[key], candidate)
+			return nil
+		})
+	}
+
+	for key, keyImages := range missing {
+		candidates := found[key]
+		for _, image := range keyImages {
+			switch len(candidates) {
+			case 0:
+				report.NotFound = append(report.NotFound, image.Identifier)
+			case 1:
+				relinked := Relinked{
+					ID:             image.ID,
+					Identifier:     image.Identifier,
+					OldStorageRoot: image.StorageRoot,
+					OldPath:        image.Path,
+					StorageRoot:    candidates[0][0],
+					Path:           candidates[0][1],
+				}
+				masks, masksNotFound, err := movedMasks(relinked)
+				if err != nil {
+					return report, fmt.Errorf("cannot find the masks of %s: %w", image.Identifier, err)
+				}
+				if !options.DryRun {
+					if err := storeRelink(image, relinked, masks); err != nil {
+						return report, fmt.Errorf("cannot relink %s: %w", image.Identifier, err)
+					}
+					log.Info(fmt.Sprintf("Relinked %s from %s to %s", image.Identifier, relinked.OldPath, relinked.Path))
+					models.RecordAuditEvent(options.Actor, models.AuditImageUpdate, image, "relink")
+					for _, mask := range masks {
+						log.Info(fmt.Sprintf("Relinked mask %s of %s from %s to %s", mask.Identifier, image.Identifier, mask.OldPath, mask.Path))
+						models.RecordAuditEvent(options.Actor, models.AuditMaskUpdate, image, mask.Identifier)
+					}
+				}
+				report.Relinked = append(report.Relinked, relinked)
+				report.RelinkedMasks = append(report.RelinkedMasks, masks...)
+				report.MasksNotFound = append(report.MasksNotFound, masksNotFound...)
+			default:
+				ambiguous := Ambiguous{Identifier: image.Identifier}
+				for _, candidate := range candidates {
+					ambiguous.Candidates = append(ambiguous.Candidates, candidate[0]+"/"+candidate[1])
+				}
+				report.Ambiguous = append(report.Ambiguous, ambiguous)
+			}
+		}
+	}
+
+	sort.Slice(report.Relinked, func(i, j int) bool { return report.Relinked[i].ID < report.Relinked[j].ID })
+	sort.Slice(report.Ambiguous, func(i, j int) bool { return report.Ambiguous[i].Identifier < report.Ambiguous[j].Identifier })
+	sort.Slice(report.RelinkedMasks, func(i, j int) bool { return report.RelinkedMasks[i].ID < report.RelinkedMasks[j].ID })
+	sort.Strings(report.NotFound)
+	sort.Strings(report.MasksNotFound)
+	progress(report.Scanned, report.Scanned)
+	return report, nil
+}
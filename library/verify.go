@@ -0,0 +1,251 @@
+package library
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NKI-AI/openslide-go/openslide"
+	log "github.com/sirupsen/logrus"
+	"slidescope/models"
+	"slidescope/storage"
+)
+
+// verifyTileSize The width and height of the region read at every level of a slide
+const verifyTileSize = 256
+
+// Kinds of files which are verified
+const (
+	KindImage = "image"
+	KindMask  = "mask"
+)
+
+// VerifyOptions What is verified besides the images and masks in the database
+type VerifyOptions struct {
+	// Unregistered also walks the storage roots for slide files which are not registered
+	Unregistered bool
+	// Extensions of the slide files which are looked for when Unregistered is set
+	Extensions []string
+	// Progress is called with the number of images and masks which have been checked, when it is set
+	Progress func(done int, total int)
+}
+
+// Problem An image or mask whose file is not healthy
+type Problem struct {
+	Kind            string `json:"kind"` // image or mask
+	ID              uint   `json:"id"`
+	Identifier      string `json:"identifier"`
+	ImageIdentifier string `json:"image_identifier,omitempty"` // The image of a mask
+	StorageRoot     string `json:"storage_root"`
+	Path            string `json:"path"`
+	Error           string `json:"error"`
+}
+
+// VerifyReport The health of the files in the library
+type VerifyReport struct {
+	Images     int       `json:"images"`
+	Masks      int       `json:"masks"`
+	Healthy    int       `json:"healthy"`    // Images and masks without problems
+	Missing    []Problem `json:"missing"`    // The file cannot be found at its path
+	Unreadable []Problem `json:"unreadable"` // The file cannot be opened with openslide, or a tile cannot be read
+	Changed    []Problem `json:"changed"`    // The fingerprint of the file differs from the one stored for the image
+	Orphaned   []Problem `json:"orphaned"`   // Masks whose image was deleted
+	// NoFingerprint are identifiers of images without a stored fingerprint, their files cannot be checked for changes
+	NoFingerprint []string `json:"no_fingerprint"`
+	// Unregistered are slide files in the storage roots which are not an image or mask, as root/path. It is only
+	// filled in when the storage roots are walked.
+	Unregistered        []string `json:"unregistered"`
+	CheckedUnregistered bool     `json:"checked_unregistered"`
+}
+
+// checkSlide Open the file with openslide and read a region at the center of every level. The errors do not contain
+// the location on the server.
+func checkSlide(location string, path string) error {
+	slide, err := openslide.Open(location)
+	if err != nil {
+		return fmt.Errorf("cannot open %s with openslide", path)
+	}
+	defer slide.Close()
+	if slide.LevelCount() < 1 {
+		return fmt.Errorf("%s has no levels", path)
+	}
+	for level := 0; level < slide.LevelCount(); level++ {
+		dimensions := slide.LevelDimensions(level)
+		width, height := verifyTileSize, verifyTileSize
+		if dimensions[0] < width {
+			width = dimensions[0]
+		}
+		if dimensions[1] < height {
+			height = dimensions[1]
+		}
+		if width <= 0 || height <= 0 {
+			return fmt.Errorf("level %d of %s is empty", level, path)
+		}
+		// The position of a region is given in level 0 coordinates
+		downsample := slide.LevelDownsample(level)
+		x := int(float64(dimensions[0]/2-width/2) * downsample)
+		y := int(float64(dimensions[1]/2-height/2) * downsample)
+		if _, err := slide.ReadRegion(x, y, level, width, height); err != nil {
+			log.Debug(fmt.Sprintf("Cannot read level %d of %s: %s", level, path, err.Error()))
+			return fmt.Errorf("cannot read a tile at level %d of %s", level, path)
+		}
+	}
+	return nil
+}
+
+// verifyImage Check the file of an image exists, has not changed and can be read
+func verifyImage(image models.Image, report *VerifyReport) {
+	problem := Problem{Kind: KindImage, ID: image.ID, Identifier: image.Identifier, StorageRoot: image.StorageRoot, Path: image.Path}
+	location, err := image.FilePath()
+	if err != nil {
+		problem.Error = err.Error()
+		report.Missing = append(report.Missing, problem)
+		return
+	}
+	healthy := true
+	if image.Fingerprint == "" {
+		report.NoFingerprint = append(report.NoFingerprint, image.Identifier)
+	} else if fingerprint, size, err := storage.Fingerprint(location); err != nil {
+		problem.Error = fmt.Sprintf("cannot fingerprint %s", image.Path)
+		report.Unreadable = append(report.Unreadable, problem)
+		return
+	} else if fingerprint != image.Fingerprint || size != image.FileSize {
+		problem.Error = fmt.Sprintf("%s has %d bytes and fingerprint %s, %d bytes and fingerprint %s were stored",
+			image.Path, size, fingerprint, image.FileSize, image.Fingerprint)
+		report.Changed = append(report.Changed, problem)
+		healthy = false
+	}
+	if err := checkSlide(location, image.Path); err != nil {
+		problem.Error = err.Error()
+		report.Unreadable = append(report.Unreadable, problem)
+		return
+	}
+	if healthy {
+		report.Healthy++
+	}
+}
+
+// verifyMask Check the image of a mask exists, and its file exists and can be read
+func verifyMask(mask models.MaskAnnotation, images map[uint]string, report *VerifyReport) {
+	problem := Problem{Kind: KindMask, ID: mask.ID, Identifier: mask.Identifier, StorageRoot: mask.StorageRoot, Path: mask.Path}
+	identifier, ok := images[mask.ImageID]
+	if !ok {
+		problem.Error = fmt.Sprintf("image %d of mask %s does not exist", mask.ImageID, mask.Identifier)
+		report.Orphaned = append(report.Orphaned, problem)
+		return
+	}
+	problem.ImageIdentifier = identifier
+	location, err := mask.FilePath()
+	if err != nil {
+		problem.Error = err.Error()
+		report.Missing = append(report.Missing, problem)
+		return
+	}
+	if err := checkSlide(location, mask.Path); err != nil {
+		problem.Error = err.Error()
+		report.Unreadable = append(report.Unreadable, problem)
+		return
+	}
+	report.Healthy++
+}
+
+// findUnregistered Walk the storage roots for slide files which are not an image or mask, including deleted ones
+func findUnregistered(extensions []string) ([]string, error) {
+	registered := map[string]bool{}
+	for _, model := range []interface{}{&models.Image{}, &models.MaskAnnotation{}} {
+		var files []struct {
+			StorageRoot string
+			Path        string
+		}
+		if err := models.Database.Model(model).Unscoped().Select("storage_root", "path").Find(&files).Error; err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			registered[file.StorageRoot+"/"+file.Path] = true
+		}
+	}
+	slideExtensions := map[string]bool{}
+	for _, extension := range extensions {
+		slideExtensions[strings.ToLower(extension)] = true
+	}
+
+	unregistered := []string{}
+	roots := models.StorageRoots()
+	for _, name := range roots.Names() {
+		directory, _ := roots.Directory(name)
+		filepath.WalkDir(directory, func(location string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() || !slideExtensions[strings.ToLower(filepath.Ext(location))] {
+				return nil
+			}
+			relative, err := filepath.Rel(directory, location)
+			if err != nil {
+				return nil
+			}
+			file := name + "/" + filepath.ToSlash(relative)
+			if !registered[file] {
+				unregistered = append(unregistered, file)
+			}
+			return nil
+		})
+	}
+	sort.Strings(unregistered)
+	return unregistered, nil
+}
+
+// Verify Check the files of all images and masks: they exist, open with openslide, a tile can be read at every
+// level, and the files of images still have their fingerprint. Every file is read, so this takes a while for a
+// large library.
+func Verify(options VerifyOptions) (VerifyReport, error) {
+	report := VerifyReport{
+		Missing:       []Problem{},
+		Unreadable:    []Problem{},
+		Changed:       []Problem{},
+		Orphaned:      []Problem{},
+		NoFingerprint: []string{},
+		Unregistered:  []string{},
+	}
+
+	var images []models.Image
+	if err := models.Database.Order("id").Find(&images).Error; err != nil {
+		return report, err
+	}
+	var masks []models.MaskAnnotation
+	if err := models.Database.Order("id").Find(&masks).Error; err != nil {
+		return report, err
+	}
+	progress := options.Progress
+	if progress == nil {
+		progress = func(int, int) {}
+	}
+	total := len(images) + len(masks)
+
+	identifiers := make(map[uint]string, len(images))
+	for i, image := range images {
+		progress(i, total)
+		identifiers[image.ID] = image.Identifier
+		verifyImage(image, &report)
+	}
+	report.Images = len(images)
+	for i, mask := range masks {
+		progress(len(images)+i, total)
+		verifyMask(mask, identifiers, &report)
+	}
+	report.Masks = len(masks)
+	progress(total, total)
+
+	if options.Unregistered {
+		unregistered, err := findUnregistered(options.Extensions)
+		if err != nil {
+			return report, err
+		}
+		report.Unregistered = unregistered
+		report.CheckedUnregistered = true
+	}
+
+	log.Info(fmt.Sprintf("Verified %d images and %d masks: %d healthy, %d missing, %d unreadable, %d changed, %d orphaned",
+		report.Images, report.Masks, report.Healthy, len(report.Missing), len(report.Unreadable), len(report.Changed),
+		len(report.Orphaned)))
+	return report, nil
+}
@@ -3,6 +3,7 @@ package main
 import "C"
 import (
 	"context"
+	"flag"
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
@@ -12,33 +13,114 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"os/user"
+	"reflect"
 	"slidescope/controllers"
 	"slidescope/deepzoom"
+	"slidescope/ingest"
+	"slidescope/middlewares"
 	"slidescope/models"
+	"slidescope/storage"
 	"slidescope/utils"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-// CorsMiddleware Use middleware for CORS (Cross-Origin Resource Sharing)
-// TODO: This is too broad, cannot expose to the internet!
-// TODO: Allow to get the origins from the database or YAML/env?
-// Use middleware
-// CORS for * origins, allowing:
-// - PUT, GET, POST and PATCH methods
-// - Origin header
-// - Credentials share
-// - Preflight requests cached for 12 hours
-func corsMiddleware() gin.HandlerFunc {
-	_corsMiddleware := cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"PUT", "GET", "POST", "PATCH"},
-		AllowHeaders:     []string{"Origin"},
-		ExposeHeaders:    []string{"X-Requested-With, Content-Type, Origin, Authorization, Accept, Client-Security-Token, Accept-Encoding, x-access-token"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	})
-	return _corsMiddleware
+// corsMiddleware Allow cross-origin requests from the origins in the cors section of the config.
+// Without allowed origins no CORS headers are sent, and only the web frontend of SlideScope itself can use the API.
+func corsMiddleware(config utils.CORSConfig) (gin.HandlerFunc, error) {
+	if len(config.AllowOrigins) == 0 {
+		return nil, nil
+	}
+	corsConfig := cors.Config{
+		AllowOrigins:     config.AllowOrigins,
+		AllowMethods:     config.AllowMethods,
+		AllowHeaders:     config.AllowHeaders,
+		ExposeHeaders:    config.ExposeHeaders,
+		AllowCredentials: config.AllowCredentials,
+		MaxAge:           time.Duration(config.MaxAgeSeconds) * time.Second,
+	}
+	if len(config.AllowOrigins) == 1 && config.AllowOrigins[0] == "*" {
+		corsConfig.AllowOrigins = nil
+		corsConfig.AllowAllOrigins = true
+	}
+	if err := corsConfig.Validate(); err != nil {
+		return nil, err
+	}
+	return cors.New(corsConfig), nil
+}
+
+// reloadableCORS Applies the CORS settings of the config, which are replaced when the config is reloaded
+type reloadableCORS struct {
+	current atomic.Value // corsHandler
+}
+
+// corsHandler The CORS middleware, nil without allowed origins
+type corsHandler struct {
+	handler gin.HandlerFunc
+}
+
+// set Replace the CORS settings
+func (rc *reloadableCORS) set(config utils.CORSConfig) error {
+	handler, err := corsMiddleware(config)
+	if err != nil {
+		return err
+	}
+	rc.current.Store(corsHandler{handler: handler})
+	return nil
+}
+
+// middleware Apply the current CORS settings to the request
+func (rc *reloadableCORS) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if current := rc.current.Load().(corsHandler); current.handler != nil {
+			current.handler(c)
+		}
+	}
+}
+
+// applySettings Apply the settings which can be changed while SlideScope is running
+func applySettings(config *utils.Config, cache *deepzoom.LocalCache, corsSettings *reloadableCORS) error {
+	level, err := log.ParseLevel(config.Log.Level)
+	if err != nil {
+		return err
+	}
+	if err := corsSettings.set(config.CORS); err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	controllers.SetJPEGQuality(config.DeepZoom.JPEGQuality)
+	cache.SetLimits(time.Duration(config.DeepZoom.CacheSeconds)*time.Second, config.DeepZoom.CacheMaxSlides)
+	return nil
+}
+
+// reloadConfig Read the config file again and apply the settings which can be changed while running: the cache,
+// CORS, log level and jpeg quality. Returns the config in use, which is the current one when the new one is invalid.
+func reloadConfig(configPath string, current *utils.Config, cache *deepzoom.LocalCache, corsSettings *reloadableCORS) *utils.Config {
+	config, err := utils.NewConfig(configPath)
+	if err != nil {
+		log.Error(fmt.Sprintf("Not reloading the config: %s", err.Error()))
+		return current
+	}
+	if err := applySettings(config, cache, corsSettings); err != nil {
+		log.Error(fmt.Sprintf("Not reloading the config: %s", err.Error()))
+		return current
+	}
+
+	// Other settings only change on a restart, warn when they differ from the ones in use
+	reloaded := *current
+	reloaded.DeepZoom.JPEGQuality = config.DeepZoom.JPEGQuality
+	reloaded.DeepZoom.CacheSeconds = config.DeepZoom.CacheSeconds
+	reloaded.DeepZoom.CacheMaxSlides = config.DeepZoom.CacheMaxSlides
+	reloaded.CORS = config.CORS
+	reloaded.Log = config.Log
+	if !reflect.DeepEqual(&reloaded, config) {
+		log.Warn("Reloaded the cache, cors, log and jpeg quality settings, other changes take effect after a restart")
+	} else {
+		log.Info("Reloaded the config")
+	}
+	return &reloaded
 }
 
 // RequestIDMiddleware Generate a UUID and attach it to each request
@@ -50,6 +132,27 @@ func requestIDMiddleware() gin.HandlerFunc {
 	}
 }
 
+// startAuditLog Start recording who accessed which image when the audit log is enabled
+func startAuditLog(config utils.AuditConfig) {
+	if !config.Enabled {
+		return
+	}
+	idleTimeout := time.Duration(config.ViewingSessionMinutes) * time.Minute
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Minute
+	}
+	models.StartAuditLog(idleTimeout, time.Duration(config.RetentionDays)*24*time.Hour)
+}
+
+// commandActor Who runs a subcommand, for the audit log: the user of the operating system
+func commandActor() models.AuditActor {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return models.AuditActor{Username: "cli:" + name}
+}
+
 func main() {
 	log.Info("Starting SlideScope...")
 
@@ -70,43 +173,293 @@ func main() {
 	}
 
 	// Connect to the database
-	models.ConnectDataBase(config.Sqlite.Filename)
+	if err := models.ConnectDataBase(config.Database); err != nil {
+		log.Fatal(err)
+	}
+
+	// Slides and masks can only be opened from the storage roots
+	storageRoots, err := storage.NewRoots(config.Storage.Roots)
+	if err != nil {
+		log.Fatal(err)
+	}
+	models.SetStorageRoots(storageRoots)
+
+	// The migrate subcommand manages the schema itself, the other subcommands need it to be up to date
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Bring the schema up to date, or refuse to run on a schema this version does not know
+	if config.Database.AutoMigrate {
+		if err := models.MigrateUp(models.LatestSchemaVersion()); err != nil {
+			log.Fatal(err)
+		}
+	} else if version, err := models.SchemaVersion(); err != nil {
+		log.Fatal(err)
+	} else if version != models.LatestSchemaVersion() {
+		log.Fatal(fmt.Sprintf("The database schema is at version %d, run `slidescope migrate up` to bring it to version %d",
+			version, models.LatestSchemaVersion()))
+	}
+	models.SetupSearchIndex(models.Database)
+
+	// The import, relink and verify subcommands run instead of the server, their changes are in the audit log
+	if len(args) > 0 {
+		startAuditLog(config.Audit)
+		var err error
+		switch args[0] {
+		case "import":
+			err = runImport(args[1:])
+		case "relink":
+			err = runRelink(args[1:])
+		case "verify":
+			err = runVerify(args[1:], config.Ingest.Extensions)
+		default:
+			err = fmt.Errorf("unknown command %s, the commands are migrate, import, relink and verify", args[0])
+		}
+		models.StopAuditLog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Tokens, cookies and share links cannot be signed safely without a secret
+	if utils.Secret("API_SECRET") == "" {
+		log.Fatal("API_SECRET or API_SECRET_FILE is required")
+	}
+
+	// Jobs which were running when the server stopped will never finish
+	if err := models.InterruptJobs(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Images registered before fingerprints were stored are fingerprinted in the background
+	go models.BackfillFingerprints()
+	models.SetAccessControl(config.Auth.EnforceAccessRules)
+	models.SetPasswordPolicy(config.Auth.PasswordPolicy)
+	models.SetLockout(config.Auth.Lockout)
+
+	// Patient information is removed from the slides of images which are de-identified
+	deidentification, err := deepzoom.NewDeidentification(
+		config.Deidentification.RedactProperties,
+		config.Deidentification.Label,
+		config.Deidentification.MacroLabelRegions)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid deidentification config: %s", err.Error()))
+	}
+	models.SetDeidentification(deidentification, config.Deidentification.Enabled)
+
+	// Logins are checked against the local users, and against the directory when LDAP is enabled
+	if config.LDAP.Enabled {
+		ldapAuthenticator, err := models.NewLDAPAuthenticator(config.LDAP, utils.Secret("LDAP_BIND_PASSWORD"))
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Invalid ldap config: %s", err.Error()))
+		}
+		models.SetAuthenticators(models.LocalAuthenticator{}, ldapAuthenticator)
+	}
+
+	// Record who accessed which image, tile requests are combined into viewing sessions
+	startAuditLog(config.Audit)
+
+	// Slides which appear in the watch folders are registered as images
+	var ingester *ingest.Ingester
+	if config.Ingest.Enabled {
+		ingester, err = ingest.New(config.Ingest, storageRoots)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Invalid ingest config: %s", err.Error()))
+		}
+		ingester.Start()
+	}
+
+	// Create the first admin user from the environment when there are no users yet
+	if err := models.EnsureAdmin(os.Getenv("ADMIN_USERNAME"), utils.Secret("ADMIN_PASSWORD")); err != nil {
+		log.Fatal(fmt.Sprintf("Cannot create admin user: %s", err.Error()))
+	}
 
 	r := gin.Default()
 
-	r.Use(corsMiddleware())
+	// The client IP is only taken from X-Forwarded-For when the request comes from a trusted proxy
+	if err := r.SetTrustedProxies(config.Server.TrustedProxies); err != nil {
+		log.Fatal(fmt.Sprintf("Invalid trusted proxies: %s", err.Error()))
+	}
+
+	// Create a cache for the deepzoom objects
+	cache := deepzoom.NewLocalCache(10e8)
+
+	// The cache, cors, log and jpeg settings are reloaded on SIGHUP
+	corsSettings := &reloadableCORS{}
+	if err := applySettings(config, cache, corsSettings); err != nil {
+		log.Fatal(err)
+	}
+	r.Use(corsSettings.middleware())
 	r.Use(requestIDMiddleware())
 	r.Use(gzip.Gzip(gzip.DefaultCompression))
 
+	// All routes are served under the base path, so SlideScope can share a host behind a reverse proxy
+	basePath := config.BasePath()
+	r.Use(middlewares.BasePath(basePath))
+
 	// Version tag to test against
-	r.GET("/version", func(c *gin.Context) {
+	r.Group(basePath).GET("/version", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "v0.0.1",
 		})
 	})
 
-	// REST API to create images
-	// Currently no authentication is used
-	api := r.Group("/api")
+	// Browser sessions of the web frontend are kept in a signed cookie
+	sessions, err := middlewares.Sessions(config)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid session config: %s", err.Error()))
+	}
+	r.Use(sessions)
+
+	// Authentication, the user of a valid token or session cookie is available to all routes.
+	// Requests with the session cookie need a CSRF token to change anything.
+	r.Use(middlewares.Authenticate())
+	r.Use(middlewares.CSRFProtect())
+	root := r.Group(basePath)
+	readAccess := middlewares.RequireReadAccess(config)
+	userAccess := middlewares.RequireRole(models.RoleViewer)
+	adminAccess := middlewares.RequireRole(models.RoleAdmin)
+
+	// Register and login controllers, only admins can register new users
+	api := root.Group("/api")
+	api.POST("/login", controllers.Login)
+	api.POST("/refresh", controllers.Refresh)
+	api.POST("/logout", userAccess, controllers.Logout)
+	api.POST("/register", adminAccess, controllers.Register(config))
+	api.DELETE("/users/:id/sessions", adminAccess, controllers.RevokeUserSessions)
+
+	// Admins manage the accounts of users
+	users := api.Group("/users", adminAccess)
+	{
+		users.GET("", controllers.FindUsers)
+		users.GET("/:id", controllers.FindUser)
+		users.PATCH("/:id", controllers.UpdateUser)
+		users.DELETE("/:id", controllers.DeleteUser)
+		users.POST("/:id/disable", controllers.DisableUser)
+		users.POST("/:id/enable", controllers.EnableUser)
+		users.POST("/:id/password", controllers.ResetPassword)
+	}
+	api.GET("/user", userAccess, controllers.CurrentUser)
+
+	// Scoped API keys for machine clients, passed in the X-API-Key header
+	api.GET("/keys", userAccess, controllers.FindAPIKeys)
+	api.POST("/keys", userAccess, controllers.CreateAPIKey)
+	api.DELETE("/keys/:id", userAccess, controllers.RevokeAPIKey)
+
+	// REST API to read images, viewers can only read
 	v1 := api.Group("/v1")
+	read := v1.Group("", middlewares.APIKeyScope(models.ScopeTilesRead), readAccess)
 	{
-		v1.GET("/images", controllers.FindImages)
-		v1.POST("/images", controllers.CreateImage)
-		v1.GET("/images/:id", controllers.FindImage)
-		v1.PATCH("/images/:id", controllers.UpdateImage)
-		v1.DELETE("/images/:id", controllers.DeleteImage)
-		// Route to return openslide properties
-		api.GET("/images/:id/properties")
+		read.GET("/images", controllers.FindImages)
+		read.GET("/images/:id", controllers.FindImage)
+		read.GET("/images/:id/masks", controllers.FindMasks)
+		read.GET("/images/:id/masks/:mask_id", controllers.FindMask)
+		read.GET("/collections", controllers.FindCollections)
+		read.GET("/collections/:id", controllers.FindCollection)
+		read.GET("/collections/:id/images", controllers.FindCollectionImages)
+		read.GET("/collections/:id/thumbnails", controllers.FindCollectionThumbnails)
+		read.GET("/tags", controllers.FindTags)
+		read.GET("/cases", controllers.FindCases)
+		read.GET("/cases/:id", controllers.FindCase)
+		read.GET("/cases/:id/images", controllers.FindCaseImages)
+		read.GET("/specimens/:id", controllers.FindSpecimen)
+		read.GET("/blocks/:id", controllers.FindBlock)
 	}
 
-	// Create a cache for the deepzoom objects
-	cache := deepzoom.NewLocalCache(10e8)
+	// Changing an existing image is checked per image: admins can change all images, annotators can write
+	// the masks of images they can read, and access rules can grant other users the right to manage an image
+	write := v1.Group("", userAccess)
+	{
+		write.PATCH("/images/:id", controllers.UpdateImage(cache))
+		write.DELETE("/images/:id", controllers.DeleteImage(cache))
+		write.POST("/images/:id/metadata", controllers.RefreshImageMetadata(cache))
+
+		// Share links give access to the tiles of a single image without an account
+		write.GET("/images/:id/shares", controllers.FindShareLinks)
+		write.POST("/images/:id/shares", controllers.CreateShareLink)
+		write.DELETE("/shares/:id", controllers.RevokeShareLink)
+	}
+	annotate := v1.Group("", middlewares.APIKeyScope(models.ScopeAnnotationsWrite), userAccess)
+	{
+		annotate.POST("/images/:id/masks", controllers.CreateMask)
+		annotate.PATCH("/images/:id/masks/:mask_id", controllers.UpdateMask(cache))
+		annotate.DELETE("/images/:id/masks/:mask_id", controllers.DeleteMask(cache))
+	}
+
+	// Importing images, also allowed for API keys with the import scope
+	v1.POST("/images", middlewares.APIKeyScope(models.ScopeImagesImport), adminAccess, controllers.CreateImage)
+	v1.POST("/images/import", middlewares.APIKeyScope(models.ScopeImagesImport), adminAccess, controllers.ImportImages)
+	v1.GET("/images/import/:id", middlewares.APIKeyScope(models.ScopeImagesImport), adminAccess, controllers.FindJob(models.JobImport))
+
+	// Admins manage the images and how they are organised
+	admin := v1.Group("", adminAccess)
+	{
+
+		// Collections group images, and can be nested
+		admin.POST("/collections", controllers.CreateCollection)
+		admin.PATCH("/collections/:id", controllers.UpdateCollection)
+		admin.DELETE("/collections/:id", controllers.DeleteCollection)
+		admin.POST("/collections/:id/images", controllers.AddCollectionImages)
+		admin.DELETE("/collections/:id/images", controllers.RemoveCollectionImages)
+
+		// Free-form tags on images
+		admin.POST("/tags", controllers.CreateTag)
+		admin.PATCH("/tags/:id", controllers.UpdateTag)
+		admin.DELETE("/tags/:id", controllers.DeleteTag)
+		admin.POST("/tags/:id/images", controllers.AddTagImages)
+		admin.DELETE("/tags/:id/images", controllers.RemoveTagImages)
+
+		// Case / specimen / block hierarchy above the slides
+		admin.POST("/cases", controllers.CreateCase)
+		admin.PATCH("/cases/:id", controllers.UpdateCase)
+		admin.DELETE("/cases/:id", controllers.DeleteCase)
+		admin.POST("/cases/:id/specimens", controllers.CreateSpecimen)
+		admin.PATCH("/specimens/:id", controllers.UpdateSpecimen)
+		admin.DELETE("/specimens/:id", controllers.DeleteSpecimen)
+		admin.POST("/specimens/:id/blocks", controllers.CreateBlock)
+		admin.PATCH("/blocks/:id", controllers.UpdateBlock)
+		admin.DELETE("/blocks/:id", controllers.DeleteBlock)
+
+		// User groups and the access rules on images
+		admin.GET("/groups", controllers.FindGroups)
+		admin.POST("/groups", controllers.CreateGroup)
+		admin.DELETE("/groups/:id", controllers.DeleteGroup)
+		admin.POST("/groups/:id/users", controllers.AddGroupUsers)
+		admin.DELETE("/groups/:id/users", controllers.RemoveGroupUsers)
+		admin.GET("/access_rules", controllers.FindAccessRules)
+		admin.POST("/access_rules", controllers.CreateAccessRule)
+		admin.DELETE("/access_rules/:id", controllers.DeleteAccessRule)
+
+		admin.GET("/shares", controllers.FindAllShareLinks)
+
+		admin.GET("/audit", controllers.FindAuditEvents)
+		admin.GET("/audit/export", controllers.ExportAuditEvents)
+
+		// Imports, relinks and verifications run as background jobs, which keep their reports
+		admin.GET("/jobs", controllers.FindJobs)
+		admin.GET("/jobs/:id", controllers.FindJob(""))
+
+		admin.GET("/ingest", controllers.IngestStatus(ingester))
+		admin.POST("/ingest/retry", controllers.RetryIngest(ingester))
+
+		// Files registered more than once, and finding the files of images which moved
+		admin.GET("/images/duplicates", controllers.FindDuplicateImages)
+		admin.POST("/images/relink", controllers.RelinkImages(cache))
+		admin.POST("/verify", controllers.VerifyLibrary(config.Ingest.Extensions))
+	}
 
 	// Routes that generate the deepzoom pyramid
 	// These pyramids are cached and released once in a while.
 	// TODO: DDOS is possible by opening a lot of images (if they are in the database)
 	// TODO: To alleviate this, a check on cache size should be done and a "server busy" response should be issued.
-	dzRoutes := r.Group("/deepzoom")
+	// The tiles, dzi files and thumbnails can also be read with a share link
+	dzRoutes := root.Group("/deepzoom", middlewares.APIKeyScope(models.ScopeTilesRead), middlewares.AllowShareLink(), readAccess)
 	{
 		dzRoutes.GET("/:image_identifier/slide_files/:level/:location", controllers.GetTile(cache, config))
 
@@ -120,35 +473,28 @@ func main() {
 		// Thumbnail routes
 		dzRoutes.GET("/:image_identifier/thumbnail.jpg", controllers.GetThumbnail(cache, config))
 		dzRoutes.GET("/:image_identifier/thumbnail.png", controllers.GetThumbnail(cache, config))
+	}
+
+	dzInfoRoutes := root.Group("/deepzoom", middlewares.APIKeyScope(models.ScopeTilesRead), readAccess)
+	{
+		// Normalized slide metadata, pass ?all=true to include the raw openslide properties
+		dzInfoRoutes.GET("/:image_identifier/properties", controllers.GetImageProperties(cache, config))
 
-		// TODO: pass a parameter ?all=true to pass the full map, otherwise just shape and mpp is relevant
-		dzRoutes.GET("/:image_identifier/properties", controllers.GetImageProperties(cache, config))
+		// Convert points and regions between deepzoom, tile, slide, level0, bounds and micron coordinates
+		dzInfoRoutes.POST("/:image_identifier/coordinates", controllers.ConvertCoordinates(cache, config))
 	}
 
 	r.LoadHTMLGlob("frontend/templates/**/*.tmpl")
-	r.Static("/static", "frontend/static")
+	root.Static("/static", "frontend/static")
 
-	r.GET("/", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "index.tmpl", gin.H{
-			"title": "Main website",
-		})
-	})
+	// Login and logout forms of the web frontend, the pages redirect to the login form when not logged in
+	pageAccess := middlewares.RequirePageAccess(config)
+	root.GET("/login", controllers.LoginPage)
+	root.POST("/login", middlewares.RequireCSRF(), controllers.LoginForm)
+	root.POST("/logout", middlewares.RequireCSRF(), controllers.LogoutForm)
 
-	r.GET("/viewer", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "viewer.tmpl", gin.H{
-			"title": "Viewer",
-		})
-	})
-
-	//// Register an login controllers
-	//api.POST("/register", controllers.Register)
-	//api.POST("/login", controllers.Login)
-	//
-	//// TODO: Use https://github.com/gin-contrib/sessions to keep the cookie
-	//protected := r.Group("/api/admin")
-	//protected.Use(middlewares.JwtAuthMiddleware())
-	//protected.GET("/user", controllers.CurrentUser)
-	//
+	root.GET("/", pageAccess, controllers.Page("index.tmpl", "Main website"))
+	root.GET("/viewer", middlewares.AllowShareLink(), pageAccess, controllers.Page("viewer.tmpl", "Viewer"))
 
 	addr := fmt.Sprintf(":%s", config.Server.Port)
 	srv := &http.Server{
@@ -165,9 +511,20 @@ func main() {
 		}
 	}()
 
+	// Reload the settings which can change while running on SIGHUP, without dropping connections
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		current := config
+		for range reload {
+			log.Info("Reloading config from ", configPath)
+			current = reloadConfig(configPath, current, cache, corsSettings)
+		}
+	}()
+
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscanll.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
@@ -186,6 +543,12 @@ func main() {
 		log.Info("Timeout of 1 seconds.")
 	}
 
+	// Finish the registration in progress, and write the viewing sessions that are still open
+	if ingester != nil {
+		ingester.Stop()
+	}
+	models.StopAuditLog()
+
 	//log.Info("Emptying deepzoom cache...")
 	//cache.EmptyCache()
 
@@ -0,0 +1,19 @@
+package middlewares
+
+import "github.com/gin-gonic/gin"
+
+// basePathKey The prefix all routes are served under is stored under this key in the context
+const basePathKey = "base_path"
+
+// BasePath Make the prefix all routes are served under available to the handlers, so they can build URLs with URL
+func BasePath(basePath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(basePathKey, basePath)
+		c.Next()
+	}
+}
+
+// URL The URL of a path on this server, with the base path in front
+func URL(c *gin.Context, path string) string {
+	return c.GetString(basePathKey) + path
+}
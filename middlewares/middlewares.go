@@ -4,9 +4,22 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"slidescope/models"
+	"slidescope/utils"
 	"slidescope/utils/token"
 )
 
+// Keys under which the authentication state is stored in the context
+const (
+	userKey         = "user"
+	apiKeyKey       = "api_key"
+	scopeGrantedKey = "api_key_scope_granted"
+	shareLinkKey    = "share_link"
+	shareAllowedKey = "share_link_allowed"
+	sessionKey      = "session"
+	cookieAuthKey   = "cookie_auth"
+)
+
 func JwtAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		err := token.TokenValid(c)
@@ -18,3 +31,150 @@ func JwtAuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// Authenticate Load the user of the API key, token or session cookie into the context when a valid one is given.
+// Requests without a valid token continue anonymously, access is checked by RequireRole.
+// Should come after Sessions, which reads the session cookie.
+func Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := token.ExtractAPIKey(c); key != "" {
+			apiKey, u, err := models.AuthenticateAPIKey(key)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+			c.Set(userKey, u)
+			c.Set(apiKeyKey, apiKey)
+		} else if shareToken := c.Query("share"); shareToken != "" {
+			link, err := models.AuthenticateShareLink(shareToken)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+			c.Set(shareLinkKey, link)
+		} else if token.ExtractToken(c) != "" {
+			claims, err := token.ExtractTokenClaims(c)
+			if err == nil {
+				if session, u, err := models.AuthenticateToken(claims); err == nil {
+					c.Set(userKey, u)
+					c.Set(sessionKey, session)
+				}
+			}
+		} else if claims, ok := cookieClaims(c); ok {
+			if session, u, err := models.AuthenticateToken(claims); err == nil {
+				c.Set(userKey, u)
+				c.Set(sessionKey, session)
+				c.Set(cookieAuthKey, true)
+			}
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser Get the authenticated user of the request
+func CurrentUser(c *gin.Context) (models.User, bool) {
+	value, ok := c.Get(userKey)
+	if !ok {
+		return models.User{}, false
+	}
+	u, ok := value.(models.User)
+	return u, ok
+}
+
+// CurrentSession Get the session of the access token the request is authenticated with
+func CurrentSession(c *gin.Context) (models.Session, bool) {
+	value, ok := c.Get(sessionKey)
+	if !ok {
+		return models.Session{}, false
+	}
+	session, ok := value.(models.Session)
+	return session, ok
+}
+
+// CurrentAPIKey Get the API key the request is authenticated with
+func CurrentAPIKey(c *gin.Context) (models.APIKey, bool) {
+	value, ok := c.Get(apiKeyKey)
+	if !ok {
+		return models.APIKey{}, false
+	}
+	apiKey, ok := value.(models.APIKey)
+	return apiKey, ok
+}
+
+// APIKeyScope Allow requests authenticated with an API key on the routes after this middleware when the key
+// has the scope. Should come before RequireRole, which rejects API keys on routes without a granted scope.
+func APIKeyScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKey, ok := CurrentAPIKey(c); ok {
+			if !apiKey.HasScope(scope) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "API key does not have scope " + scope})
+				c.Abort()
+				return
+			}
+			c.Set(scopeGrantedKey, true)
+		}
+		c.Next()
+	}
+}
+
+// RequireRole Only allow authenticated users with at least the given role.
+// Requests with an API key additionally need a scope granted by APIKeyScope.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, ok := CurrentUser(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+		if _, isAPIKey := CurrentAPIKey(c); isAPIKey && !c.GetBool(scopeGrantedKey) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot be used for this route"})
+			c.Abort()
+			return
+		}
+		if !u.HasRole(role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentShareLink Get the share link the request is made with
+func CurrentShareLink(c *gin.Context) (models.ShareLink, bool) {
+	value, ok := c.Get(shareLinkKey)
+	if !ok {
+		return models.ShareLink{}, false
+	}
+	link, ok := value.(models.ShareLink)
+	return link, ok
+}
+
+// AllowShareLink Accept share links on the routes after this middleware, should come before RequireReadAccess.
+// The handlers are responsible for checking the link covers the requested image.
+func AllowShareLink() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(shareAllowedKey, true)
+		c.Next()
+	}
+}
+
+// RequireReadAccess Allow viewers, or everyone when anonymous read access is enabled in the config.
+// Requests with a share link are allowed on routes accepting them.
+func RequireReadAccess(config *utils.Config) gin.HandlerFunc {
+	requireViewer := RequireRole(models.RoleViewer)
+	return func(c *gin.Context) {
+		if _, ok := CurrentShareLink(c); ok && c.GetBool(shareAllowedKey) {
+			c.Next()
+			return
+		}
+		if config.Auth.AnonymousRead {
+			c.Next()
+			return
+		}
+		requireViewer(c)
+	}
+}
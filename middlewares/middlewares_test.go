@@ -0,0 +1,106 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"slidescope/models"
+)
+
+// testRouter Routes guarded like the ones of the API. The user and API key of a request are taken from the
+// X-Test-Role and X-Test-Scopes headers, a key is only used when X-Test-Scopes is sent.
+func testRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if role := c.GetHeader("X-Test-Role"); role != "" {
+			c.Set(userKey, models.User{Username: "test", Role: role})
+		}
+		if scopes, ok := c.Request.Header["X-Test-Scopes"]; ok {
+			c.Set(apiKeyKey, models.APIKey{Scopes: scopes[0]})
+		}
+	})
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/read", APIKeyScope(models.ScopeTilesRead), RequireRole(models.RoleViewer), ok)
+	router.GET("/annotate", APIKeyScope(models.ScopeAnnotationsWrite), RequireRole(models.RoleAnnotator), ok)
+	router.GET("/import", APIKeyScope(models.ScopeImagesImport), RequireRole(models.RoleAdmin), ok)
+	router.GET("/admin", RequireRole(models.RoleAdmin), ok)
+	router.GET("/viewer", RequireRole(models.RoleViewer), ok)
+	return router
+}
+
+func TestRequireRoleAndAPIKeyScope(t *testing.T) {
+	router := testRouter()
+	noKey := "-" // A request with a session instead of an API key
+
+	tests := []struct {
+		name       string
+		route      string
+		role       string // Empty for anonymous requests
+		scopes     string // The scopes of the API key, or noKey
+		wantStatus int
+		wantError  string
+	}{
+		{"anonymous", "/viewer", "", noKey, http.StatusUnauthorized, "Unauthorized"},
+		{"anonymous on a route accepting keys", "/read", "", noKey, http.StatusUnauthorized, "Unauthorized"},
+		{"viewer", "/viewer", models.RoleViewer, noKey, http.StatusOK, ""},
+		{"annotator on a viewer route", "/viewer", models.RoleAnnotator, noKey, http.StatusOK, ""},
+		{"viewer on an admin route", "/admin", models.RoleViewer, noKey, http.StatusForbidden, "Forbidden"},
+		{"annotator on an admin route", "/admin", models.RoleAnnotator, noKey, http.StatusForbidden, "Forbidden"},
+		{"admin", "/admin", models.RoleAdmin, noKey, http.StatusOK, ""},
+		{"unknown role", "/viewer", "superuser", noKey, http.StatusForbidden, "Forbidden"},
+		{"sessions do not need scopes", "/import", models.RoleAdmin, noKey, http.StatusOK, ""},
+		{"viewer session on a route accepting keys", "/annotate", models.RoleViewer, noKey, http.StatusForbidden, "Forbidden"},
+
+		{"key with the scope", "/read", models.RoleViewer, models.ScopeTilesRead, http.StatusOK, ""},
+		{"key with one of its scopes", "/import", models.RoleAdmin,
+			models.ScopeTilesRead + "," + models.ScopeImagesImport, http.StatusOK, ""},
+		{"key without the scope", "/import", models.RoleAdmin, models.ScopeTilesRead, http.StatusForbidden,
+			"does not have scope " + models.ScopeImagesImport},
+		{"key without scopes", "/read", models.RoleAdmin, "", http.StatusForbidden, "does not have scope"},
+		{"scopes are not prefixes", "/read", models.RoleViewer, "tiles", http.StatusForbidden, "does not have scope"},
+		{"key on a route without scopes", "/admin", models.RoleAdmin, models.ScopeImagesImport, http.StatusForbidden,
+			"API keys cannot be used for this route"},
+		{"key with all scopes on a route without scopes", "/viewer", models.RoleAdmin,
+			models.ScopeTilesRead + "," + models.ScopeImagesImport + "," + models.ScopeAnnotationsWrite,
+			http.StatusForbidden, "API keys cannot be used for this route"},
+		{"scope does not raise the role of the owner", "/import", models.RoleViewer, models.ScopeImagesImport,
+			http.StatusForbidden, "Forbidden"},
+		{"annotator key", "/annotate", models.RoleAnnotator, models.ScopeAnnotationsWrite, http.StatusOK, ""},
+		{"owner lost the role of the scope", "/annotate", models.RoleViewer, models.ScopeAnnotationsWrite,
+			http.StatusForbidden, "Forbidden"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", test.route, nil)
+			if test.role != "" {
+				request.Header.Set("X-Test-Role", test.role)
+			}
+			if test.scopes != noKey {
+				request.Header["X-Test-Scopes"] = []string{test.scopes}
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+
+			if response.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", response.Code, test.wantStatus, response.Body.String())
+			}
+			if test.wantError == "" {
+				return
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body.Error, test.wantError) {
+				t.Fatalf("got error %q, want one containing %q", body.Error, test.wantError)
+			}
+		})
+	}
+}
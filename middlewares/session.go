@@ -0,0 +1,192 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"slidescope/models"
+	"slidescope/utils"
+	"slidescope/utils/token"
+)
+
+// defaultCookieName The session cookie of the web frontend when none is configured
+const defaultCookieName = "slidescope_session"
+
+// Keys of the values stored in the session cookie
+const (
+	cookieSessionIDKey = "session_id"
+	cookieUserIDKey    = "user_id"
+	cookieCSRFKey      = "csrf_token"
+)
+
+// The CSRF token is sent in this header by scripts, or in this field by HTML forms
+const (
+	CSRFHeader    = "X-CSRF-Token"
+	CSRFFormField = "csrf_token"
+)
+
+// Sessions Keep browser sessions in a signed cookie, configured in the session section of the config.
+// The cookie only refers to a session in the database, so it stops working when that session is revoked.
+func Sessions(config *utils.Config) (gin.HandlerFunc, error) {
+	var sameSite http.SameSite
+	switch strings.ToLower(config.Session.SameSite) {
+	case "", "lax":
+		sameSite = http.SameSiteLaxMode
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		if !config.Session.Secure {
+			return nil, errors.New("session.same_site none requires session.secure")
+		}
+		sameSite = http.SameSiteNoneMode
+	default:
+		return nil, errors.New("session.same_site should be one of strict, lax or none")
+	}
+
+	lifespan, err := token.RefreshTokenLifespan()
+	if err != nil {
+		return nil, err
+	}
+
+	name := config.Session.CookieName
+	if name == "" {
+		name = defaultCookieName
+	}
+
+	store := cookie.NewStore(token.SessionSecret())
+	store.Options(sessions.Options{
+		Path:     config.BasePath() + "/",
+		Domain:   config.Session.Domain,
+		MaxAge:   int(lifespan.Seconds()),
+		Secure:   config.Session.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+	return sessions.Sessions(name, store), nil
+}
+
+// cookieClaims Get the user and session the session cookie refers to
+func cookieClaims(c *gin.Context) (token.Claims, bool) {
+	session := sessions.Default(c)
+	sid, ok := session.Get(cookieSessionIDKey).(uint)
+	if !ok || sid == 0 {
+		return token.Claims{}, false
+	}
+	uid, ok := session.Get(cookieUserIDKey).(uint)
+	if !ok {
+		return token.Claims{}, false
+	}
+	return token.Claims{UserID: uid, SessionID: sid}, true
+}
+
+// StartCookieSession Log the browser in to a session. The CSRF token is replaced, so a token from before the login
+// cannot be used.
+func StartCookieSession(c *gin.Context, s models.Session) error {
+	csrfToken, err := token.GenerateCSRFToken()
+	if err != nil {
+		return err
+	}
+	session := sessions.Default(c)
+	session.Clear()
+	session.Set(cookieSessionIDKey, s.ID)
+	session.Set(cookieUserIDKey, s.UserID)
+	session.Set(cookieCSRFKey, csrfToken)
+	return session.Save()
+}
+
+// EndCookieSession Log the browser out, the cookie no longer refers to a session
+func EndCookieSession(c *gin.Context) error {
+	session := sessions.Default(c)
+	session.Clear()
+	return session.Save()
+}
+
+// CSRFToken Get the CSRF token of the browser session, a new one is created for browsers without a session
+func CSRFToken(c *gin.Context) (string, error) {
+	session := sessions.Default(c)
+	if csrfToken, ok := session.Get(cookieCSRFKey).(string); ok && csrfToken != "" {
+		return csrfToken, nil
+	}
+	csrfToken, err := token.GenerateCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	session.Set(cookieCSRFKey, csrfToken)
+	return csrfToken, session.Save()
+}
+
+// validCSRFToken Check the request carries the CSRF token of its session, in the header or in the form
+func validCSRFToken(c *gin.Context) bool {
+	expected, ok := sessions.Default(c).Get(cookieCSRFKey).(string)
+	if !ok || expected == "" {
+		return false
+	}
+	given := c.GetHeader(CSRFHeader)
+	if given == "" {
+		given = c.PostForm(CSRFFormField)
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// safeMethod Requests with these methods do not change state, and do not need a CSRF token
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFProtect Reject state-changing requests that are authenticated with the session cookie, but do not carry
+// the CSRF token. Requests with a bearer token or API key cannot be forged by other sites and are not checked.
+func CSRFProtect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetBool(cookieAuthKey) && !safeMethod(c.Request.Method) && !validCSRFToken(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "missing or invalid CSRF token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireCSRF Always require the CSRF token, also for browsers that are not logged in, for instance on the login form
+func RequireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validCSRFToken(c) {
+			c.String(http.StatusForbidden, "Missing or invalid CSRF token, reload the page and try again")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// SafeRedirect Only redirect to paths on this server, anything else goes to the main page
+func SafeRedirect(c *gin.Context, next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return URL(c, "/")
+	}
+	return next
+}
+
+// RequirePageAccess Send browsers that are not logged in to the login page, unless anonymous read access is enabled
+// in the config. Pages accepting share links are shown with a share link.
+func RequirePageAccess(config *utils.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, loggedIn := CurrentUser(c)
+		_, shared := CurrentShareLink(c)
+		if loggedIn || (shared && c.GetBool(shareAllowedKey)) || config.Auth.AnonymousRead {
+			c.Next()
+			return
+		}
+		c.Redirect(http.StatusSeeOther, URL(c, "/login?next=")+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+	}
+}
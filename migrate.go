@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slidescope/models"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// migrateUsage How the migrate subcommand is used
+const migrateUsage = "usage: slidescope [-config config.yaml] migrate up [version] | down [version] | status"
+
+// runMigrate Run the migrate subcommand: apply migrations up to a version (default all), undo them down to a
+// version (default one step back), or list which migrations are applied
+func runMigrate(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+	target := -1
+	if len(args) == 2 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 || version > models.LatestSchemaVersion() {
+			return fmt.Errorf("version should be between 0 and %d, not %s", models.LatestSchemaVersion(), args[1])
+		}
+		target = version
+	}
+
+	switch args[0] {
+	case "up":
+		if target == 0 {
+			return nil
+		}
+		if target < 0 {
+			target = models.LatestSchemaVersion()
+		}
+		return models.MigrateUp(target)
+	case "down":
+		if target < 0 {
+			version, err := models.SchemaVersion()
+			if err != nil {
+				return err
+			}
+			if version == 0 {
+				return nil
+			}
+			target = version - 1
+		}
+		return models.MigrateDown(target)
+	case "status":
+		return printMigrationStatus()
+	}
+	return errors.New(migrateUsage)
+}
+
+// printMigrationStatus List all migrations, and when they were applied
+func printMigrationStatus() error {
+	applied, err := models.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, migration := range models.Migrations() {
+		appliedAt := "pending"
+		if record, ok := applied[migration.Version]; ok {
+			appliedAt = record.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", migration.Version, migration.Name, appliedAt)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"errors"
+	"gorm.io/gorm"
+)
+
+// Permissions which can be granted on images. Manage includes read.
+const (
+	PermissionRead   = "read"
+	PermissionManage = "manage"
+)
+
+// enforceAccessRules Whether non-admin users only see the images granted to them
+var enforceAccessRules bool
+
+// SetAccessControl Enable or disable checking the access rules for non-admin users
+func SetAccessControl(enabled bool) {
+	enforceAccessRules = enabled
+}
+
+// Group A group of users, access can be granted to all its members at once
+type Group struct {
+	gorm.Model
+	Name  string `gorm:"size:255;not null;unique" json:"name"`
+	Users []User `json:"users,omitempty" gorm:"many2many:group_users;"`
+}
+
+// AccessRule Grants a user or group a permission on an image, the images of a collection
+// (including nested collections) or all images with an identifier starting with a prefix.
+type AccessRule struct {
+	gorm.Model
+	UserID           *uint  `json:"user_id"`
+	GroupID          *uint  `json:"group_id"`
+	ImageID          *uint  `json:"image_id"`
+	CollectionID     *uint  `json:"collection_id"`
+	IdentifierPrefix string `json:"identifier_prefix"`
+	Permission       string `gorm:"size:32;not null" json:"permission"`
+}
+
+// Validate Check the rule has exactly one grantee, exactly one target and a known permission
+func (rule *AccessRule) Validate() error {
+	if (rule.UserID == nil) == (rule.GroupID == nil) {
+		return errors.New("an access rule needs either a user_id or a group_id")
+	}
+	targets := 0
+	if rule.ImageID != nil {
+		targets++
+	}
+	if rule.CollectionID != nil {
+		targets++
+	}
+	if rule.IdentifierPrefix != "" {
+		targets++
+	}
+	if targets != 1 {
+		return errors.New("an access rule needs exactly one of image_id, collection_id or identifier_prefix")
+	}
+	if rule.Permission != PermissionRead && rule.Permission != PermissionManage {
+		return errors.New("permission should be read or manage")
+	}
+	return nil
+}
+
+// unrestricted Check if the user can access all images, without looking at the rules
+func unrestricted(u *User) bool {
+	if !enforceAccessRules {
+		return true
+	}
+	return u != nil && u.HasRole(RoleAdmin)
+}
+
+// accessRulesFor Get the rules which grant the user the permission, directly or through a group
+func accessRulesFor(u *User, permission string) ([]AccessRule, error) {
+	var groupIDs []uint
+	if err := Database.Table("group_users").Where("user_id = ?", u.ID).Pluck("group_id", &groupIDs).Error; err != nil {
+		return nil, err
+	}
+
+	permissions := []string{PermissionManage}
+	if permission == PermissionRead {
+		permissions = append(permissions, PermissionRead)
+	}
+
+	var rules []AccessRule
+	err := Database.Where("(user_id = ? OR group_id IN ?) AND permission IN ?", u.ID, groupIDs, permissions).Find(&rules).Error
+	return rules, err
+}
+
+// AccessibleImages Restrict a query on images to those the user has the permission on.
+// Anonymous users are passed as nil, and only have access when the rules are not enforced.
+func AccessibleImages(db *gorm.DB, u *User, permission string) *gorm.DB {
+	if unrestricted(u) {
+		return db
+	}
+	if u == nil {
+		return db.Where("1 = 0")
+	}
+
+	rules, err := accessRulesFor(u, permission)
+	if err != nil {
+		_ = db.AddError(err)
+		return db
+	}
+
+	var imageIDs []uint
+	var collectionIDs []uint
+	condition := Database.Where("1 = 0")
+	for _, rule := range rules {
+		switch {
+		case rule.ImageID != nil:
+			imageIDs = append(imageIDs, *rule.ImageID)
+		case rule.CollectionID != nil:
+			collection := Collection{}
+			collection.ID = *rule.CollectionID
+			descendants, err := collection.DescendantIDs()
+			if err != nil {
+				_ = db.AddError(err)
+				return db
+			}
+			collectionIDs = append(collectionIDs, descendants...)
+		case rule.IdentifierPrefix != "":
+			condition = condition.Or("images.identifier LIKE ? ESCAPE '!'", escapeLike(rule.IdentifierPrefix)+"%")
+		}
+	}
+	if imageIDs != nil {
+		condition = condition.Or("images.id IN ?", imageIDs)
+	}
+	if collectionIDs != nil {
+		condition = condition.Or("images.id IN (SELECT collection_images.image_id FROM collection_images WHERE collection_images.collection_id IN ?)", collectionIDs)
+	}
+	return db.Where(condition)
+}
+
+// CanAccessImage Check if the user has the permission on the image
+func CanAccessImage(u *User, image Image, permission string) bool {
+	if unrestricted(u) {
+		return true
+	}
+	var count int64
+	AccessibleImages(Database.Model(&Image{}), u, permission).Where("images.id = ?", image.ID).Count(&count)
+	return count > 0
+}
+
+// CanManageImage Check if the user can change or delete the image. Admins can manage all images,
+// other users only when the access rules are enforced and grant them the manage permission.
+func CanManageImage(u *User, image Image) bool {
+	if u == nil {
+		return false
+	}
+	if u.HasRole(RoleAdmin) {
+		return true
+	}
+	return enforceAccessRules && CanAccessImage(u, image, PermissionManage)
+}
+
+// CanAnnotateImage Check if the user can write the masks of the image. Annotators need read access,
+// users who manage the image can always annotate it.
+func CanAnnotateImage(u *User, image Image) bool {
+	if u == nil {
+		return false
+	}
+	if CanManageImage(u, image) {
+		return true
+	}
+	return u.HasRole(RoleAnnotator) && CanAccessImage(u, image, PermissionRead)
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testRule An access rule of a test case, by the names of its grantee and target
+type testRule struct {
+	group      bool   // Granted to the group of alice instead of alice herself
+	user       string // Granted to this user instead of alice, when set
+	prefix     string
+	image      string // Identifier of the image
+	collection bool   // The parent collection, the image in its child collection is covered
+	permission string
+}
+
+func TestAccessibleImages(t *testing.T) {
+	testDatabase(t)
+	SetAccessControl(true)
+	t.Cleanup(func() { SetAccessControl(false) })
+
+	images := map[string]Image{}
+	for _, identifier := range []string{"T1-01", "T1-02", "T10-01", "T1_01", "T1X01", "100%-A", "100-A", "a!b", "ab", "nested"} {
+		image := Image{Identifier: identifier, StorageRoot: "default", Path: identifier + ".svs"}
+		if err := Database.Create(&image).Error; err != nil {
+			t.Fatal(err)
+		}
+		images[identifier] = image
+	}
+	alice := testUser(t, User{Username: "alice", Password: "secret", Role: RoleViewer})
+	bob := testUser(t, User{Username: "bob", Password: "secret", Role: RoleViewer})
+	admin := testUser(t, User{Username: "admin", Password: "secret", Role: RoleAdmin})
+	users := map[string]*User{"alice": &alice, "bob": &bob, "admin": &admin, "anonymous": nil}
+	group := Group{Name: "pathologists", Users: []User{alice}}
+	if err := Database.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	parent := Collection{Name: "study"}
+	if err := Database.Create(&parent).Error; err != nil {
+		t.Fatal(err)
+	}
+	child := Collection{Name: "cohort", ParentID: &parent.ID, Images: []Image{images["nested"]}}
+	if err := Database.Create(&child).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		user       string // alice when empty
+		rules      []testRule
+		permission string // read when empty
+		unenforced bool
+		want       []string
+	}{
+		{name: "no rules"},
+		{name: "prefix", rules: []testRule{{prefix: "T1-"}}, want: []string{"T1-01", "T1-02"}},
+		{name: "shorter prefix", rules: []testRule{{prefix: "T1"}},
+			want: []string{"T1-01", "T1-02", "T10-01", "T1X01", "T1_01"}},
+		{name: "underscore is not a wildcard", rules: []testRule{{prefix: "T1_"}}, want: []string{"T1_01"}},
+		{name: "percent is not a wildcard", rules: []testRule{{prefix: "100%"}}, want: []string{"100%-A"}},
+		{name: "only a percent", rules: []testRule{{prefix: "%"}}},
+		{name: "only an underscore", rules: []testRule{{prefix: "_"}}},
+		{name: "escape character", rules: []testRule{{prefix: "a!"}}, want: []string{"a!b"}},
+		{name: "whole identifier", rules: []testRule{{prefix: "T1-01"}}, want: []string{"T1-01"}},
+		{name: "prefix through a group", rules: []testRule{{group: true, prefix: "T1-"}}, want: []string{"T1-01", "T1-02"}},
+		{name: "rule of another user", rules: []testRule{{user: "bob", prefix: "T1-"}}},
+		{name: "read does not grant manage", rules: []testRule{{prefix: "T1-"}}, permission: PermissionManage},
+		{name: "manage grants read", rules: []testRule{{prefix: "T1-", permission: PermissionManage}},
+			want: []string{"T1-01", "T1-02"}},
+		{name: "manage", rules: []testRule{{prefix: "T1-"}, {prefix: "100", permission: PermissionManage}},
+			permission: PermissionManage, want: []string{"100%-A", "100-A"}},
+		{name: "prefix, image and collection rules combined",
+			rules: []testRule{{prefix: "T1-"}, {image: "ab"}, {group: true, collection: true}},
+			want:  []string{"T1-01", "T1-02", "ab", "nested"}},
+		{name: "admins see all images", user: "admin",
+			want: []string{"100%-A", "100-A", "T1-01", "T1-02", "T10-01", "T1X01", "T1_01", "a!b", "ab", "nested"}},
+		{name: "anonymous users see no images", user: "anonymous", rules: []testRule{{prefix: "T"}}},
+		{name: "rules which are not enforced", rules: []testRule{{prefix: "T1-"}}, unenforced: true,
+			want: []string{"100%-A", "100-A", "T1-01", "T1-02", "T10-01", "T1X01", "T1_01", "a!b", "ab", "nested"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Database.Unscoped().Where("1 = 1").Delete(&AccessRule{}).Error; err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range test.rules {
+				rule := AccessRule{IdentifierPrefix: r.prefix, Permission: r.permission}
+				switch {
+				case r.group:
+					rule.GroupID = &group.ID
+				case r.user != "":
+					rule.UserID = &users[r.user].ID
+				default:
+					rule.UserID = &alice.ID
+				}
+				if r.image != "" {
+					id := images[r.image].ID
+					rule.ImageID = &id
+				}
+				if r.collection {
+					rule.CollectionID = &parent.ID
+				}
+				if rule.Permission == "" {
+					rule.Permission = PermissionRead
+				}
+				if err := rule.Validate(); err != nil {
+					t.Fatal(err)
+				}
+				if err := Database.Create(&rule).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			SetAccessControl(!test.unenforced)
+			t.Cleanup(func() { SetAccessControl(true) })
+			user := users["alice"]
+			if test.user != "" {
+				user = users[test.user]
+			}
+			permission := test.permission
+			if permission == "" {
+				permission = PermissionRead
+			}
+
+			var got []string
+			query := AccessibleImages(Database.Model(&Image{}), user, permission)
+			if err := query.Pluck("images.identifier", &got).Error; err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			// A single image is checked with the same rules
+			for identifier, image := range images {
+				wantAccess := false
+				for _, want := range test.want {
+					wantAccess = wantAccess || want == identifier
+				}
+				if access := CanAccessImage(user, image, permission); access != wantAccess {
+					t.Fatalf("access to %s is %v, want %v", identifier, access, wantAccess)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+	"slidescope/utils"
+)
+
+var passwordPolicy utils.PasswordPolicy
+var lockout utils.LockoutConfig
+
+// ErrUserDisabled The account has been disabled by an admin
+var ErrUserDisabled = errors.New("account is disabled")
+
+// AccountLockedError The account is locked after too many failed logins
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e AccountLockedError) Error() string {
+	return fmt.Sprintf("account is locked after too many failed logins, try again in %d seconds", e.RetryAfter())
+}
+
+// RetryAfter Seconds until the account is unlocked
+func (e AccountLockedError) RetryAfter() int {
+	return int(time.Until(e.Until).Seconds()) + 1
+}
+
+// SetPasswordPolicy Set the rules new passwords of local users are checked against
+func SetPasswordPolicy(policy utils.PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// SetLockout Set when accounts are locked after failed logins
+func SetLockout(config utils.LockoutConfig) {
+	lockout = config
+}
+
+// ValidatePassword Check the password follows the password policy
+func ValidatePassword(password string) error {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	var missing []string
+	if len([]rune(password)) < passwordPolicy.MinLength {
+		missing = append(missing, fmt.Sprintf("at least %d characters", passwordPolicy.MinLength))
+	}
+	if passwordPolicy.RequireUpper && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if passwordPolicy.RequireLower && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if passwordPolicy.RequireDigit && !digit {
+		missing = append(missing, "a digit")
+	}
+	if passwordPolicy.RequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("password should contain %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// lockDuration How long the account is locked after the given number of failed logins, 0 when it is not locked
+func lockDuration(failedLogins int) time.Duration {
+	if lockout.MaxAttempts <= 0 || failedLogins < lockout.MaxAttempts {
+		return 0
+	}
+	lock := time.Duration(lockout.LockSeconds) * time.Second
+	limit := time.Duration(lockout.MaxLockSeconds) * time.Second
+	for i := lockout.MaxAttempts; i < failedLogins && (limit <= 0 || lock < limit); i++ {
+		lock *= 2
+	}
+	if limit > 0 && lock > limit {
+		lock = limit
+	}
+	return lock
+}
+
+// checkAccount Find the account of a login, and refuse logins to disabled and locked accounts
+func checkAccount(username string) (*User, error) {
+	var u User
+	err := Database.Where("username = ?", username).Take(&u).Error
+	if err != nil {
+		// Directory users are stored with their name in lowercase, whichever case they log in with
+		err = Database.Where("username = ? AND source = ?", strings.ToLower(username), SourceLDAP).Take(&u).Error
+	}
+	if err != nil {
+		// Directory users log in for the first time, the directory has its own lockout
+		return nil, nil
+	}
+	return &u, refuseAccount(u)
+}
+
+// refuseAccount Check the account is not disabled or locked
+func refuseAccount(u User) error {
+	if u.Disabled {
+		return ErrUserDisabled
+	}
+	if u.LockedUntil != nil && time.Now().Before(*u.LockedUntil) {
+		return AccountLockedError{Until: *u.LockedUntil}
+	}
+	return nil
+}
+
+// recordLogin Count a failed login, and lock the account when there are too many. A successful login resets the count.
+func recordLogin(u *User, success bool) error {
+	now := time.Now()
+	if success {
+		return Database.Model(u).UpdateColumns(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  nil,
+			"last_login_at": now,
+		}).Error
+	}
+
+	// Increment in the database, so concurrent attempts are all counted
+	if err := Database.Model(u).UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1")).Error; err != nil {
+		return err
+	}
+	if err := Database.Model(u).Select("failed_logins").Take(u).Error; err != nil {
+		return err
+	}
+	if lock := lockDuration(u.FailedLogins); lock > 0 {
+		lockedUntil := now.Add(lock)
+		return Database.Model(u).UpdateColumn("locked_until", lockedUntil).Error
+	}
+	return nil
+}
+
+// SetPassword Replace the password of a local user, this also unlocks the account and ends its sessions
+func (u *User) SetPassword(password string) error {
+	if u.Source != SourceLocal {
+		return errors.New("the password of a directory user is managed in the directory")
+	}
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = Database.Model(u).UpdateColumns(map[string]interface{}{
+		"password":      hashedPassword,
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+	if err != nil {
+		return err
+	}
+	_, err = RevokeUserSessions(u.ID)
+	return err
+}
+
+// SetDisabled Disable or enable the account. Disabled users cannot log in, and their sessions are ended.
+// Enabling an account also unlocks it.
+func (u *User) SetDisabled(disabled bool) error {
+	updates := map[string]interface{}{"disabled": disabled}
+	if !disabled {
+		updates["failed_logins"] = 0
+		updates["locked_until"] = nil
+	}
+	if err := Database.Model(u).UpdateColumns(updates).Error; err != nil {
+		return err
+	}
+	u.Disabled = disabled
+	if disabled {
+		_, err := RevokeUserSessions(u.ID)
+		return err
+	}
+	return nil
+}
+
+// DeleteUser Delete the user with their group memberships and access rules, their sessions are ended and their
+// API keys revoked. The user is removed permanently, so the username can be used again.
+func DeleteUser(u *User) error {
+	return Database.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&Session{}).Where("user_id = ? AND revoked_at IS NULL", u.ID).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", u.ID).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM group_users WHERE user_id = ?", u.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", u.ID).Delete(&AccessRule{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(u).Error
+	})
+}
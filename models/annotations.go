@@ -4,7 +4,14 @@ import "gorm.io/gorm"
 
 type MaskAnnotation struct {
 	gorm.Model
-	ImageID    uint   `json:"image_id"`
-	Path       string `json:"path"`
-	Identifier string `json:"identifier"`
+	ImageID     uint   `json:"image_id"`
+	StorageRoot string `json:"storage_root" gorm:"size:64"`
+	Path        string `json:"path"` // Relative to the storage root
+	Identifier  string `json:"identifier"`
+	Vendor      string `json:"vendor"`
+}
+
+// FilePath The location of the mask on disk
+func (mask *MaskAnnotation) FilePath() (string, error) {
+	return resolvePath(mask.StorageRoot, mask.Path)
 }
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"slidescope/utils/token"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be limited to, with the role the owner needs to create a key with that scope
+const (
+	ScopeTilesRead        = "tiles:read"
+	ScopeImagesImport     = "images:import"
+	ScopeAnnotationsWrite = "annotations:write"
+)
+
+var scopeRoles = map[string]string{
+	ScopeTilesRead:        RoleViewer,
+	ScopeImagesImport:     RoleAdmin,
+	ScopeAnnotationsWrite: RoleAnnotator,
+}
+
+// apiKeyTouchInterval Only update the last used timestamp once in a while, not on every tile
+const apiKeyTouchInterval = time.Minute
+
+// APIKey A named key for machine clients. Only the hash of the key is stored.
+type APIKey struct {
+	gorm.Model
+	UserID     uint       `json:"user_id"`
+	Name       string     `gorm:"size:255;not null" json:"name"`
+	Prefix     string     `gorm:"size:16" json:"prefix"` // First characters of the key, to recognize it
+	KeyHash    string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Scopes     string     `json:"scopes"` // Comma separated
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// ValidateScopes Check the scopes exist and the user has the role required for each of them
+func ValidateScopes(u *User, scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("an API key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		role, ok := scopeRoles[scope]
+		if !ok {
+			return errors.New("unknown scope " + scope)
+		}
+		if !u.HasRole(role) {
+			return errors.New("your role does not allow the scope " + scope)
+		}
+	}
+	return nil
+}
+
+// CreateAPIKey Create a new API key for the user, the plain key is returned once and cannot be retrieved later
+func CreateAPIKey(u *User, name string, scopes []string, expiresAt *time.Time) (APIKey, string, error) {
+	if err := ValidateScopes(u, scopes); err != nil {
+		return APIKey{}, "", err
+	}
+	key, err := token.GenerateAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	apiKey := APIKey{
+		UserID:    u.ID,
+		Name:      name,
+		Prefix:    key[:10],
+		KeyHash:   token.HashAPIKey(key),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	if err := Database.Create(&apiKey).Error; err != nil {
+		return APIKey{}, "", err
+	}
+	return apiKey, key, nil
+}
+
+// HasScope Check if the key is allowed the scope
+func (apiKey *APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Split(apiKey.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Active Check the key is not revoked or expired
+func (apiKey *APIKey) Active() bool {
+	if apiKey.RevokedAt != nil {
+		return false
+	}
+	return apiKey.ExpiresAt == nil || apiKey.ExpiresAt.After(time.Now())
+}
+
+// Revoke Revoke the key, it can no longer be used
+func (apiKey *APIKey) Revoke() error {
+	now := time.Now()
+	apiKey.RevokedAt = &now
+	return Database.Model(apiKey).Update("revoked_at", now).Error
+}
+
+// AuthenticateAPIKey Find the active key and its user, and record it has been used
+func AuthenticateAPIKey(key string) (APIKey, User, error) {
+	var apiKey APIKey
+	if err := Database.Where("key_hash = ?", token.HashAPIKey(key)).First(&apiKey).Error; err != nil {
+		return APIKey{}, User{}, errors.New("invalid API key")
+	}
+	if !apiKey.Active() {
+		return APIKey{}, User{}, errors.New("API key is revoked or expired")
+	}
+	u, err := GetUserByID(apiKey.UserID)
+	if err != nil {
+		return APIKey{}, User{}, err
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		apiKey.LastUsedAt = &now
+		Database.Model(&apiKey).UpdateColumn("last_used_at", now)
+	}
+	return apiKey, u, nil
+}
@@ -0,0 +1,301 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditOpenDzi        = "open_dzi"         // Opened the image in a viewer
+	AuditViewTiles      = "view_tiles"       // Viewed tiles of the image, one event per viewing session
+	AuditThumbnail      = "thumbnail"        // Requested the thumbnail
+	AuditProperties     = "properties"       // Read the slide metadata
+	AuditImageCreate    = "image_create"     // Imported the image
+	AuditImageUpdate    = "image_update"     // Changed the image
+	AuditImageDelete    = "image_delete"     // Deleted the image
+	AuditMetadataUpdate = "metadata_refresh" // Read the metadata from the slide again
+	AuditMaskCreate     = "mask_create"      // Added a mask to the image
+	AuditMaskUpdate     = "mask_update"      // Changed a mask of the image
+	AuditMaskDelete     = "mask_delete"      // Deleted a mask of the image
+)
+
+// auditPurgeInterval How often events older than the retention are deleted
+const auditPurgeInterval = 24 * time.Hour
+
+// AuditEvent Who accessed or changed which image, and when. Events are only ever added, never changed,
+// and are kept after the user or image has been deleted. Tile requests are combined into one event per viewing
+// session, with the number of tiles and the region viewed.
+type AuditEvent struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt       time.Time  `gorm:"index" json:"created_at"` // Start of a viewing session
+	EndedAt         *time.Time `json:"ended_at"`                // Last tile of a viewing session
+	Action          string     `gorm:"size:32;not null;index" json:"action"`
+	UserID          *uint      `gorm:"index" json:"user_id"`
+	Username        string     `gorm:"size:255" json:"username"`
+	APIKeyID        *uint      `json:"api_key_id"`
+	ShareLinkID     *uint      `json:"share_link_id"`
+	ImageID         *uint      `gorm:"index" json:"image_id"`
+	ImageIdentifier string     `gorm:"size:255;index" json:"image_identifier"`
+	Detail          string     `json:"detail"` // The mask, overlay or changed fields
+	Tiles           int        `json:"tiles"`
+	MaxLevel        *int       `json:"max_level"` // Highest deepzoom level viewed
+	RegionX         *float64   `json:"region_x"`  // Bounding box of the tiles viewed, in level 0 coordinates
+	RegionY         *float64   `json:"region_y"`
+	RegionWidth     *float64   `json:"region_width"`
+	RegionHeight    *float64   `json:"region_height"`
+	ClientIP        string     `gorm:"size:64" json:"client_ip"`
+	RequestID       string     `gorm:"size:64" json:"request_id"`
+}
+
+// AuditActor Who made the request, and from where
+type AuditActor struct {
+	UserID      *uint
+	Username    string
+	APIKeyID    *uint
+	ShareLinkID *uint
+	ClientIP    string
+	RequestID   string
+}
+
+// BeforeUpdate The audit log is append-only
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return errors.New("audit events cannot be changed")
+}
+
+// BeforeDelete Audit events are only deleted when they are older than the retention, see PurgeAuditEvents
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return errors.New("audit events cannot be deleted")
+}
+
+// newAuditEvent An event of the actor on the image
+func newAuditEvent(actor AuditActor, action string, image Image, detail string) AuditEvent {
+	imageID := image.ID
+	return AuditEvent{
+		CreatedAt:       time.Now(),
+		Action:          action,
+		UserID:          actor.UserID,
+		Username:        actor.Username,
+		APIKeyID:        actor.APIKeyID,
+		ShareLinkID:     actor.ShareLinkID,
+		ImageID:         &imageID,
+		ImageIdentifier: image.Identifier,
+		Detail:          detail,
+		ClientIP:        actor.ClientIP,
+		RequestID:       actor.RequestID,
+	}
+}
+
+// viewingSessionKey Tile requests with the same key are combined into one viewing session
+type viewingSessionKey struct {
+	userID      uint
+	apiKeyID    uint
+	shareLinkID uint
+	clientIP    string
+	imageID     uint
+	detail      string
+}
+
+// auditLog Records audit events, and keeps the viewing sessions that are still open in memory
+type auditLog struct {
+	mu          sync.Mutex
+	sessions    map[viewingSessionKey]*AuditEvent
+	idleTimeout time.Duration
+	retention   time.Duration
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// audit The audit log, nil when auditing is disabled
+var audit *auditLog
+
+// StartAuditLog Start recording audit events. Viewing sessions end after idleTimeout without tile requests, and
+// events older than the retention are deleted. A retention of zero keeps the events forever.
+func StartAuditLog(idleTimeout time.Duration, retention time.Duration) {
+	audit = &auditLog{
+		sessions:    map[viewingSessionKey]*AuditEvent{},
+		idleTimeout: idleTimeout,
+		retention:   retention,
+		done:        make(chan struct{}),
+	}
+	audit.wg.Add(1)
+	go audit.run()
+}
+
+// StopAuditLog Write the viewing sessions that are still open, and stop recording
+func StopAuditLog() {
+	if audit == nil {
+		return
+	}
+	close(audit.done)
+	audit.wg.Wait()
+	audit.flush(true)
+	audit = nil
+}
+
+// run Write idle viewing sessions every minute, and delete old events every day
+func (a *auditLog) run() {
+	defer a.wg.Done()
+	flushTicker := time.NewTicker(time.Minute)
+	defer flushTicker.Stop()
+	purgeTicker := time.NewTicker(auditPurgeInterval)
+	defer purgeTicker.Stop()
+
+	a.purge()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-flushTicker.C:
+			a.flush(false)
+		case <-purgeTicker.C:
+			a.purge()
+		}
+	}
+}
+
+// flush Write the viewing sessions that have ended, or all of them
+func (a *auditLog) flush(all bool) {
+	var ended []AuditEvent
+	a.mu.Lock()
+	for key, session := range a.sessions {
+		if all || time.Since(*session.EndedAt) > a.idleTimeout {
+			ended = append(ended, *session)
+			delete(a.sessions, key)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, event := range ended {
+		writeAuditEvent(event)
+	}
+}
+
+// purge Delete the events older than the retention
+func (a *auditLog) purge() {
+	if a.retention <= 0 {
+		return
+	}
+	deleted, err := PurgeAuditEvents(time.Now().Add(-a.retention))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cannot purge audit events: %s", err.Error()))
+	} else if deleted > 0 {
+		log.Info(fmt.Sprintf("Purged %d audit events older than the retention", deleted))
+	}
+}
+
+// writeAuditEvent Store an event. A failure is logged, as it should not fail the request.
+func writeAuditEvent(event AuditEvent) {
+	if err := Database.Create(&event).Error; err != nil {
+		log.Warn(fmt.Sprintf("Cannot write audit event %s on image %s: %s", event.Action, event.ImageIdentifier, err.Error()))
+	}
+}
+
+// RecordAuditEvent Record an action of the actor on the image
+func RecordAuditEvent(actor AuditActor, action string, image Image, detail string) {
+	if audit == nil {
+		return
+	}
+	writeAuditEvent(newAuditEvent(actor, action, image, detail))
+}
+
+// RecordTileView Add a tile to the viewing session of the actor on the image, or start a new one.
+// The tile region is in level 0 coordinates.
+func RecordTileView(actor AuditActor, image Image, detail string, level int, location [2]float64, size [2]float64) {
+	if audit == nil {
+		return
+	}
+	key := viewingSessionKey{clientIP: actor.ClientIP, imageID: image.ID, detail: detail}
+	if actor.UserID != nil {
+		key.userID = *actor.UserID
+	}
+	if actor.APIKeyID != nil {
+		key.apiKeyID = *actor.APIKeyID
+	}
+	if actor.ShareLinkID != nil {
+		key.shareLinkID = *actor.ShareLinkID
+	}
+	now := time.Now()
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	session, ok := audit.sessions[key]
+	if ok && now.Sub(*session.EndedAt) > audit.idleTimeout {
+		// The previous session has ended but was not written yet
+		go writeAuditEvent(*session)
+		ok = false
+	}
+	if !ok {
+		event := newAuditEvent(actor, AuditViewTiles, image, detail)
+		event.MaxLevel = &level
+		event.RegionX, event.RegionY = &location[0], &location[1]
+		event.RegionWidth, event.RegionHeight = &size[0], &size[1]
+		session = &event
+		audit.sessions[key] = session
+	} else {
+		if level > *session.MaxLevel {
+			session.MaxLevel = &level
+		}
+		// Grow the bounding box to include the tile
+		x0 := math.Min(*session.RegionX, location[0])
+		y0 := math.Min(*session.RegionY, location[1])
+		x1 := math.Max(*session.RegionX+*session.RegionWidth, location[0]+size[0])
+		y1 := math.Max(*session.RegionY+*session.RegionHeight, location[1]+size[1])
+		width, height := x1-x0, y1-y0
+		session.RegionX, session.RegionY = &x0, &y0
+		session.RegionWidth, session.RegionHeight = &width, &height
+	}
+	session.Tiles++
+	session.EndedAt = &now
+}
+
+// PurgeAuditEvents Delete the events from before the given time, and return how many were deleted.
+// This is the only way events are removed.
+func PurgeAuditEvents(before time.Time) (int64, error) {
+	result := Database.Session(&gorm.Session{SkipHooks: true}).Where("created_at < ?", before).Delete(&AuditEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// AuditFilter Filters which can be applied to a query on the audit log
+type AuditFilter struct {
+	UserID          *uint
+	Username        string
+	ImageID         *uint
+	ImageIdentifier string
+	Action          string
+	From            *time.Time
+	To              *time.Time
+}
+
+// Apply Add the filters to a query on the audit events
+func (filter AuditFilter) Apply(db *gorm.DB) *gorm.DB {
+	if filter.UserID != nil {
+		db = db.Where("user_id = ?", *filter.UserID)
+	}
+	if filter.Username != "" {
+		db = db.Where("username = ?", filter.Username)
+	}
+	if filter.ImageID != nil {
+		db = db.Where("image_id = ?", *filter.ImageID)
+	}
+	if filter.ImageIdentifier != "" {
+		db = db.Where("image_identifier = ?", filter.ImageIdentifier)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	if filter.From != nil {
+		db = db.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		db = db.Where("created_at < ?", *filter.To)
+	}
+	return db
+}
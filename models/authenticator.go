@@ -0,0 +1,42 @@
+package models
+
+import (
+	"errors"
+)
+
+var (
+	// ErrUnknownUser The authenticator does not know the user, the next authenticator is tried
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrInvalidCredentials The username or password is incorrect
+	ErrInvalidCredentials = errors.New("username or password is incorrect")
+)
+
+// Authenticator Checks the username and password of a login against a user store, and returns the user.
+// Returns ErrUnknownUser when the user is not in its store, so the next authenticator can be tried.
+type Authenticator interface {
+	Authenticate(username string, password string) (User, error)
+}
+
+// authenticators Logins are checked against these, in order
+var authenticators = []Authenticator{LocalAuthenticator{}}
+
+// SetAuthenticators Set the authenticators logins are checked against, in order
+func SetAuthenticators(a ...Authenticator) {
+	authenticators = a
+}
+
+// LocalAuthenticator Checks the password hash of local users in the database
+type LocalAuthenticator struct{}
+
+// Authenticate Check the password of a local user
+func (LocalAuthenticator) Authenticate(username string, password string) (User, error) {
+	u := User{}
+	err := Database.Model(User{}).Where("username = ? AND source = ?", username, SourceLocal).Take(&u).Error
+	if err != nil {
+		return User{}, ErrUnknownUser
+	}
+	if err := VerifyPassword(password, u.Password); err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Case A pathology case. Only a pseudonymised identifier is stored, never the accession number or patient data.
+type Case struct {
+	gorm.Model
+	Identifier  string     `gorm:"size:255;not null;unique" json:"identifier"`
+	Description string     `json:"description"`
+	Specimens   []Specimen `json:"specimens,omitempty" gorm:"foreignKey:CaseID"`
+}
+
+// Specimen A specimen taken from the patient, for instance a resection or biopsy, belonging to a case
+type Specimen struct {
+	gorm.Model
+	CaseID      uint    `json:"case_id"`
+	Identifier  string  `gorm:"size:255;not null" json:"identifier"`
+	Description string  `json:"description"`
+	Blocks      []Block `json:"blocks,omitempty" gorm:"foreignKey:SpecimenID"`
+}
+
+// Block A tissue block of a specimen, the slides are cut from the block
+type Block struct {
+	gorm.Model
+	SpecimenID  uint    `json:"specimen_id"`
+	Identifier  string  `gorm:"size:255;not null" json:"identifier"`
+	Description string  `json:"description"`
+	Images      []Image `json:"images,omitempty" gorm:"foreignKey:BlockID"`
+}
+
+// CaseBlockIDs Get the ids of all blocks in a case
+func CaseBlockIDs(caseID uint) ([]uint, error) {
+	var blockIDs []uint
+	err := Database.Model(&Block{}).
+		Joins("JOIN specimens ON specimens.id = blocks.specimen_id AND specimens.deleted_at IS NULL").
+		Where("specimens.case_id = ?", caseID).
+		Pluck("blocks.id", &blockIDs).Error
+	return blockIDs, err
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"errors"
+	"gorm.io/gorm"
+)
+
+// Collection A group of images, for instance a study, cohort or teaching set.
+// Collections can be nested, and an image can be part of several collections.
+type Collection struct {
+	gorm.Model
+	Name        string       `gorm:"size:255;not null" json:"name"`
+	Description string       `json:"description"`
+	ParentID    *uint        `json:"parent_id"`
+	Children    []Collection `json:"children,omitempty" gorm:"foreignKey:ParentID"`
+	Images      []Image      `json:"-" gorm:"many2many:collection_images;"`
+}
+
+// Tag A free-form label on images
+type Tag struct {
+	gorm.Model
+	Name   string  `gorm:"size:255;not null;unique" json:"name"`
+	Images []Image `json:"-" gorm:"many2many:image_tags;"`
+}
+
+// DescendantIDs Get the id of the collection and of all collections nested below it
+func (collection *Collection) DescendantIDs() ([]uint, error) {
+	ids := []uint{collection.ID}
+	seen := map[uint]bool{collection.ID: true}
+	parents := []uint{collection.ID}
+
+	for len(parents) > 0 {
+		var children []uint
+		if err := Database.Model(&Collection{}).Where("parent_id IN ?", parents).Pluck("id", &children).Error; err != nil {
+			return nil, err
+		}
+		parents = nil
+		for _, child := range children {
+			if !seen[child] {
+				seen[child] = true
+				ids = append(ids, child)
+				parents = append(parents, child)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// SetParent Move the collection below parentID, nil moves it to the top level.
+// A collection cannot be moved below itself or one of its descendants.
+func (collection *Collection) SetParent(parentID *uint) error {
+	if parentID == nil {
+		collection.ParentID = nil
+		return nil
+	}
+
+	var parent Collection
+	if err := Database.First(&parent, *parentID).Error; err != nil {
+		return errors.New("parent collection not found")
+	}
+	if collection.ID != 0 {
+		descendants, err := collection.DescendantIDs()
+		if err != nil {
+			return err
+		}
+		for _, id := range descendants {
+			if id == *parentID {
+				return errors.New("a collection cannot be nested below itself")
+			}
+		}
+	}
+	collection.ParentID = parentID
+	return nil
+}
+
+// FindImagesByID Get the images with the given ids, returns an error when one of them does not exist
+func FindImagesByID(ids []uint) ([]Image, error) {
+	var images []Image
+	if err := Database.Where("id IN ?", ids).Find(&images).Error; err != nil {
+		return nil, err
+	}
+	if len(images) != len(uniqueIDs(ids)) {
+		return nil, errors.New("one or more images not found")
+	}
+	return images, nil
+}
+
+// uniqueIDs Remove duplicate ids
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool)
+	var output []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			output = append(output, id)
+		}
+	}
+	return output
+}
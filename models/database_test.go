@@ -0,0 +1,42 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+
+	"slidescope/storage"
+	"slidescope/utils"
+)
+
+// testDatabase Connect to a new SQLite database with the latest schema for the test. The default storage root is an
+// empty directory, and the database is closed when the test ends.
+func testDatabase(t *testing.T) {
+	t.Helper()
+	roots, err := storage.NewRoots(map[string]string{storage.DefaultRoot: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStorageRoots(roots)
+	config := utils.DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "test.sqlite")}
+	if err := ConnectDataBase(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db, err := Database.DB(); err == nil {
+			db.Close()
+		}
+	})
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	SetupSearchIndex(Database)
+}
+
+// testUser Create a user for the test
+func testUser(t *testing.T, u User) User {
+	t.Helper()
+	if _, err := u.SaveUser(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
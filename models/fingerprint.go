@@ -0,0 +1,95 @@
+package models
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"slidescope/storage"
+)
+
+// UpdateFingerprint Store the fingerprint and size of the file of the slide on the image
+func (image *Image) UpdateFingerprint() error {
+	location, err := image.FilePath()
+	if err != nil {
+		return err
+	}
+	fingerprint, size, err := storage.Fingerprint(location)
+	if err != nil {
+		return err
+	}
+	image.Fingerprint = fingerprint
+	image.FileSize = size
+	return nil
+}
+
+// FindDuplicates The other images with the same file, by fingerprint and size
+func FindDuplicates(image Image) ([]Image, error) {
+	var duplicates []Image
+	if image.Fingerprint == "" {
+		return duplicates, nil
+	}
+	err := Database.Where("fingerprint = ? AND file_size = ? AND id <> ?", image.Fingerprint, image.FileSize, image.ID).
+		Order("id").Find(&duplicates).Error
+	return duplicates, err
+}
+
+// DuplicateGroup Images which are registered more than once for the same file
+type DuplicateGroup struct {
+	Fingerprint string  `json:"fingerprint"`
+	FileSize    int64   `json:"file_size"`
+	Images      []Image `json:"images"`
+}
+
+// FindDuplicateGroups All images which share their file with another image, grouped by file
+func FindDuplicateGroups() ([]DuplicateGroup, error) {
+	var files []struct {
+		Fingerprint string
+		FileSize    int64
+	}
+	err := Database.Model(&Image{}).Select("fingerprint", "file_size").Where("fingerprint <> ''").
+		Group("fingerprint").Group("file_size").Having("COUNT(*) > 1").Order("fingerprint").Scan(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]DuplicateGroup, 0, len(files))
+	for _, file := range files {
+		group := DuplicateGroup{Fingerprint: file.Fingerprint, FileSize: file.FileSize}
+		err := Database.Where("fingerprint = ? AND file_size = ?", file.Fingerprint, file.FileSize).Order("id").Find(&group.Images).Error
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// BackfillFingerprints Fingerprint the images which were registered before fingerprints were stored, one at a time.
+// Images whose file cannot be read keep an empty fingerprint, and are tried again on the next start.
+func BackfillFingerprints() {
+	var images []Image
+	if err := Database.Where("fingerprint = '' OR fingerprint IS NULL").Find(&images).Error; err != nil {
+		log.Warn(fmt.Sprintf("Cannot find images without fingerprint: %s", err.Error()))
+		return
+	}
+	if len(images) == 0 {
+		return
+	}
+	log.Info(fmt.Sprintf("Fingerprinting %d images registered before fingerprints were stored", len(images)))
+	fingerprinted := 0
+	for _, image := range images {
+		if err := image.UpdateFingerprint(); err != nil {
+			log.Warn(fmt.Sprintf("Cannot fingerprint %s: %s", image.Identifier, err.Error()))
+			continue
+		}
+		// The search index does not change, so the hooks are skipped
+		err := Database.Session(&gorm.Session{SkipHooks: true}).Model(&image).
+			UpdateColumns(map[string]interface{}{"fingerprint": image.Fingerprint, "file_size": image.FileSize}).Error
+		if err != nil {
+			log.Warn(fmt.Sprintf("Cannot store the fingerprint of %s: %s", image.Identifier, err.Error()))
+			continue
+		}
+		fingerprinted++
+	}
+	log.Info(fmt.Sprintf("Fingerprinted %d of %d images", fingerprinted, len(images)))
+}
@@ -1,11 +1,211 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"errors"
+	"github.com/NKI-AI/openslide-go/openslide"
+	"gorm.io/gorm"
+	"os"
+	"slidescope/deepzoom"
+	"slidescope/storage"
+	"strings"
+	"time"
+)
 
 type Image struct {
 	gorm.Model
 	ID              uint             `json:"id" gorm:"primary_key"`
-	Path            string           `json:"path"`
+	StorageRoot     string           `json:"storage_root" gorm:"size:64"`
+	Path            string           `json:"path"` // Relative to the storage root
 	Identifier      string           `json:"identifier"`
 	MaskAnnotations []MaskAnnotation `json:"mask_annotations" gorm:"foreignKey:ImageID"`
+	Tags            []Tag            `json:"tags" gorm:"many2many:image_tags;"`
+
+	// Place of the slide in the case / specimen / block hierarchy, and its stain
+	BlockID     *uint  `json:"block_id"`
+	Stain       string `json:"stain"`        // For instance H&E or IHC
+	StainMarker string `json:"stain_marker"` // The IHC marker, for instance CD8
+
+	// Metadata extracted from the slide on import, so listings do not need to open the slide
+	Vendor              string     `json:"vendor"`
+	Width               int        `json:"width"`
+	Height              int        `json:"height"`
+	MppX                *float64   `json:"mpp_x"`
+	MppY                *float64   `json:"mpp_y"`
+	ObjectivePower      *float64   `json:"objective_power"`
+	LevelCount          int        `json:"level_count"`
+	FileSize            int64      `json:"file_size"`
+	FileModTime         *time.Time `json:"file_mod_time"`
+	MetadataExtractedAt *time.Time `json:"metadata_extracted_at"`
+	Fingerprint         string     `json:"fingerprint" gorm:"size:64;index"` // Of the file at import, see storage.Fingerprint
+
+	// Deidentify overrides the global de-identification setting for this image when it is set
+	Deidentify *bool `json:"deidentify"`
+}
+
+// storageRoots The directories the paths of slides and masks are relative to
+var storageRoots *storage.Roots
+
+// SetStorageRoots Set the directories slides and masks are stored under
+func SetStorageRoots(roots *storage.Roots) {
+	storageRoots = roots
+}
+
+// StorageRoots The directories slides and masks are stored under
+func StorageRoots() *storage.Roots {
+	return storageRoots
+}
+
+// resolvePath The location on disk of a path relative to a storage root
+func resolvePath(root string, path string) (string, error) {
+	if storageRoots == nil {
+		return "", errors.New("storage roots are not configured")
+	}
+	return storageRoots.Resolve(root, path)
+}
+
+// CheckStoragePath Check a path given by a client is a file in its storage root, and return the root and path as
+// they are stored, and the location on disk. Paths without a root are in the default root.
+func CheckStoragePath(root string, path string) (string, string, string, error) {
+	if root == "" {
+		root = storage.DefaultRoot
+	}
+	cleaned, err := storage.CleanPath(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	location, err := resolvePath(root, cleaned)
+	if err != nil {
+		return "", "", "", err
+	}
+	return root, cleaned, location, nil
+}
+
+// FilePath The location of the slide on disk
+func (image *Image) FilePath() (string, error) {
+	return resolvePath(image.StorageRoot, image.Path)
+}
+
+// deidentification The de-identification policy, and whether it applies to images which do not set it themselves
+var deidentification *deepzoom.Deidentification
+var deidentifyByDefault bool
+
+// SetDeidentification Set the policy which removes patient information from the slides
+func SetDeidentification(policy *deepzoom.Deidentification, enabled bool) {
+	deidentification = policy
+	deidentifyByDefault = enabled
+}
+
+// Deidentification The de-identification policy of the image, nil when the slide is served as it is
+func (image *Image) Deidentification() *deepzoom.Deidentification {
+	enabled := deidentifyByDefault
+	if image.Deidentify != nil {
+		enabled = *image.Deidentify
+	}
+	if !enabled {
+		return nil
+	}
+	return deidentification
+}
+
+// UpdateMetadata Store the normalized metadata of an opened slide and the state of its file on the image
+func (image *Image) UpdateMetadata(slide openslide.Slide) error {
+	location, err := image.FilePath()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(location)
+	if err != nil {
+		return err
+	}
+	metadata := deepzoom.GetSlideMetadata(slide, false, nil)
+
+	image.Vendor = metadata.Vendor
+	image.Width = metadata.Dimensions[0]
+	image.Height = metadata.Dimensions[1]
+	image.MppX = nil
+	image.MppY = nil
+	if metadata.Mpp != nil {
+		image.MppX = &metadata.Mpp[0]
+		image.MppY = &metadata.Mpp[1]
+	}
+	image.ObjectivePower = metadata.ObjectivePower
+	image.LevelCount = metadata.LevelCount
+
+	modTime := info.ModTime()
+	extractedAt := time.Now()
+	image.FileSize = info.Size()
+	image.FileModTime = &modTime
+	image.MetadataExtractedAt = &extractedAt
+	return nil
+}
+
+// SaveMetadata Store only the metadata columns of the image, so concurrent changes to its other columns are kept
+func (image *Image) SaveMetadata() error {
+	return Database.Model(image).UpdateColumns(map[string]interface{}{
+		"vendor":                image.Vendor,
+		"width":                 image.Width,
+		"height":                image.Height,
+		"mpp_x":                 image.MppX,
+		"mpp_y":                 image.MppY,
+		"objective_power":       image.ObjectivePower,
+		"level_count":           image.LevelCount,
+		"file_size":             image.FileSize,
+		"file_mod_time":         image.FileModTime,
+		"metadata_extracted_at": image.MetadataExtractedAt,
+	}).Error
+}
+
+// ExtractMetadata Open the slide once and store its metadata and the fingerprint of its file on the image
+func (image *Image) ExtractMetadata() error {
+	location, err := image.FilePath()
+	if err != nil {
+		return err
+	}
+	slide, err := openslide.Open(location)
+	if err != nil {
+		return err
+	}
+	defer slide.Close()
+
+	if err := image.UpdateMetadata(slide); err != nil {
+		return err
+	}
+	return image.UpdateFingerprint()
+}
+
+// MetadataStale Check if the metadata has never been extracted, or the file changed since
+func (image *Image) MetadataStale() bool {
+	if image.MetadataExtractedAt == nil || image.FileModTime == nil {
+		return true
+	}
+	location, err := image.FilePath()
+	if err != nil {
+		return true
+	}
+	info, err := os.Stat(location)
+	if err != nil {
+		return true
+	}
+	// Compare at second resolution, not all databases store the fractional part
+	return info.Size() != image.FileSize || info.ModTime().Unix() != image.FileModTime.Unix()
+}
+
+// ImageIdentifierTaken Check if another image than exceptID already uses the identifier
+func ImageIdentifierTaken(identifier string, exceptID uint) bool {
+	var count int64
+	Database.Model(&Image{}).Where("identifier = ? AND id <> ?", identifier, exceptID).Count(&count)
+	return count > 0
+}
+
+// IsIdentifierConflict Check if the database refused to store an image because another image has its identifier.
+// ImageIdentifierTaken gives a clear error beforehand, this catches images with the same identifier stored at the
+// same time.
+func IsIdentifierConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	// SQLite names the column, MySQL and PostgreSQL the index of migration 5
+	message := err.Error()
+	return strings.Contains(message, "UNIQUE constraint failed: images.identifier") ||
+		strings.Contains(message, identifierIndexV5)
 }
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSaveMetadata(t *testing.T) {
+	testDatabase(t)
+	image := Image{Identifier: "T1-01", StorageRoot: "default", Path: "T1-01.svs", Stain: "H&E"}
+	if err := Database.Create(&image).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is changed by another request while the metadata is read from the slide
+	stale := image
+	if err := Database.Model(&image).Updates(Image{Stain: "IHC", StainMarker: "CD8"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	stale.Vendor = "aperio"
+	stale.Width = 1000
+	stale.Height = 800
+	if err := stale.SaveMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored Image
+	if err := Database.Take(&stored, image.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Vendor != "aperio" || stored.Width != 1000 || stored.Height != 800 {
+		t.Fatalf("metadata is not stored: %+v", stored)
+	}
+	if stored.Stain != "IHC" || stored.StainMarker != "CD8" {
+		t.Fatalf("got stain %q %q, want the change of the other request to be kept", stored.Stain, stored.StainMarker)
+	}
+}
+
+func TestUniqueIdentifiers(t *testing.T) {
+	testDatabase(t)
+	first := Image{Identifier: "T1-01", StorageRoot: "default", Path: "T1-01.svs"}
+	if err := Database.Create(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	second := Image{Identifier: "T1-01", StorageRoot: "default", Path: "other/T1-01.svs"}
+	err := Database.Create(&second).Error
+	if !IsIdentifierConflict(err) {
+		t.Fatalf("storing a second image with the identifier gave %v, want a conflict", err)
+	}
+	renamed := Image{Identifier: "T1-02", StorageRoot: "default", Path: "T1-02.svs"}
+	if err := Database.Create(&renamed).Error; err != nil {
+		t.Fatal(err)
+	}
+	err = Database.Model(&renamed).Update("identifier", "T1-01").Error
+	if !IsIdentifierConflict(err) {
+		t.Fatalf("renaming an image to a used identifier gave %v, want a conflict", err)
+	}
+
+	// The identifier of a deleted image can be used again
+	if err := Database.Delete(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+	second.ID = 0
+	if err := Database.Create(&second).Error; err != nil {
+		t.Fatalf("cannot reuse the identifier of a deleted image: %v", err)
+	}
+	if IsIdentifierConflict(Database.Create(&Image{Identifier: "T1-03"}).Error) {
+		t.Fatal("a new identifier conflicts")
+	}
+}
+
+func TestUniqueIdentifiersMigration(t *testing.T) {
+	testDatabase(t)
+	if err := MigrateDown(4); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a.svs", "b.svs"} {
+		if err := Database.Create(&Image{Identifier: "T1-01", StorageRoot: "default", Path: path}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := MigrateUp(5)
+	if err == nil || !strings.Contains(err.Error(), "1 identifiers are used by more than one image, for instance T1-01") {
+		t.Fatalf("migrating with duplicate identifiers gave %v", err)
+	}
+
+	// Once the duplicate is deleted the migration succeeds
+	if err := Database.Where("path = ?", "b.svs").Delete(&Image{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateUp(5); err != nil {
+		t.Fatal(err)
+	}
+}
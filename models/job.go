@@ -0,0 +1,147 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of background jobs
+const (
+	JobImport = "import" // Importing the images of a manifest
+	JobRelink = "relink" // Finding the files of images which moved
+	JobVerify = "verify" // Checking the files of all images and masks
+)
+
+// States of a background job
+const (
+	JobRunning  = "running"
+	JobFinished = "finished"
+	JobFailed   = "failed"
+)
+
+// jobRetention The number of jobs of each kind which are kept, older ones are deleted when a job starts
+const jobRetention = 50
+
+// jobProgressInterval How often the progress of a job is stored
+const jobProgressInterval = time.Second
+
+// ErrJobRunning A job of the same kind is still running
+var ErrJobRunning = errors.New("a job of this kind is already running")
+
+// jobStart Makes sure only one job of each kind runs at a time
+var jobStart sync.Mutex
+
+// Job An operation which takes longer than a request may, and runs in the background. Its report is stored when it
+// finishes, and can be read until the job is deleted to make room for newer ones.
+type Job struct {
+	ID         uint            `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at"`
+	Kind       string          `gorm:"size:32;not null;index" json:"kind"`
+	State      string          `gorm:"size:16;not null;index" json:"state"`
+	UserID     *uint           `json:"user_id"`
+	Username   string          `gorm:"size:255" json:"username"`
+	APIKeyID   *uint           `json:"api_key_id"`
+	Done       int             `json:"done"` // Progress, in the rows, images or files the job handles
+	Total      int             `json:"total"`
+	Error      string          `json:"error,omitempty"`
+	Report     json.RawMessage `json:"report,omitempty"`
+
+	progressAt time.Time
+}
+
+// Progress Store how far the job is, at most once every jobProgressInterval unless it is done. The total is 0 while
+// it is not known yet.
+func (job *Job) Progress(done int, total int) {
+	if (total == 0 || done < total) && time.Since(job.progressAt) < jobProgressInterval {
+		return
+	}
+	job.progressAt = time.Now()
+	job.Done, job.Total = done, total
+	if err := Database.Model(&Job{}).Where("id = ?", job.ID).Updates(map[string]interface{}{"done": done, "total": total}).Error; err != nil {
+		log.Warn(fmt.Sprintf("Cannot store the progress of job %d: %s", job.ID, err.Error()))
+	}
+}
+
+// finish Store the report or the error of the job
+func (job *Job) finish(report interface{}, err error) {
+	now := time.Now()
+	updates := map[string]interface{}{"state": JobFinished, "finished_at": now}
+	if err != nil {
+		updates["state"] = JobFailed
+		updates["error"] = err.Error()
+		log.Warn(fmt.Sprintf("The %s job %d failed: %s", job.Kind, job.ID, err.Error()))
+	} else {
+		log.Info(fmt.Sprintf("The %s job %d finished", job.Kind, job.ID))
+	}
+	if report != nil {
+		if encoded, marshalErr := json.Marshal(report); marshalErr == nil {
+			updates["report"] = encoded
+		}
+	}
+	if err := Database.Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+		log.Error(fmt.Sprintf("Cannot store the outcome of job %d: %s", job.ID, err.Error()))
+	}
+}
+
+// StartJob Run a job of the kind in the background, for the actor. The function reports its progress on the job, and
+// returns the report, which is also stored when it fails. Only one job of each kind runs at a time, otherwise
+// ErrJobRunning is returned.
+func StartJob(kind string, actor AuditActor, run func(job *Job) (interface{}, error)) (Job, error) {
+	jobStart.Lock()
+	defer jobStart.Unlock()
+	var running int64
+	if err := Database.Model(&Job{}).Where("kind = ? AND state = ?", kind, JobRunning).Count(&running).Error; err != nil {
+		return Job{}, err
+	}
+	if running > 0 {
+		return Job{}, ErrJobRunning
+	}
+	job := Job{Kind: kind, State: JobRunning, UserID: actor.UserID, Username: actor.Username, APIKeyID: actor.APIKeyID}
+	if err := Database.Create(&job).Error; err != nil {
+		return Job{}, err
+	}
+	var old []uint
+	Database.Model(&Job{}).Where("kind = ?", kind).Order("id DESC").Offset(jobRetention).Pluck("id", &old)
+	if len(old) > 0 {
+		Database.Delete(&Job{}, old)
+	}
+
+	log.Info(fmt.Sprintf("Started %s job %d", kind, job.ID))
+	started := job
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				started.finish(nil, fmt.Errorf("the job stopped unexpectedly: %v", r))
+			}
+		}()
+		report, err := run(&started)
+		started.finish(report, err)
+	}()
+	return job, nil
+}
+
+// FindJobs The jobs of the kind, or of all kinds when it is empty, newest first and without their reports
+func FindJobs(kind string) ([]Job, error) {
+	query := Database.Omit("report").Order("id DESC")
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	jobs := []Job{}
+	err := query.Find(&jobs).Error
+	return jobs, err
+}
+
+// InterruptJobs Mark the jobs which were running when the server stopped as failed, as they will never finish
+func InterruptJobs() error {
+	return Database.Model(&Job{}).Where("state = ?", JobRunning).Updates(map[string]interface{}{
+		"state":       JobFailed,
+		"error":       "the server stopped before the job finished",
+		"finished_at": time.Now(),
+	}).Error
+}
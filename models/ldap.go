@@ -0,0 +1,178 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"slidescope/utils"
+)
+
+// ldapTimeout Connecting and each request to the directory server give up after this
+const ldapTimeout = 10 * time.Second
+
+// LDAPAuthenticator Checks the password of a directory user by binding with their DN. The role follows from the
+// groups of the user. Users are created on their first login, and their role is updated on every login.
+type LDAPAuthenticator struct {
+	config       utils.LDAPConfig
+	bindPassword string
+}
+
+// NewLDAPAuthenticator Create an authenticator for the directory in the config
+func NewLDAPAuthenticator(config utils.LDAPConfig, bindPassword string) (*LDAPAuthenticator, error) {
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, errors.New("ldap url and base_dn are required")
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, errors.New("ldap user_filter should contain %s for the username")
+	}
+	for group, role := range config.GroupRoles {
+		if !ValidRole(role) {
+			return nil, fmt.Errorf("ldap group %s has unknown role %s", group, role)
+		}
+	}
+	if config.DefaultRole != "" && !ValidRole(config.DefaultRole) {
+		return nil, fmt.Errorf("ldap default_role %s is not a role", config.DefaultRole)
+	}
+	return &LDAPAuthenticator{config: config, bindPassword: bindPassword}, nil
+}
+
+// connect Open a connection to the directory, bound with the service account when one is configured
+func (a *LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if a.config.BindDN != "" {
+		err = conn.Bind(a.config.BindDN, a.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot bind the ldap service account: %w", err)
+	}
+	return conn, nil
+}
+
+// role The highest role of the groups, or the default role
+func (a *LDAPAuthenticator) role(groups []string) string {
+	role := a.config.DefaultRole
+	for _, group := range groups {
+		for mapped, mappedRole := range a.config.GroupRoles {
+			// DNs are case insensitive
+			if strings.EqualFold(group, mapped) && roleLevels[mappedRole] > roleLevels[role] {
+				role = mappedRole
+			}
+		}
+	}
+	return role
+}
+
+// Authenticate Find the user in the directory and bind as the user to check the password
+func (a *LDAPAuthenticator) Authenticate(username string, password string) (User, error) {
+	// An empty password would be an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return User{}, ErrInvalidCredentials
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	groupAttribute := a.config.GroupAttribute
+	if groupAttribute == "" {
+		groupAttribute = "memberOf"
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", groupAttribute},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return User{}, ErrUnknownUser
+		}
+		return User{}, err
+	}
+	if len(result.Entries) == 0 {
+		return User{}, ErrUnknownUser
+	}
+	if len(result.Entries) > 1 {
+		return User{}, fmt.Errorf("ldap user filter matches more than one entry for %s", username)
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return User{}, ErrInvalidCredentials
+		}
+		return User{}, err
+	}
+
+	role := a.role(entry.GetAttributeValues(groupAttribute))
+	if role == "" {
+		return User{}, errors.New("not a member of any group with access to SlideScope")
+	}
+	// Directory usernames are case insensitive, store them in one case so every login finds the same user
+	return provisionLDAPUser(strings.ToLower(username), role)
+}
+
+// provisionLDAPUser Create a directory user on their first login, or update the role of an existing one
+func provisionLDAPUser(username string, role string) (User, error) {
+	var u User
+	err := Database.Where("username = ?", username).Take(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The password is never used, local logins are only checked for local users
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return User{}, err
+		}
+		password := hex.EncodeToString(buf)
+		log.Info(fmt.Sprintf("Creating user %s from ldap with role %s", username, role))
+		u = User{Username: username, Password: password, Role: role, Source: SourceLDAP}
+		if _, err := u.SaveUser(); err != nil {
+			return User{}, err
+		}
+		u.PrepareGive()
+		return u, nil
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	// A directory account cannot take over a local user with the same name
+	if u.Source != SourceLDAP {
+		return User{}, fmt.Errorf("user %s is a local user", username)
+	}
+	if u.Role != role {
+		log.Info(fmt.Sprintf("Changing role of ldap user %s from %s to %s", username, u.Role, role))
+		if err := Database.Model(&u).Update("role", role).Error; err != nil {
+			return User{}, err
+		}
+	}
+	u.PrepareGive()
+	return u, nil
+}
@@ -0,0 +1,446 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"slidescope/utils"
+)
+
+// Accounts of the test directory
+const (
+	testServiceDN       = "cn=slidescope,ou=services,dc=example,dc=org"
+	testServicePassword = "service secret"
+	testAdminsGroup     = "cn=pathology-admins,ou=groups,dc=example,dc=org"
+	testViewersGroup    = "cn=pathology,ou=groups,dc=example,dc=org"
+)
+
+// ldapEntry A user in the test directory
+type ldapEntry struct {
+	uid      string
+	password string
+	groups   []string
+}
+
+func (e ldapEntry) dn() string {
+	return "uid=" + e.uid + ",ou=people,dc=example,dc=org"
+}
+
+// ldapFilter A search filter as the test directory received it
+type ldapFilter struct {
+	tag       ber.Tag
+	attribute string
+	value     string
+}
+
+// testLDAPServer A directory which answers simple binds, and searches with an equality or presence filter on uid.
+// A presence filter matches every user, as a real server would when a username is not escaped.
+type testLDAPServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries map[string]ldapEntry
+	filters []ldapFilter
+}
+
+// newTestLDAPServer Serve the entries on a local port until the test ends
+func newTestLDAPServer(t *testing.T, entries ...ldapEntry) *testLDAPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testLDAPServer{listener: listener, entries: map[string]ldapEntry{}}
+	for _, entry := range entries {
+		server.setEntry(entry)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+// URL The address to connect to
+func (s *testLDAPServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// setEntry Add or replace a user
+func (s *testLDAPServer) setEntry(entry ldapEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[strings.ToLower(entry.uid)] = entry
+}
+
+// receivedFilters The filters of all searches so far
+func (s *testLDAPServer) receivedFilters() []ldapFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ldapFilter{}, s.filters...)
+}
+
+// ldapResult An LDAPResult with the code, as the operation of a response
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return result
+}
+
+// ldapSearchEntry The operation of a response with an entry and its groups
+func ldapSearchEntry(entry ldapEntry) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn(), "objectName"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+	attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", "type"))
+	values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+	for _, group := range entry.groups {
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, "value"))
+	}
+	attribute.AppendChild(values)
+	attributes.AppendChild(attribute)
+	packet.AppendChild(attributes)
+	return packet
+}
+
+// bind Check the DN and password of a simple bind, an empty DN and password is an anonymous bind
+func (s *testLDAPServer) bind(dn string, password string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if (dn == "" && password == "") || (dn == testServiceDN && password == testServicePassword) {
+		return ldap.LDAPResultSuccess
+	}
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.dn(), dn) && entry.password == password && password != "" {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+// search The entries matching the filter
+func (s *testLDAPServer) search(filter *ber.Packet) []ldapEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	received := ldapFilter{tag: filter.Tag}
+	var matches []ldapEntry
+	switch filter.Tag {
+	case ldap.FilterEqualityMatch:
+		received.attribute = filter.Children[0].Data.String()
+		received.value = filter.Children[1].Data.String()
+		if entry, ok := s.entries[strings.ToLower(received.value)]; ok && strings.EqualFold(received.attribute, "uid") {
+			matches = append(matches, entry)
+		}
+	case ldap.FilterPresent:
+		received.attribute = filter.Data.String()
+		for _, entry := range s.entries {
+			matches = append(matches, entry)
+		}
+	}
+	s.filters = append(s.filters, received)
+	return matches
+}
+
+// serve Answer the requests on the connection until it is closed or unbound
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	respond := func(id int64, operation *ber.Packet) error {
+		packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+		packet.AppendChild(operation)
+		_, err := conn.Write(packet.Bytes())
+		return err
+	}
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		id, _ := request.Children[0].Value.(int64)
+		operation := request.Children[1]
+		switch operation.Tag {
+		case ldap.ApplicationBindRequest:
+			code := s.bind(operation.Children[1].Data.String(), operation.Children[2].Data.String())
+			err = respond(id, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			for _, entry := range s.search(operation.Children[6]) {
+				if err = respond(id, ldapSearchEntry(entry)); err != nil {
+					return
+				}
+			}
+			err = respond(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// testLDAPConfig The config of the test directory, with the pathology groups mapped to roles
+func testLDAPConfig(server *testLDAPServer) utils.LDAPConfig {
+	return utils.LDAPConfig{
+		Enabled:    true,
+		URL:        server.URL(),
+		BindDN:     testServiceDN,
+		BaseDN:     "dc=example,dc=org",
+		UserFilter: "(uid=%s)",
+		GroupRoles: map[string]string{
+			testAdminsGroup:  RoleAdmin,
+			testViewersGroup: RoleViewer,
+		},
+	}
+}
+
+// newTestLDAPAuthenticator An authenticator for the config, failing the test when it is invalid
+func newTestLDAPAuthenticator(t *testing.T, config utils.LDAPConfig, bindPassword string) *LDAPAuthenticator {
+	t.Helper()
+	authenticator, err := NewLDAPAuthenticator(config, bindPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+func TestNewLDAPAuthenticator(t *testing.T) {
+	valid := utils.LDAPConfig{URL: "ldap://localhost", BaseDN: "dc=example,dc=org", UserFilter: "(uid=%s)"}
+	tests := []struct {
+		name    string
+		change  func(config *utils.LDAPConfig)
+		wantErr string
+	}{
+		{"valid", func(config *utils.LDAPConfig) {}, ""},
+		{"no url", func(config *utils.LDAPConfig) { config.URL = "" }, "url and base_dn are required"},
+		{"no base dn", func(config *utils.LDAPConfig) { config.BaseDN = "" }, "url and base_dn are required"},
+		{"filter without username", func(config *utils.LDAPConfig) { config.UserFilter = "(uid=alice)" }, "should contain %s"},
+		{"unknown group role", func(config *utils.LDAPConfig) {
+			config.GroupRoles = map[string]string{testAdminsGroup: "superuser"}
+		}, "unknown role superuser"},
+		{"unknown default role", func(config *utils.LDAPConfig) { config.DefaultRole = "guest" }, "default_role guest is not a role"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := valid
+			test.change(&config)
+			_, err := NewLDAPAuthenticator(config, "")
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLDAPBind(t *testing.T) {
+	testDatabase(t)
+	server := newTestLDAPServer(t, ldapEntry{uid: "alice", password: "alice secret", groups: []string{testViewersGroup}})
+
+	tests := []struct {
+		name         string
+		bindPassword string
+		username     string
+		password     string
+		wantErr      error
+		wantErrText  string
+	}{
+		{name: "correct password", bindPassword: testServicePassword, username: "alice", password: "alice secret"},
+		{name: "wrong password", bindPassword: testServicePassword, username: "alice", password: "wrong",
+			wantErr: ErrInvalidCredentials},
+		{name: "empty password is not an anonymous bind", bindPassword: testServicePassword, username: "alice",
+			wantErr: ErrInvalidCredentials},
+		{name: "unknown user", bindPassword: testServicePassword, username: "mallory", password: "secret",
+			wantErr: ErrUnknownUser},
+		{name: "wrong service account password", bindPassword: "wrong", username: "alice", password: "alice secret",
+			wantErrText: "cannot bind the ldap service account"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := newTestLDAPAuthenticator(t, testLDAPConfig(server), test.bindPassword)
+			u, err := authenticator.Authenticate(test.username, test.password)
+			switch {
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("error %v, want %v", err, test.wantErr)
+				}
+			case test.wantErrText != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantErrText) {
+					t.Fatalf("error %v, want one containing %q", err, test.wantErrText)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if u.Username != test.username || u.Source != SourceLDAP {
+					t.Fatalf("got user %s from %s, want %s from ldap", u.Username, u.Source, test.username)
+				}
+			}
+		})
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	testDatabase(t)
+	server := newTestLDAPServer(t,
+		ldapEntry{uid: "alice", password: "alice secret", groups: []string{testViewersGroup}},
+		ldapEntry{uid: "bob", password: "bob secret", groups: []string{testAdminsGroup}},
+	)
+	authenticator := newTestLDAPAuthenticator(t, testLDAPConfig(server), testServicePassword)
+
+	// Unescaped, these would be a presence filter matching every user, or another filter than the one configured
+	for _, username := range []string{"*", "alice)(uid=*", "bob*", `a\2a`, "alice)(|(uid=bob"} {
+		t.Run(username, func(t *testing.T) {
+			before := len(server.receivedFilters())
+			if _, err := authenticator.Authenticate(username, "alice secret"); !errors.Is(err, ErrUnknownUser) {
+				t.Fatalf("error %v, want %v", err, ErrUnknownUser)
+			}
+			filters := server.receivedFilters()[before:]
+			if len(filters) != 1 {
+				t.Fatalf("got %d searches, want 1", len(filters))
+			}
+			want := ldapFilter{tag: ldap.FilterEqualityMatch, attribute: "uid", value: username}
+			if filters[0] != want {
+				t.Fatalf("searched with %+v, want %+v", filters[0], want)
+			}
+		})
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	testDatabase(t)
+	server := newTestLDAPServer(t)
+
+	tests := []struct {
+		name        string
+		groups      []string
+		defaultRole string
+		wantRole    string // Empty when the login is refused
+	}{
+		{name: "viewer group", groups: []string{testViewersGroup}, wantRole: RoleViewer},
+		{name: "admin group", groups: []string{testAdminsGroup}, wantRole: RoleAdmin},
+		{name: "highest role of the groups", groups: []string{testViewersGroup, testAdminsGroup}, wantRole: RoleAdmin},
+		{name: "group DNs are case insensitive", groups: []string{strings.ToUpper(testAdminsGroup)}, wantRole: RoleAdmin},
+		{name: "unmapped group without default role", groups: []string{"cn=radiology,ou=groups,dc=example,dc=org"}},
+		{name: "no groups without default role"},
+		{name: "unmapped group with default role", groups: []string{"cn=radiology,ou=groups,dc=example,dc=org"},
+			defaultRole: RoleAnnotator, wantRole: RoleAnnotator},
+		{name: "mapped group above the default role", groups: []string{testAdminsGroup}, defaultRole: RoleAnnotator,
+			wantRole: RoleAdmin},
+		{name: "default role above the mapped group", groups: []string{testViewersGroup}, defaultRole: RoleAnnotator,
+			wantRole: RoleAnnotator},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Every case logs in as a new user, so the role is not an update of an earlier one
+			entry := ldapEntry{uid: "user" + string(rune('a'+i)), password: "secret", groups: test.groups}
+			server.setEntry(entry)
+			config := testLDAPConfig(server)
+			config.DefaultRole = test.defaultRole
+			authenticator := newTestLDAPAuthenticator(t, config, testServicePassword)
+
+			u, err := authenticator.Authenticate(entry.uid, entry.password)
+			if test.wantRole == "" {
+				if err == nil || !strings.Contains(err.Error(), "not a member of any group") {
+					t.Fatalf("error %v, want the login to be refused", err)
+				}
+				var count int64
+				Database.Model(&User{}).Where("username = ?", entry.uid).Count(&count)
+				if count != 0 {
+					t.Fatalf("a refused user was created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if u.Role != test.wantRole {
+				t.Fatalf("got role %s, want %s", u.Role, test.wantRole)
+			}
+		})
+	}
+}
+
+func TestLDAPProvisioning(t *testing.T) {
+	testDatabase(t)
+	server := newTestLDAPServer(t,
+		ldapEntry{uid: "alice", password: "alice secret", groups: []string{testViewersGroup}},
+		ldapEntry{uid: "bob", password: "directory secret", groups: []string{testAdminsGroup}},
+	)
+	authenticator := newTestLDAPAuthenticator(t, testLDAPConfig(server), testServicePassword)
+	local := testUser(t, User{Username: "bob", Password: "local secret", Role: RoleViewer})
+
+	t.Run("first login creates the user", func(t *testing.T) {
+		u, err := authenticator.Authenticate("Alice", "alice secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored User
+		if err := Database.Take(&stored, u.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.Username != "alice" || stored.Source != SourceLDAP || stored.Role != RoleViewer {
+			t.Fatalf("stored %s from %s with role %s, want alice from ldap with role viewer",
+				stored.Username, stored.Source, stored.Role)
+		}
+	})
+
+	t.Run("later logins find the same user and update the role", func(t *testing.T) {
+		server.setEntry(ldapEntry{uid: "alice", password: "alice secret", groups: []string{testAdminsGroup}})
+		u, err := authenticator.Authenticate("ALICE", "alice secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var users []User
+		Database.Where("username = ?", "alice").Find(&users)
+		if len(users) != 1 || users[0].ID != u.ID || users[0].Role != RoleAdmin {
+			t.Fatalf("got %+v, want one alice with role admin", users)
+		}
+	})
+
+	t.Run("a directory user cannot take over a local user", func(t *testing.T) {
+		_, err := authenticator.Authenticate("bob", "directory secret")
+		if err == nil || !strings.Contains(err.Error(), "is a local user") {
+			t.Fatalf("error %v, want the local user to be refused", err)
+		}
+		var stored User
+		if err := Database.Take(&stored, local.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.Source != SourceLocal || stored.Role != RoleViewer {
+			t.Fatalf("local user changed to %s with role %s", stored.Source, stored.Role)
+		}
+	})
+
+	t.Run("logins with the directory password of a local user fail", func(t *testing.T) {
+		SetAuthenticators(LocalAuthenticator{}, authenticator)
+		t.Cleanup(func() { SetAuthenticators(LocalAuthenticator{}) })
+		for _, username := range []string{"bob", "Bob"} {
+			if _, err := LoginCheck(username, "directory secret"); err == nil {
+				t.Fatalf("%s logged in with the directory password", username)
+			}
+		}
+		u, err := LoginCheck("bob", "local secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != local.ID {
+			t.Fatalf("logged in as user %d, want the local user %d", u.ID, local.ID)
+		}
+	})
+}
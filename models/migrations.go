@@ -0,0 +1,355 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"slidescope/models/schemav1"
+)
+
+// SchemaMigration A migration which has been applied to the database
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"size:255" json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// Migration A numbered change to the schema, which Down undoes
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// createSchemaV1 Create the tables of version 1. A database from before migrations were versioned already has them,
+// then only the columns it misses are added.
+func createSchemaV1(tx *gorm.DB) error {
+	for _, model := range schemav1.Models() {
+		if err := tx.AutoMigrate(model); err != nil {
+			statement := &gorm.Statement{DB: tx}
+			if parseErr := statement.Parse(model); parseErr != nil {
+				return err
+			}
+			return fmt.Errorf("cannot create table %s: %w", statement.Schema.Table, err)
+		}
+	}
+	return nil
+}
+
+// dropSchemaV1 Drop all tables of version 1, including the join tables and the search index
+func dropSchemaV1(tx *gorm.DB) error {
+	tables := []interface{}{"image_search", "group_users", "collection_images", "image_tags"}
+	models := schemav1.Models()
+	for i := len(models) - 1; i >= 0; i-- {
+		tables = append(tables, models[i])
+	}
+	return tx.Migrator().DropTable(tables...)
+}
+
+// relativePathTables The tables with paths of files in the storage roots
+var relativePathTables = []string{"images", "mask_annotations"}
+
+// storageRootV2 The column added by version 2
+type storageRootV2 struct {
+	StorageRoot string `gorm:"size:64"`
+}
+
+// storedPath The path of an image or mask as it is stored, for the migrations
+type storedPath struct {
+	ID          uint
+	StorageRoot string
+	Path        string
+}
+
+// relativePaths Add the storage root to images and masks, and make their paths relative to the root which contains
+// them. Paths which were relative were taken from the working directory. Fails when a path is in none of the roots,
+// then a root containing it should be added to the config first.
+func relativePaths(tx *gorm.DB) error {
+	if storageRoots == nil {
+		return errors.New("storage roots are not configured")
+	}
+	for _, table := range relativePathTables {
+		if !tx.Table(table).Migrator().HasColumn(&storageRootV2{}, "StorageRoot") {
+			if err := tx.Table(table).Migrator().AddColumn(&storageRootV2{}, "StorageRoot"); err != nil {
+				return err
+			}
+		}
+		var paths []storedPath
+		if err := tx.Table(table).Select("id", "storage_root", "path").Find(&paths).Error; err != nil {
+			return err
+		}
+		var outside []string
+		for _, stored := range paths {
+			if stored.StorageRoot != "" {
+				continue
+			}
+			root, relative, err := storageRoots.Relative(stored.Path)
+			if err != nil {
+				outside = append(outside, stored.Path)
+				continue
+			}
+			err = tx.Table(table).Where("id = ?", stored.ID).
+				UpdateColumns(map[string]interface{}{"storage_root": root, "path": relative}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(outside) > 0 {
+			return fmt.Errorf("%d paths in %s are not in any of the storage roots, for instance %s",
+				len(outside), table, outside[0])
+		}
+	}
+	return nil
+}
+
+// absolutePaths Make the paths of images and masks absolute again, and remove their storage root
+func absolutePaths(tx *gorm.DB) error {
+	if storageRoots == nil {
+		return errors.New("storage roots are not configured")
+	}
+	for _, table := range relativePathTables {
+		var paths []storedPath
+		if err := tx.Table(table).Select("id", "storage_root", "path").Find(&paths).Error; err != nil {
+			return err
+		}
+		for _, stored := range paths {
+			directory, ok := storageRoots.Directory(stored.StorageRoot)
+			if !ok {
+				return fmt.Errorf("unknown storage root %s of %s", stored.StorageRoot, stored.Path)
+			}
+			err := tx.Table(table).Where("id = ?", stored.ID).
+				UpdateColumn("path", filepath.Join(directory, filepath.FromSlash(stored.Path))).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Table(table).Migrator().DropColumn(&storageRootV2{}, "StorageRoot"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobV3 The table added by version 3
+type jobV3 struct {
+	ID         uint `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	FinishedAt *time.Time
+	Kind       string `gorm:"size:32;not null;index"`
+	State      string `gorm:"size:16;not null;index"`
+	UserID     *uint
+	Username   string `gorm:"size:255"`
+	APIKeyID   *uint
+	Done       int
+	Total      int
+	Error      string
+	Report     []byte
+}
+
+func (jobV3) TableName() string { return "jobs" }
+
+// createJobs Add the table of background jobs
+func createJobs(tx *gorm.DB) error {
+	return tx.AutoMigrate(&jobV3{})
+}
+
+// dropJobs Remove the background jobs and their reports
+func dropJobs(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&jobV3{})
+}
+
+// fingerprintV4 The column added to images by version 4
+type fingerprintV4 struct {
+	Fingerprint string `gorm:"size:64;index"`
+}
+
+func (fingerprintV4) TableName() string { return "images" }
+
+// addFingerprints Add the fingerprint of the file to images, existing images are fingerprinted by
+// BackfillFingerprints, as reading all slides would hold up the migration
+func addFingerprints(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&fingerprintV4{}, "Fingerprint") {
+		if err := tx.Migrator().AddColumn(&fingerprintV4{}, "Fingerprint"); err != nil {
+			return err
+		}
+	}
+	if !tx.Migrator().HasIndex(&fingerprintV4{}, "Fingerprint") {
+		return tx.Migrator().CreateIndex(&fingerprintV4{}, "Fingerprint")
+	}
+	return nil
+}
+
+// dropFingerprints Remove the fingerprints of images
+func dropFingerprints(tx *gorm.DB) error {
+	if tx.Migrator().HasIndex(&fingerprintV4{}, "Fingerprint") {
+		if err := tx.Migrator().DropIndex(&fingerprintV4{}, "Fingerprint"); err != nil {
+			return err
+		}
+	}
+	return tx.Migrator().DropColumn(&fingerprintV4{}, "Fingerprint")
+}
+
+// identifierIndexV5 The unique index added by version 5 on the identifiers of images which are not deleted
+const identifierIndexV5 = "idx_images_identifier"
+
+// uniqueIdentifiers Make the identifiers of images which are not deleted unique, so images registered at the same time
+// cannot get the same identifier. Deleted images keep theirs, and their identifiers can be used again. Fails when
+// images already share an identifier, then these should be renamed or deleted first.
+func uniqueIdentifiers(tx *gorm.DB) error {
+	var duplicates []string
+	err := tx.Table("images").Where("deleted_at IS NULL").Group("identifier").Having("COUNT(*) > 1").
+		Pluck("identifier", &duplicates).Error
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("%d identifiers are used by more than one image, for instance %s", len(duplicates), duplicates[0])
+	}
+	if tx.Dialector.Name() == "mysql" {
+		// MySQL has no partial indexes, the index is on a column which only has the identifier of images which are
+		// not deleted
+		return tx.Exec("ALTER TABLE images ADD COLUMN live_identifier VARCHAR(255) " +
+			"AS (IF(deleted_at IS NULL, identifier, NULL)) STORED, ADD UNIQUE INDEX " + identifierIndexV5 + " (live_identifier)").Error
+	}
+	return tx.Exec("CREATE UNIQUE INDEX " + identifierIndexV5 + " ON images (identifier) WHERE deleted_at IS NULL").Error
+}
+
+// dropUniqueIdentifiers Allow images to share an identifier again
+func dropUniqueIdentifiers(tx *gorm.DB) error {
+	if tx.Dialector.Name() == "mysql" {
+		return tx.Exec("ALTER TABLE images DROP INDEX " + identifierIndexV5 + ", DROP COLUMN live_identifier").Error
+	}
+	return tx.Exec("DROP INDEX " + identifierIndexV5).Error
+}
+
+// migrations All changes to the schema, in order. Add a change at the end with the next version, and never change
+// a migration once it has been released. Migrations only use their own frozen types, never the models, so they
+// change the same tables whenever they run.
+var migrations = []Migration{
+	{Version: 1, Name: "initial schema", Up: createSchemaV1, Down: dropSchemaV1},
+	{Version: 2, Name: "paths relative to storage roots", Up: relativePaths, Down: absolutePaths},
+	{Version: 3, Name: "background jobs", Up: createJobs, Down: dropJobs},
+	{Version: 4, Name: "image fingerprints", Up: addFingerprints, Down: dropFingerprints},
+	{Version: 5, Name: "unique image identifiers", Up: uniqueIdentifiers, Down: dropUniqueIdentifiers},
+}
+
+// LatestSchemaVersion The version of the schema this build expects
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrations All migrations, in order
+func Migrations() []Migration {
+	return migrations
+}
+
+// AppliedMigrations The migrations which have been applied to the database, by version
+func AppliedMigrations() (map[int]SchemaMigration, error) {
+	if err := Database.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("cannot create the schema migrations table: %w", err)
+	}
+	var applied []SchemaMigration
+	if err := Database.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	versions := make(map[int]SchemaMigration, len(applied))
+	for _, migration := range applied {
+		versions[migration.Version] = migration
+	}
+	return versions, nil
+}
+
+// SchemaVersion The highest migration applied to the database, 0 for an empty database
+func SchemaVersion() (int, error) {
+	applied, err := AppliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// MigrateUp Apply the pending migrations up to and including the target version, 0 applies all of them. An empty
+// database gets all migrations in order. A database created before migrations were versioned already has the tables
+// of version 1, the first migration only adds the columns it misses, and the later migrations are applied to it.
+func MigrateUp(target int) error {
+	if target == 0 {
+		target = LatestSchemaVersion()
+	}
+	applied, err := AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 && Database.Migrator().HasTable("images") {
+		log.Info("Found a database created before versioned migrations, migrating it from version 1")
+	}
+
+	for _, migration := range migrations {
+		if migration.Version > target {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := Database.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("cannot apply migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		log.Info(fmt.Sprintf("Applied migration %d: %s", migration.Version, migration.Name))
+	}
+	return nil
+}
+
+// MigrateDown Undo the applied migrations above the target version, newest first. A target of 0 drops all tables.
+func MigrateDown(target int) error {
+	applied, err := AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+	for _, version := range versions {
+		if version <= target {
+			break
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			return fmt.Errorf("migration %d is applied, but not known to this version of SlideScope", version)
+		}
+		err := Database.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("cannot undo migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		log.Info(fmt.Sprintf("Undid migration %d: %s", migration.Version, migration.Name))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Package schemav1 The tables of schema version 1, as they were when migrations were introduced. These are frozen:
+// the models of the application change with later migrations, these types do not, so the first migration creates the
+// same tables on every database. The types have the names of the models, which gorm uses for keys and constraints.
+package schemav1
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// User The users table at version 1
+type User struct {
+	gorm.Model
+	Username     string `gorm:"size:255;not null;unique"`
+	Password     string `gorm:"size:255;not null;"`
+	Role         string `gorm:"size:32;not null;default:viewer"`
+	Source       string `gorm:"size:32;not null;default:local"`
+	Disabled     bool   `gorm:"not null;default:false"`
+	FailedLogins int    `gorm:"not null;default:0"`
+	LockedUntil  *time.Time
+	LastLoginAt  *time.Time
+}
+
+func (User) TableName() string { return "users" }
+
+// Image The images table at version 1
+type Image struct {
+	gorm.Model
+	ID              uint `gorm:"primary_key"`
+	Path            string
+	Identifier      string
+	MaskAnnotations []MaskAnnotation `gorm:"foreignKey:ImageID"`
+	Tags            []Tag            `gorm:"many2many:image_tags;joinForeignKey:ImageID;joinReferences:TagID"`
+
+	BlockID     *uint
+	Stain       string
+	StainMarker string
+
+	Vendor              string
+	Width               int
+	Height              int
+	MppX                *float64
+	MppY                *float64
+	ObjectivePower      *float64
+	LevelCount          int
+	FileSize            int64
+	FileModTime         *time.Time
+	MetadataExtractedAt *time.Time
+
+	Deidentify *bool
+}
+
+func (Image) TableName() string { return "images" }
+
+// MaskAnnotation The mask_annotations table at version 1
+type MaskAnnotation struct {
+	gorm.Model
+	ImageID    uint
+	Path       string
+	Identifier string
+	Vendor     string
+}
+
+func (MaskAnnotation) TableName() string { return "mask_annotations" }
+
+// Collection The collections table at version 1
+type Collection struct {
+	gorm.Model
+	Name        string `gorm:"size:255;not null"`
+	Description string
+	ParentID    *uint
+	Children    []Collection `gorm:"foreignKey:ParentID"`
+	Images      []Image      `gorm:"many2many:collection_images;joinForeignKey:CollectionID;joinReferences:ImageID"`
+}
+
+func (Collection) TableName() string { return "collections" }
+
+// Tag The tags table at version 1
+type Tag struct {
+	gorm.Model
+	Name   string  `gorm:"size:255;not null;unique"`
+	Images []Image `gorm:"many2many:image_tags;joinForeignKey:TagID;joinReferences:ImageID"`
+}
+
+func (Tag) TableName() string { return "tags" }
+
+// Case The cases table at version 1
+type Case struct {
+	gorm.Model
+	Identifier  string `gorm:"size:255;not null;unique"`
+	Description string
+	Specimens   []Specimen `gorm:"foreignKey:CaseID"`
+}
+
+func (Case) TableName() string { return "cases" }
+
+// Specimen The specimens table at version 1
+type Specimen struct {
+	gorm.Model
+	CaseID      uint
+	Identifier  string `gorm:"size:255;not null"`
+	Description string
+	Blocks      []Block `gorm:"foreignKey:SpecimenID"`
+}
+
+func (Specimen) TableName() string { return "specimens" }
+
+// Block The blocks table at version 1
+type Block struct {
+	gorm.Model
+	SpecimenID  uint
+	Identifier  string `gorm:"size:255;not null"`
+	Description string
+	Images      []Image `gorm:"foreignKey:BlockID"`
+}
+
+func (Block) TableName() string { return "blocks" }
+
+// Group The groups table at version 1
+type Group struct {
+	gorm.Model
+	Name  string `gorm:"size:255;not null;unique"`
+	Users []User `gorm:"many2many:group_users;joinForeignKey:GroupID;joinReferences:UserID"`
+}
+
+func (Group) TableName() string { return "groups" }
+
+// AccessRule The access_rules table at version 1
+type AccessRule struct {
+	gorm.Model
+	UserID           *uint
+	GroupID          *uint
+	ImageID          *uint
+	CollectionID     *uint
+	IdentifierPrefix string
+	Permission       string `gorm:"size:32;not null"`
+}
+
+func (AccessRule) TableName() string { return "access_rules" }
+
+// APIKey The api_keys table at version 1
+type APIKey struct {
+	gorm.Model
+	UserID     uint
+	Name       string `gorm:"size:255;not null"`
+	Prefix     string `gorm:"size:16"`
+	KeyHash    string `gorm:"size:64;not null;uniqueIndex"`
+	Scopes     string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (APIKey) TableName() string { return "api_keys" }
+
+// ShareLink The share_links table at version 1
+type ShareLink struct {
+	gorm.Model
+	ImageID         uint
+	CreatedByID     uint
+	Description     string
+	IncludeOverlays bool
+	ExpiresAt       time.Time
+	RevokedAt       *time.Time
+
+	RegionX      *int
+	RegionY      *int
+	RegionWidth  *int
+	RegionHeight *int
+}
+
+func (ShareLink) TableName() string { return "share_links" }
+
+// Session The sessions table at version 1
+type Session struct {
+	gorm.Model
+	UserID          uint   `gorm:"index"`
+	RefreshHash     string `gorm:"size:64;not null;uniqueIndex"`
+	PreviousHash    string `gorm:"size:64;index"`
+	UserAgent       string
+	ClientIP        string `gorm:"size:64"`
+	ExpiresAt       time.Time
+	LastRefreshedAt *time.Time
+	RevokedAt       *time.Time
+}
+
+func (Session) TableName() string { return "sessions" }
+
+// AuditEvent The audit_events table at version 1
+type AuditEvent struct {
+	ID              uint      `gorm:"primaryKey"`
+	CreatedAt       time.Time `gorm:"index"`
+	EndedAt         *time.Time
+	Action          string `gorm:"size:32;not null;index"`
+	UserID          *uint  `gorm:"index"`
+	Username        string `gorm:"size:255"`
+	APIKeyID        *uint
+	ShareLinkID     *uint
+	ImageID         *uint  `gorm:"index"`
+	ImageIdentifier string `gorm:"size:255;index"`
+	Detail          string
+	Tiles           int
+	MaxLevel        *int
+	RegionX         *float64
+	RegionY         *float64
+	RegionWidth     *float64
+	RegionHeight    *float64
+	ClientIP        string `gorm:"size:64"`
+	RequestID       string `gorm:"size:64"`
+}
+
+func (AuditEvent) TableName() string { return "audit_events" }
+
+// Models The tables of version 1, in the order they are created
+func Models() []interface{} {
+	return []interface{}{
+		&User{}, &Image{}, &MaskAnnotation{}, &Collection{}, &Tag{}, &Case{}, &Specimen{}, &Block{},
+		&Group{}, &AccessRule{}, &APIKey{}, &ShareLink{}, &Session{}, &AuditEvent{},
+	}
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// searchIndexEnabled Whether the SQLite FTS5 index on images is available
+var searchIndexEnabled bool
+
+// insertSearchIndex Fill the search index from the images and their masks
+const insertSearchIndex = `INSERT INTO image_search (rowid, identifier, mask_identifiers, path)
+	SELECT images.id, images.identifier, COALESCE((
+		SELECT GROUP_CONCAT(mask_annotations.identifier, ' ') FROM mask_annotations
+		WHERE mask_annotations.image_id = images.id AND mask_annotations.deleted_at IS NULL), ''), images.path
+	FROM images WHERE images.deleted_at IS NULL`
+
+// ImageFilter Filters which can be applied to a query on images
+type ImageFilter struct {
+	IdentifierPrefix string
+	PathPrefix       string
+	CreatedAfter     *time.Time
+	CreatedBefore    *time.Time
+	HasMasks         *bool
+	Search           string
+	CollectionIDs    []uint   // Images in any of these collections
+	Tags             []string // Images with all of these tags
+	BlockIDs         []uint   // Images cut from any of these blocks
+	Stain            string
+	StainMarker      string
+}
+
+// escapeLike Escape the wildcards in a LIKE pattern. The escape character is an exclamation mark,
+// as a backslash is interpreted differently between databases.
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+// Apply Add the filters to a query on the images table
+func (filter ImageFilter) Apply(db *gorm.DB) *gorm.DB {
+	if filter.IdentifierPrefix != "" {
+		db = db.Where("images.identifier LIKE ? ESCAPE '!'", escapeLike(filter.IdentifierPrefix)+"%")
+	}
+	if filter.PathPrefix != "" {
+		db = db.Where("images.path LIKE ? ESCAPE '!'", escapeLike(filter.PathPrefix)+"%")
+	}
+	if filter.CreatedAfter != nil {
+		db = db.Where("images.created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		db = db.Where("images.created_at < ?", *filter.CreatedBefore)
+	}
+	if filter.HasMasks != nil {
+		hasMasks := "EXISTS (SELECT 1 FROM mask_annotations WHERE mask_annotations.image_id = images.id AND mask_annotations.deleted_at IS NULL)"
+		if *filter.HasMasks {
+			db = db.Where(hasMasks)
+		} else {
+			db = db.Where("NOT " + hasMasks)
+		}
+	}
+	if filter.Search != "" {
+		db = searchImages(db, filter.Search)
+	}
+	if filter.CollectionIDs != nil {
+		db = db.Where("images.id IN (SELECT collection_images.image_id FROM collection_images WHERE collection_images.collection_id IN ?)", filter.CollectionIDs)
+	}
+	if filter.BlockIDs != nil {
+		db = db.Where("images.block_id IN ?", filter.BlockIDs)
+	}
+	if filter.Stain != "" {
+		db = db.Where("images.stain = ?", filter.Stain)
+	}
+	if filter.StainMarker != "" {
+		db = db.Where("images.stain_marker = ?", filter.StainMarker)
+	}
+	for _, tag := range filter.Tags {
+		db = db.Where("images.id IN (SELECT image_tags.image_id FROM image_tags JOIN tags ON tags.id = image_tags.tag_id WHERE tags.name = ? AND tags.deleted_at IS NULL)", tag)
+	}
+	return db
+}
+
+// searchImages Full-text search over the image identifiers, mask identifiers and paths.
+// Uses the FTS5 index when available, and falls back to LIKE otherwise.
+func searchImages(db *gorm.DB, query string) *gorm.DB {
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return db
+	}
+
+	if searchIndexEnabled {
+		// Quote every term so FTS5 syntax in the query is not interpreted, and match on prefixes
+		var matchTerms []string
+		for _, term := range terms {
+			matchTerms = append(matchTerms, "\""+strings.ReplaceAll(term, "\"", "\"\"")+"\"*")
+		}
+		return db.Where("images.id IN (SELECT rowid FROM image_search WHERE image_search MATCH ?)", strings.Join(matchTerms, " "))
+	}
+
+	for _, term := range terms {
+		pattern := "%" + escapeLike(term) + "%"
+		db = db.Where(
+			"(images.identifier LIKE @pattern ESCAPE '!' OR images.path LIKE @pattern ESCAPE '!' OR EXISTS ("+
+				"SELECT 1 FROM mask_annotations WHERE mask_annotations.image_id = images.id "+
+				"AND mask_annotations.deleted_at IS NULL AND mask_annotations.identifier LIKE @pattern ESCAPE '!'))",
+			map[string]interface{}{"pattern": pattern})
+	}
+	return db
+}
+
+// SetupSearchIndex Create the FTS5 search index on images when the database supports it
+func SetupSearchIndex(db *gorm.DB) {
+	if db.Dialector.Name() != "sqlite" {
+		log.Info("Full-text search index is only available for sqlite, falling back to LIKE search")
+		return
+	}
+
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS image_search USING fts5(identifier, mask_identifiers, path)").Error
+	if err != nil {
+		log.Info(fmt.Sprintf("SQLite FTS5 is not available, falling back to LIKE search: %s", err.Error()))
+		return
+	}
+	searchIndexEnabled = true
+
+	if err := RebuildSearchIndex(db); err != nil {
+		log.Warn(fmt.Sprintf("Cannot build the search index: %s", err.Error()))
+	}
+}
+
+// RebuildSearchIndex Recreate the search index from the images and masks in the database
+func RebuildSearchIndex(db *gorm.DB) error {
+	if !searchIndexEnabled {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM image_search").Error; err != nil {
+			return err
+		}
+		return tx.Exec(insertSearchIndex).Error
+	})
+}
+
+// indexImage Update the search index entry of a single image
+func indexImage(tx *gorm.DB, imageID uint) error {
+	if !searchIndexEnabled {
+		return nil
+	}
+	if err := tx.Exec("DELETE FROM image_search WHERE rowid = ?", imageID).Error; err != nil {
+		return err
+	}
+	return tx.Exec(insertSearchIndex+" AND images.id = ?", imageID).Error
+}
+
+// AfterSave Keep the search index up to date when an image is created or updated
+func (image *Image) AfterSave(tx *gorm.DB) error {
+	return indexImage(tx, image.ID)
+}
+
+// AfterDelete Remove a deleted image from the search index
+func (image *Image) AfterDelete(tx *gorm.DB) error {
+	return indexImage(tx, image.ID)
+}
+
+// AfterSave Keep the mask identifiers of the image in the search index up to date
+func (maskAnnotation *MaskAnnotation) AfterSave(tx *gorm.DB) error {
+	return indexImage(tx, maskAnnotation.ImageID)
+}
+
+// AfterDelete Remove the mask identifier from the search index of the image
+func (maskAnnotation *MaskAnnotation) AfterDelete(tx *gorm.DB) error {
+	return indexImage(tx, maskAnnotation.ImageID)
+}
@@ -0,0 +1,175 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"slidescope/utils/token"
+	"time"
+)
+
+// Session A login of a user. The session is extended with a refresh token, which is replaced on every refresh.
+type Session struct {
+	gorm.Model
+	UserID          uint       `gorm:"index" json:"user_id"`
+	RefreshHash     string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	PreviousHash    string     `gorm:"size:64;index" json:"-"` // The refresh token before the last rotation, to detect reuse
+	UserAgent       string     `json:"user_agent"`
+	ClientIP        string     `gorm:"size:64" json:"client_ip"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	LastRefreshedAt *time.Time `json:"last_refreshed_at"`
+	RevokedAt       *time.Time `json:"revoked_at"`
+}
+
+// TokenPair The tokens handed out on login and refresh
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // Lifetime of the access token in seconds
+}
+
+// Active Check the session has not been revoked and has not expired
+func (s Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// issueTokens Create an access token and a new refresh token for the session
+func (s *Session) issueTokens() (TokenPair, string, error) {
+	refreshToken, err := token.GenerateRefreshToken()
+	if err != nil {
+		return TokenPair{}, "", err
+	}
+	refreshLifespan, err := token.RefreshTokenLifespan()
+	if err != nil {
+		return TokenPair{}, "", err
+	}
+	tokenLifespan, err := token.TokenLifespan()
+	if err != nil {
+		return TokenPair{}, "", err
+	}
+	s.ExpiresAt = time.Now().Add(refreshLifespan)
+
+	pair := TokenPair{RefreshToken: refreshToken, ExpiresIn: int(tokenLifespan.Seconds())}
+	return pair, token.HashRefreshToken(refreshToken), nil
+}
+
+// startSession Store a new session of the user, and create its tokens
+func startSession(u User, userAgent string, clientIP string) (Session, TokenPair, error) {
+	s := Session{UserID: u.ID, UserAgent: userAgent, ClientIP: clientIP}
+	pair, refreshHash, err := s.issueTokens()
+	if err != nil {
+		return Session{}, TokenPair{}, err
+	}
+	s.RefreshHash = refreshHash
+	if err := Database.Create(&s).Error; err != nil {
+		return Session{}, TokenPair{}, err
+	}
+
+	pair.Token, err = token.GenerateToken(u.ID, s.ID)
+	if err != nil {
+		return Session{}, TokenPair{}, err
+	}
+	return s, pair, nil
+}
+
+// CreateSession Start a session for a user who logged in
+func CreateSession(u User, userAgent string, clientIP string) (TokenPair, error) {
+	_, pair, err := startSession(u, userAgent, clientIP)
+	return pair, err
+}
+
+// CreateBrowserSession Start a session for a user who logged in on the web frontend. The session is kept in a cookie,
+// its tokens are not handed out, so it ends when it expires or is revoked.
+func CreateBrowserSession(u User, userAgent string, clientIP string) (Session, error) {
+	s, _, err := startSession(u, userAgent, clientIP)
+	return s, err
+}
+
+// revokeReusedSession Revoke a session whose refresh token was used more than once
+func revokeReusedSession(s *Session) error {
+	if err := s.Revoke(); err != nil {
+		log.Warn(fmt.Sprintf("Cannot revoke session %d after its refresh token was reused: %s", s.ID, err.Error()))
+		return fmt.Errorf("refresh token has already been used, and the session cannot be revoked: %w", err)
+	}
+	return errors.New("refresh token has already been used, the session is revoked")
+}
+
+// RefreshSession Replace a refresh token by a new pair of tokens. A refresh token can only be used once,
+// when an old one is presented again it has been stolen or leaked, and the session is revoked.
+func RefreshSession(refreshToken string) (TokenPair, error) {
+	hash := token.HashRefreshToken(refreshToken)
+
+	var s Session
+	if err := Database.Where("refresh_hash = ?", hash).First(&s).Error; err != nil {
+		if Database.Where("previous_hash = ?", hash).First(&s).Error == nil {
+			return TokenPair{}, revokeReusedSession(&s)
+		}
+		return TokenPair{}, errors.New("invalid refresh token")
+	}
+	if !s.Active() {
+		return TokenPair{}, errors.New("session is revoked or expired")
+	}
+	if _, err := GetUserByID(s.UserID); err != nil {
+		return TokenPair{}, err
+	}
+
+	pair, refreshHash, err := s.issueTokens()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	now := time.Now()
+	// Only rotate when the token has not been rotated concurrently
+	result := Database.Model(&Session{}).
+		Where("id = ? AND refresh_hash = ?", s.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_hash":      refreshHash,
+			"previous_hash":     hash,
+			"expires_at":        s.ExpiresAt,
+			"last_refreshed_at": now,
+		})
+	if result.Error != nil {
+		return TokenPair{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Another request rotated the token in the meantime, the token was presented twice
+		return TokenPair{}, revokeReusedSession(&s)
+	}
+
+	pair.Token, err = token.GenerateToken(s.UserID, s.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return pair, nil
+}
+
+// Revoke End the session, its refresh token and access tokens stop working
+func (s *Session) Revoke() error {
+	now := time.Now()
+	s.RevokedAt = &now
+	return Database.Model(s).Update("revoked_at", now).Error
+}
+
+// RevokeUserSessions End all sessions of a user, and return how many were active
+func RevokeUserSessions(userID uint) (int64, error) {
+	result := Database.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// AuthenticateToken Find the user of an access token, as long as its session is active
+func AuthenticateToken(claims token.Claims) (Session, User, error) {
+	var s Session
+	if err := Database.First(&s, claims.SessionID).Error; err != nil {
+		return Session{}, User{}, errors.New("session not found")
+	}
+	if s.UserID != claims.UserID || !s.Active() {
+		return Session{}, User{}, errors.New("session is revoked or expired")
+	}
+	u, err := GetUserByID(s.UserID)
+	if err != nil {
+		return Session{}, User{}, err
+	}
+	return s, u, nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"slidescope/utils/token"
+)
+
+func TestRefreshSession(t *testing.T) {
+	t.Setenv("API_SECRET", "test secret")
+	testDatabase(t)
+	u := testUser(t, User{Username: "alice", Password: "alice secret"})
+
+	tests := []struct {
+		name string
+		// present are the refresh tokens used after the first refresh, in order: the original one of the login,
+		// the rotated one of the first refresh, or an unknown one
+		present     []string
+		wantErr     string // Of the last refresh, empty when it succeeds
+		wantRevoked bool
+	}{
+		{name: "rotated token", present: []string{"rotated"}},
+		{name: "rotated tokens are rotated again", present: []string{"rotated", "latest"}},
+		{name: "reusing the original token revokes the session", present: []string{"original"},
+			wantErr: "already been used", wantRevoked: true},
+		{name: "the rotated token stops working after reuse", present: []string{"original", "rotated"},
+			wantErr: "revoked or expired", wantRevoked: true},
+		{name: "reusing a rotated token revokes the session", present: []string{"rotated", "rotated"},
+			wantErr: "already been used", wantRevoked: true},
+		{name: "unknown token", present: []string{"unknown"}, wantErr: "invalid refresh token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pair, err := CreateSession(u, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotated, err := RefreshSession(pair.RefreshToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated.RefreshToken == pair.RefreshToken || rotated.Token == "" {
+				t.Fatal("refreshing did not hand out new tokens")
+			}
+			var session Session
+			if err := Database.Where("refresh_hash = ?", token.HashRefreshToken(rotated.RefreshToken)).Take(&session).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			tokens := map[string]string{
+				"original": pair.RefreshToken,
+				"rotated":  rotated.RefreshToken,
+				"unknown":  "ssr_unknown",
+			}
+			for i, name := range test.present {
+				refreshed, err := RefreshSession(tokens[name])
+				if i < len(test.present)-1 {
+					if err == nil {
+						tokens["latest"] = refreshed.RefreshToken
+					}
+					continue
+				}
+				if test.wantErr == "" && err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+					t.Fatalf("error %v, want one containing %q", err, test.wantErr)
+				}
+			}
+
+			if err := Database.Take(&session, session.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if revoked := session.RevokedAt != nil; revoked != test.wantRevoked {
+				t.Fatalf("session revoked is %v, want %v", revoked, test.wantRevoked)
+			}
+			// Access tokens of the session stop working as soon as it is revoked
+			_, _, err = AuthenticateToken(token.Claims{UserID: u.ID, SessionID: session.ID})
+			if (err != nil) != test.wantRevoked {
+				t.Fatalf("authenticating an access token of the session gave %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshSessionEnded(t *testing.T) {
+	t.Setenv("API_SECRET", "test secret")
+	testDatabase(t)
+
+	tests := []struct {
+		name    string
+		end     func(u *User, session *Session) error
+		wantErr string
+	}{
+		{"revoked session", func(u *User, session *Session) error { return session.Revoke() }, "revoked or expired"},
+		{"all sessions of the user revoked", func(u *User, session *Session) error {
+			_, err := RevokeUserSessions(u.ID)
+			return err
+		}, "revoked or expired"},
+		{"expired session", func(u *User, session *Session) error {
+			return Database.Model(session).Update("expires_at", time.Now().Add(-time.Minute)).Error
+		}, "revoked or expired"},
+		{"disabled user", func(u *User, session *Session) error { return u.SetDisabled(true) }, "revoked or expired"},
+		{"deleted user", func(u *User, session *Session) error { return DeleteUser(u) }, "revoked or expired"},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := testUser(t, User{Username: "user" + string(rune('a'+i)), Password: "secret"})
+			pair, err := CreateSession(u, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var session Session
+			if err := Database.Where("refresh_hash = ?", token.HashRefreshToken(pair.RefreshToken)).Take(&session).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := test.end(&u, &session); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RefreshSession(pair.RefreshToken); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRefreshSessionConcurrently(t *testing.T) {
+	t.Setenv("API_SECRET", "test secret")
+	testDatabase(t)
+	u := testUser(t, User{Username: "alice", Password: "alice secret"})
+	pair, err := CreateSession(u, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session Session
+	if err := Database.Where("refresh_hash = ?", token.HashRefreshToken(pair.RefreshToken)).Take(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Another request with the same refresh token rotates it between the lookup and the rotation of this one
+	rotated := false
+	err = Database.Callback().Update().Before("gorm:update").Register("test:rotate", func(db *gorm.DB) {
+		if rotated {
+			return
+		}
+		rotated = true
+		if err := Database.Exec("UPDATE sessions SET refresh_hash = ? WHERE id = ?", "concurrent", session.ID).Error; err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Database.Callback().Update().Remove("test:rotate") })
+
+	if _, err := RefreshSession(pair.RefreshToken); err == nil || !strings.Contains(err.Error(), "already been used") {
+		t.Fatalf("error %v, want the reuse to be refused", err)
+	}
+	if err := Database.Take(&session, session.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if session.RevokedAt == nil {
+		t.Fatal("the session is not revoked")
+	}
+}
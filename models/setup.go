@@ -2,32 +2,52 @@ package models
 
 import (
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"slidescope/utils"
+	"strings"
 )
 
 var Database *gorm.DB
 
-func ConnectDataBase(dbUrl string) {
-	sqliteDb := sqlite.Open(dbUrl)
-	var err error
-	Database, err = gorm.Open(sqliteDb, &gorm.Config{})
-
-	if err != nil {
-		log.Fatal(fmt.Sprintf("Cannot connect sqlite database at %s", dbUrl))
-		log.Fatal("connection error:", err)
-	} else {
-		log.Info(fmt.Sprintf("Connecting to sqlite database %s", dbUrl))
+// withParameter Add a query parameter to the DSN, unless it is already set
+func withParameter(dsn string, key string, value string) string {
+	if strings.Contains(dsn, key+"=") {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
 	}
+	return dsn + separator + key + "=" + value
+}
 
-	err = Database.AutoMigrate(&User{})
-	err = Database.AutoMigrate(&Image{})
-	err = Database.AutoMigrate(&MaskAnnotation{})
+// ConnectDataBase Connect to the database in the config. SQLite runs in WAL mode, so reading does not wait for
+// writes. The schema is not changed, see MigrateUp.
+func ConnectDataBase(config utils.DatabaseConfig) error {
+	var dialector gorm.Dialector
+	switch config.Driver {
+	case "sqlite":
+		dsn := withParameter(config.DSN, "_journal_mode", "WAL")
+		dialector = sqlite.Open(withParameter(dsn, "_busy_timeout", "5000"))
+	case "mysql":
+		// Timestamps are only scanned into time.Time with parseTime
+		dialector = mysql.Open(withParameter(config.DSN, "parseTime", "true"))
+	case "postgres":
+		dialector = postgres.Open(config.DSN)
+	default:
+		return fmt.Errorf("unknown database driver %s", config.Driver)
+	}
 
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Cannot automigrate: %s"), err.Error())
+		return fmt.Errorf("cannot connect to the %s database: %w", config.Driver, err)
 	}
-
+	// The DSN is not logged, it can contain a password
+	log.Info(fmt.Sprintf("Connected to %s database", config.Driver))
+	Database = db
+	return nil
 }
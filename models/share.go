@@ -0,0 +1,69 @@
+package models
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"slidescope/utils/token"
+	"time"
+)
+
+// ShareLink Access to a single image for people without an account, through a signed and expiring URL
+type ShareLink struct {
+	gorm.Model
+	ImageID         uint       `json:"image_id"`
+	CreatedByID     uint       `json:"created_by_id"`
+	Description     string     `json:"description"`
+	IncludeOverlays bool       `json:"include_overlays"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at"`
+
+	// Optional region restriction in level 0 coordinates
+	RegionX      *int `json:"region_x"`
+	RegionY      *int `json:"region_y"`
+	RegionWidth  *int `json:"region_width"`
+	RegionHeight *int `json:"region_height"`
+}
+
+// Token The signed token to pass as ?share= in the URL
+func (link *ShareLink) Token() string {
+	return token.SignShareLink(link.ID, link.ExpiresAt)
+}
+
+// HasRegion Check if the link is restricted to a region of the image
+func (link *ShareLink) HasRegion() bool {
+	return link.RegionX != nil && link.RegionY != nil && link.RegionWidth != nil && link.RegionHeight != nil
+}
+
+// RegionIntersects Check if a level 0 rectangle overlaps with the region of the link
+func (link *ShareLink) RegionIntersects(location [2]float64, size [2]float64) bool {
+	if !link.HasRegion() {
+		return true
+	}
+	return location[0] < float64(*link.RegionX+*link.RegionWidth) &&
+		location[0]+size[0] > float64(*link.RegionX) &&
+		location[1] < float64(*link.RegionY+*link.RegionHeight) &&
+		location[1]+size[1] > float64(*link.RegionY)
+}
+
+// Revoke Revoke the link, it can no longer be used
+func (link *ShareLink) Revoke() error {
+	now := time.Now()
+	link.RevokedAt = &now
+	return Database.Model(link).Update("revoked_at", now).Error
+}
+
+// AuthenticateShareLink Verify the signed token and check the link has not been revoked
+func AuthenticateShareLink(shareToken string) (ShareLink, error) {
+	linkId, err := token.ParseShareLink(shareToken)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	var link ShareLink
+	if err := Database.First(&link, linkId).Error; err != nil {
+		return ShareLink{}, errors.New("share link not found")
+	}
+	if link.RevokedAt != nil {
+		return ShareLink{}, errors.New("share link has been revoked")
+	}
+	return link, nil
+}
@@ -2,18 +2,56 @@ package models
 
 import (
 	"errors"
+	"fmt"
 	"html"
 	"strings"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
-	"slidescope/utils/token"
+)
+
+// Roles a user can have. Each role includes the rights of the roles below it.
+const (
+	RoleAdmin     = "admin"     // Manage images, users and everything else
+	RoleAnnotator = "annotator" // Write annotations
+	RoleViewer    = "viewer"    // Read-only access
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:    1,
+	RoleAnnotator: 2,
+	RoleAdmin:     3,
+}
+
+// Where the account of a user is managed
+const (
+	SourceLocal = "local" // Password is stored in the database
+	SourceLDAP  = "ldap"  // Password and role are managed in the directory, created on the first login
 )
 
 type User struct {
 	gorm.Model
-	Username string `gorm:"size:255;not null;unique" json:"username"`
-	Password string `gorm:"size:255;not null;" json:"password"`
+	Username     string     `gorm:"size:255;not null;unique" json:"username"`
+	Password     string     `gorm:"size:255;not null;" json:"-"`
+	Role         string     `gorm:"size:32;not null;default:viewer" json:"role"`
+	Source       string     `gorm:"size:32;not null;default:local" json:"source"`
+	Disabled     bool       `gorm:"not null;default:false" json:"disabled"`
+	FailedLogins int        `gorm:"not null;default:0" json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until"`
+	LastLoginAt  *time.Time `json:"last_login_at"`
+}
+
+// ValidRole Check if the role exists
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// HasRole Check if the user has the role, or a role above it
+func (u *User) HasRole(role string) bool {
+	return roleLevels[u.Role] >= roleLevels[role] && roleLevels[role] > 0
 }
 
 func GetUserByID(uid uint) (User, error) {
@@ -21,7 +59,10 @@ func GetUserByID(uid uint) (User, error) {
 	var u User
 
 	if err := Database.First(&u, uid).Error; err != nil {
-		return u, errors.New("DeepZoomStruct not found!")
+		return u, errors.New("User not found!")
+	}
+	if u.Disabled {
+		return User{}, ErrUserDisabled
 	}
 
 	u.PrepareGive()
@@ -34,30 +75,64 @@ func (u *User) PrepareGive() {
 	u.Password = ""
 }
 
+// hashPassword Hash a password for storage
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashedPassword), err
+}
+
 func VerifyPassword(password, hashedPassword string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
 
-func LoginCheck(username string, password string) (string, error) {
-
-	var err error
-	u := User{}
-	err = Database.Model(User{}).Where("username = ?", username).Take(&u).Error
+// LoginCheck Find the user with the given username and password, with the configured authenticators.
+// Disabled and locked accounts are refused, failed logins count towards the lockout.
+func LoginCheck(username string, password string) (User, error) {
+	username = strings.TrimSpace(username)
+	account, err := checkAccount(username)
 	if err != nil {
-		return "", err
+		return User{}, err
 	}
-	err = VerifyPassword(password, u.Password)
-	if err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
-		return "", err
-	}
-	token, err := token.GenerateToken(u.ID)
 
+	u, err := authenticate(username, password)
 	if err != nil {
-		return "", err
+		if account != nil && errors.Is(err, ErrInvalidCredentials) {
+			if recordErr := recordLogin(account, false); recordErr != nil {
+				return User{}, recordErr
+			}
+		}
+		return User{}, err
 	}
 
-	return token, nil
+	// Directory users can be created or found under another name by this login, so their account is checked again
+	var current User
+	if err := Database.Select("id", "disabled", "locked_until").Take(&current, u.ID).Error; err != nil {
+		return User{}, err
+	}
+	if err := refuseAccount(current); err != nil {
+		return User{}, err
+	}
+	if err := recordLogin(&u, true); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
 
+// authenticate Check the username and password against the configured authenticators, in order
+func authenticate(username string, password string) (User, error) {
+	for _, authenticator := range authenticators {
+		u, err := authenticator.Authenticate(username, password)
+		if err == nil {
+			return u, nil
+		}
+		if !errors.Is(err, ErrUnknownUser) {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				log.Warn(fmt.Sprintf("Login of %s failed: %s", username, err.Error()))
+			}
+			return User{}, err
+		}
+	}
+	return User{}, ErrInvalidCredentials
 }
 
 func (u *User) SaveUser() (*User, error) {
@@ -70,18 +145,45 @@ func (u *User) SaveUser() (*User, error) {
 	return u, nil
 }
 
-func (u *User) BeforeSave() error {
+// BeforeCreate Hash the password and clean up the username of a new user
+func (u *User) BeforeCreate(tx *gorm.DB) error {
 
 	//turn password into hash
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(u.Password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hashedPassword)
+	u.Password = hashedPassword
 
 	//remove spaces in username
 	u.Username = html.EscapeString(strings.TrimSpace(u.Username))
 
+	if u.Role == "" {
+		u.Role = RoleViewer
+	}
+	if u.Source == "" {
+		u.Source = SourceLocal
+	}
+
 	return nil
 
 }
+
+// EnsureAdmin Create an admin user when there are no users yet, so the instance can be set up
+func EnsureAdmin(username string, password string) error {
+	var count int64
+	if err := Database.Model(&User{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 || username == "" || password == "" {
+		return nil
+	}
+
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Creating initial admin user %s", username))
+	u := User{Username: username, Password: password, Role: RoleAdmin}
+	_, err := u.SaveUser()
+	return err
+}
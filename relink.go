@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slidescope/library"
+	"strings"
+	"text/tabwriter"
+)
+
+// relinkUsage How the relink subcommand is used
+const relinkUsage = "usage: slidescope [-config config.yaml] relink [-dry-run] [-root default] folder..."
+
+// runRelink Run the relink subcommand: find the files of missing images in the folders of a storage root, and
+// print which images and masks were relinked
+func runRelink(args []string) error {
+	flags := flag.NewFlagSet("relink", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report which images would be relinked")
+	root := flags.String("root", "", "storage root of the folders, the default root when left out")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		return errors.New(relinkUsage)
+	}
+	var folders []library.Folder
+	for _, folder := range flags.Args() {
+		folders = append(folders, library.Folder{StorageRoot: *root, Path: folder})
+	}
+
+	report, err := library.Relink(library.RelinkOptions{Folders: folders, DryRun: *dryRun, Actor: commandActor()})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENTIFIER\tOLD PATH\tNEW PATH")
+	for _, relinked := range report.Relinked {
+		fmt.Fprintf(w, "%s\t%s/%s\t%s/%s\n", relinked.Identifier,
+			relinked.OldStorageRoot, relinked.OldPath, relinked.StorageRoot, relinked.Path)
+	}
+	for _, mask := range report.RelinkedMasks {
+		fmt.Fprintf(w, "%s/%s\t%s/%s\t%s/%s\n", mask.ImageIdentifier, mask.Identifier,
+			mask.OldStorageRoot, mask.OldPath, mask.StorageRoot, mask.Path)
+	}
+	for _, ambiguous := range report.Ambiguous {
+		fmt.Fprintf(w, "%s\t\tfound more than once: %s\n", ambiguous.Identifier, strings.Join(ambiguous.Candidates, ", "))
+	}
+	for _, mask := range report.MasksNotFound {
+		fmt.Fprintf(w, "%s\t\tmask not found\n", mask)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d images missing, %d files fingerprinted, %d relinked, %d ambiguous, %d not found, %d without fingerprint, %d masks relinked, %d masks not found\n",
+		report.Missing, report.Scanned, len(report.Relinked), len(report.Ambiguous), len(report.NotFound), len(report.NoFingerprint),
+		len(report.RelinkedMasks), len(report.MasksNotFound))
+	return nil
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// fingerprintChunk The number of bytes read at the start, middle and end of a file for its fingerprint
+const fingerprintChunk = 64 << 10
+
+// Fingerprint A fast content fingerprint of a file and its size. Only the start, middle and end of the file are
+// hashed together with its size, so slides of many gigabytes are fingerprinted in a few reads. This tells files
+// apart and recognizes a moved file, it does not prove a file is unchanged.
+func Fingerprint(location string) (string, int64, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	size := info.Size()
+
+	hash := sha256.New()
+	binary.Write(hash, binary.BigEndian, size)
+	buffer := make([]byte, fingerprintChunk)
+	for _, offset := range []int64{0, size/2 - fingerprintChunk/2, size - fingerprintChunk} {
+		if offset < 0 {
+			offset = 0
+		}
+		n, err := file.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			return "", 0, err
+		}
+		hash.Write(buffer[:n])
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
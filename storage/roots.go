@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultRoot The root of paths which do not name one
+const DefaultRoot = "default"
+
+// ErrOutsideRoot The path leaves its storage root
+var ErrOutsideRoot = errors.New("path is outside of the storage root")
+
+// root A directory slides are stored under, as configured and with its symlinks resolved
+type root struct {
+	name      string
+	directory string
+	resolved  string
+}
+
+// Roots The directories slides and masks are stored under, by name. Paths in the database are relative to a root,
+// so the library is moved by changing the directory of its root.
+type Roots struct {
+	roots map[string]root
+}
+
+// NewRoots Check the directories exist, relative directories are taken from the working directory
+func NewRoots(directories map[string]string) (*Roots, error) {
+	roots := &Roots{roots: make(map[string]root, len(directories))}
+	for name, directory := range directories {
+		absolute, err := filepath.Abs(directory)
+		if err != nil {
+			return nil, fmt.Errorf("storage root %s: %w", name, err)
+		}
+		resolved, err := filepath.EvalSymlinks(absolute)
+		if err != nil {
+			return nil, fmt.Errorf("storage root %s: %w", name, err)
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("storage root %s: %s is not a directory", name, directory)
+		}
+		roots.roots[name] = root{name: name, directory: absolute, resolved: resolved}
+	}
+	return roots, nil
+}
+
+// Names The names of the roots, sorted
+func (roots *Roots) Names() []string {
+	names := make([]string, 0, len(roots.roots))
+	for name := range roots.roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Directory The absolute directory of the root
+func (roots *Roots) Directory(name string) (string, bool) {
+	r, ok := roots.roots[name]
+	return r.directory, ok
+}
+
+// within Check the path is the directory or below it
+func within(directory string, path string) bool {
+	relative, err := filepath.Rel(directory, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// CleanPath Check a path is relative and does not go up with .., and return it with forward slashes as it is stored
+func CleanPath(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("path cannot be empty")
+	}
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) || filepath.VolumeName(path) != "" {
+		return "", fmt.Errorf("path %s should be relative to its storage root", path)
+	}
+	for _, element := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return "", fmt.Errorf("path %s cannot contain ..", path)
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(filepath.FromSlash(path))), nil
+}
+
+// Resolve The location of a file on disk from its root and relative path. Absolute paths, .. and symlinks which
+// point outside of the root are refused, so clients can only reach files in the storage roots. The location is
+// returned with its symlinks resolved, so a symlink which is changed after the check is not followed.
+func (roots *Roots) Resolve(name string, path string) (string, error) {
+	r, ok := roots.roots[name]
+	if !ok {
+		return "", fmt.Errorf("unknown storage root %s", name)
+	}
+	cleaned, err := CleanPath(path)
+	if err != nil {
+		return "", err
+	}
+	location := filepath.Join(r.directory, filepath.FromSlash(cleaned))
+	// The error is not passed on, it contains the location on the server
+	target, err := filepath.EvalSymlinks(location)
+	if err != nil {
+		return "", fmt.Errorf("cannot find %s in storage root %s", cleaned, name)
+	}
+	if !within(r.resolved, target) {
+		return "", ErrOutsideRoot
+	}
+	return target, nil
+}
+
+// Relative The root and relative path of a location on disk, from the deepest root which contains it
+func (roots *Roots) Relative(location string) (string, string, error) {
+	absolute, err := filepath.Abs(location)
+	if err != nil {
+		return "", "", err
+	}
+	best, bestRelative := "", ""
+	for _, r := range roots.roots {
+		for _, directory := range []string{r.directory, r.resolved} {
+			if !within(directory, absolute) {
+				continue
+			}
+			relative, _ := filepath.Rel(directory, absolute)
+			if best == "" || len(relative) < len(bestRelative) || (len(relative) == len(bestRelative) && r.name < best) {
+				best, bestRelative = r.name, relative
+			}
+		}
+	}
+	if best == "" {
+		return "", "", fmt.Errorf("%s is not in any of the storage roots", location)
+	}
+	return best, filepath.ToSlash(bestRelative), nil
+}
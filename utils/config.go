@@ -4,33 +4,249 @@ package utils
 import (
 	"flag"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"net"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Config struct for webapp config
 type Config struct {
-	// TODO: Validate these inputs (sum 256, or format = png or jpg)
 	DeepZoom struct {
 		TileSize    int    `yaml:"tile_size"`
 		TileOverlap int    `yaml:"tile_overlap"`
 		Format      string `yaml:"format"`
-	}
+		// JPEGQuality is the quality of jpeg tiles and thumbnails, from 1 to 100
+		JPEGQuality int `yaml:"jpeg_quality"`
+		// CacheSeconds is how long an opened slide is kept in the cache after it was opened
+		CacheSeconds int `yaml:"cache_seconds"`
+		// CacheMaxSlides is the number of slides kept open in the cache, 0 does not limit it
+		CacheMaxSlides int `yaml:"cache_max_slides"`
+	} `yaml:"deepzoom"`
+
+	Log struct {
+		// Level is the lowest level which is logged: debug, info, warning or error
+		Level string `yaml:"level"`
+	} `yaml:"log"`
 
 	Sqlite struct {
+		// Filename of the database when database.dsn is not set, kept for older configs
 		Filename string `yaml:"filename"`
-	}
+	} `yaml:"sqlite"`
+
+	Database DatabaseConfig `yaml:"database"`
+
+	Storage struct {
+		// Roots are the directories slides and masks are stored under, by name. Image and mask paths are relative to
+		// a root, and the default root is used when a client does not name one.
+		Roots map[string]string `yaml:"roots"`
+	} `yaml:"storage"`
+
+	Auth struct {
+		// AnonymousRead allows reading images and tiles without logging in
+		AnonymousRead bool `yaml:"anonymous_read"`
+		// DefaultRole is the role of newly registered users when none is given
+		DefaultRole string `yaml:"default_role"`
+		// EnforceAccessRules limits non-admin users to the images granted to them or their groups
+		EnforceAccessRules bool `yaml:"enforce_access_rules"`
+		// PasswordPolicy are the rules passwords of local users should follow
+		PasswordPolicy PasswordPolicy `yaml:"password_policy"`
+		// Lockout blocks logins to an account after repeated failed attempts
+		Lockout LockoutConfig `yaml:"lockout"`
+	} `yaml:"auth"`
+
+	Session struct {
+		// CookieName is the name of the session cookie of the web frontend
+		CookieName string `yaml:"cookie_name"`
+		// Secure only sends the cookie over HTTPS, enable this when SlideScope is served over HTTPS
+		Secure bool `yaml:"secure"`
+		// SameSite is the SameSite attribute of the cookie: strict, lax or none (which requires secure)
+		SameSite string `yaml:"same_site"`
+		// Domain of the cookie, when empty the cookie is only sent to the host that set it
+		Domain string `yaml:"domain"`
+	} `yaml:"session"`
+
+	LDAP LDAPConfig `yaml:"ldap"`
+
+	Audit AuditConfig `yaml:"audit"`
+
+	Deidentification DeidentificationConfig `yaml:"deidentification"`
+
+	Ingest IngestConfig `yaml:"ingest"`
 
 	Server struct {
 		// Port is the local machine TCP Port to bind the HTTP Server to
 		Port string `yaml:"port"`
+		// BasePath serves all routes, static files and pages under this prefix, for instance /slidescope
+		BasePath string `yaml:"base_path"`
+		// TrustedProxies are the addresses or CIDR ranges of reverse proxies whose X-Forwarded-For header is used
+		// for the client IP, when empty the address of the connection is used
+		TrustedProxies []string `yaml:"trusted_proxies"`
 	} `yaml:"server"`
+
+	CORS CORSConfig `yaml:"cors"`
+}
+
+// BasePath The prefix of all routes, without a trailing slash, or empty when served at the root
+func (config *Config) BasePath() string {
+	basePath := strings.Trim(config.Server.BasePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// DatabaseConfig The database SlideScope stores its data in
+type DatabaseConfig struct {
+	// Driver is sqlite, mysql or postgres
+	Driver string `yaml:"driver"`
+	// DSN is the filename for sqlite, or the connection string for mysql and postgres
+	DSN string `yaml:"dsn"`
+	// AutoMigrate applies pending schema migrations on startup, otherwise they are applied with the migrate command
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// CORSConfig Cross-origin requests from browser applications on other origins.
+// Without allowed origins only the web frontend of SlideScope itself can use the API.
+type CORSConfig struct {
+	// AllowOrigins are the origins allowed to make requests, such as https://viewer.example.org
+	AllowOrigins []string `yaml:"allow_origins"`
+	// AllowMethods are the methods allowed in cross-origin requests
+	AllowMethods []string `yaml:"allow_methods"`
+	// AllowHeaders are the request headers allowed in cross-origin requests
+	AllowHeaders []string `yaml:"allow_headers"`
+	// ExposeHeaders are the response headers scripts on the other origin can read
+	ExposeHeaders []string `yaml:"expose_headers"`
+	// AllowCredentials allows sending cookies, which cannot be combined with allowing all origins
+	AllowCredentials bool `yaml:"allow_credentials"`
+	// MaxAgeSeconds is how long browsers cache the preflight response
+	MaxAgeSeconds int `yaml:"max_age_seconds"`
+}
+
+// PasswordPolicy Strength rules for the passwords of local users
+type PasswordPolicy struct {
+	MinLength     int  `yaml:"min_length"`
+	RequireUpper  bool `yaml:"require_upper"`
+	RequireLower  bool `yaml:"require_lower"`
+	RequireDigit  bool `yaml:"require_digit"`
+	RequireSymbol bool `yaml:"require_symbol"`
+}
+
+// LockoutConfig Locking accounts after failed logins. The lock doubles with every further failure.
+type LockoutConfig struct {
+	// MaxAttempts is the number of failed logins before the account is locked, 0 disables the lockout
+	MaxAttempts int `yaml:"max_attempts"`
+	// LockSeconds is how long the account is locked the first time
+	LockSeconds int `yaml:"lock_seconds"`
+	// MaxLockSeconds is the longest the account is locked
+	MaxLockSeconds int `yaml:"max_lock_seconds"`
+}
+
+// LDAPConfig Logging in with an LDAP or Active Directory account. The password of the bind DN is read
+// from the LDAP_BIND_PASSWORD environment variable.
+type LDAPConfig struct {
+	// Enabled checks logins against the directory when the user is not a local user
+	Enabled bool `yaml:"enabled"`
+	// URL of the directory server, ldap:// or ldaps://
+	URL string `yaml:"url"`
+	// StartTLS upgrades ldap:// connections to TLS
+	StartTLS bool `yaml:"start_tls"`
+	// InsecureSkipVerify does not check the certificate of the server, only use this for testing
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// BindDN is the service account used to look up users, anonymous when empty
+	BindDN string `yaml:"bind_dn"`
+	// BaseDN is where users are searched
+	BaseDN string `yaml:"base_dn"`
+	// UserFilter finds the user, %s is replaced by the escaped username
+	UserFilter string `yaml:"user_filter"`
+	// GroupAttribute is the attribute of the user listing the DNs of its groups
+	GroupAttribute string `yaml:"group_attribute"`
+	// GroupRoles maps group DNs to roles, users get the highest role of their groups
+	GroupRoles map[string]string `yaml:"group_roles"`
+	// DefaultRole is the role of users in none of the groups, when empty these users cannot log in
+	DefaultRole string `yaml:"default_role"`
+}
+
+// DeidentificationConfig Removing patient information from slides before they are served.
+// Images can override Enabled with their own deidentify setting.
+type DeidentificationConfig struct {
+	// Enabled applies the policy to all images which do not set it themselves
+	Enabled bool `yaml:"enabled"`
+	// RedactProperties are regular expressions, properties with a matching key are left out
+	RedactProperties []string `yaml:"redact_properties"`
+	// Label is how the label image and the label area of the macro image are served: show, blur or hide
+	Label string `yaml:"label"`
+	// MacroLabelRegions is the label area of the macro image per vendor, as [x, y, width, height] fractions of the
+	// macro image. The default key is used for other vendors, without it the complete macro image is treated as label.
+	MacroLabelRegions map[string][4]float64 `yaml:"macro_label_regions"`
+}
+
+// AuditConfig Recording who accessed or changed which image
+type AuditConfig struct {
+	// Enabled records who accessed or changed which image
+	Enabled bool `yaml:"enabled"`
+	// RetentionDays is how long audit events are kept, 0 keeps them forever
+	RetentionDays int `yaml:"retention_days"`
+	// ViewingSessionMinutes ends a viewing session of an image after this many minutes without tile requests
+	ViewingSessionMinutes int `yaml:"viewing_session_minutes"`
+}
+
+// IngestFolder A folder in a storage root which is watched for new slides, including its subfolders.
+// The path . watches the complete root.
+type IngestFolder struct {
+	Root string `yaml:"root" json:"storage_root"`
+	Path string `yaml:"path" json:"path"`
+}
+
+// IngestConfig Registering the slides which appear in watch folders as images
+type IngestConfig struct {
+	// Enabled scans the watch folders in the background
+	Enabled bool `yaml:"enabled"`
+	// Folders are watched for new slides
+	Folders []IngestFolder `yaml:"folders"`
+	// PollSeconds is how often the folders are scanned
+	PollSeconds int `yaml:"poll_seconds"`
+	// StableSeconds is how long a file should not change before it is complete
+	StableSeconds int `yaml:"stable_seconds"`
+	// MarkerSuffix makes a file complete when a file with its name and this suffix exists, such as .done,
+	// instead of when it is stable
+	MarkerSuffix string `yaml:"marker_suffix"`
+	// Extensions of the slide files which are registered
+	Extensions []string `yaml:"extensions"`
+	// IdentifierPattern is matched on the filename of a slide, its identifier group is the identifier of the image
+	IdentifierPattern string `yaml:"identifier_pattern"`
+	// MaskPattern is matched on all filenames, the file is a mask of the image in the identifier group, with the
+	// identifier in the mask group. Empty does not attach masks.
+	MaskPattern string `yaml:"mask_pattern"`
+}
+
+// defaultConfig The settings which are used when they are left out of the config file
+func defaultConfig() *Config {
+	config := &Config{}
+	config.DeepZoom.TileSize = 254
+	config.DeepZoom.TileOverlap = 1
+	config.DeepZoom.Format = "png"
+	config.DeepZoom.JPEGQuality = 75
+	config.DeepZoom.CacheSeconds = 500
+	config.Log.Level = "info"
+	config.Database.Driver = "sqlite"
+	config.Database.AutoMigrate = true
+	config.Server.Port = "8080"
+	config.Audit.ViewingSessionMinutes = 5
+	config.Ingest.PollSeconds = 30
+	config.Ingest.StableSeconds = 60
+	config.Ingest.IdentifierPattern = `^(?P<identifier>.+)\.[^.]+$`
+	return config
 }
 
-// NewConfig returns a new decoded Config struct
+// NewConfig returns a new decoded Config struct. Settings from the file are overridden by SLIDESCOPE_*
+// environment variables, and the result is validated.
 func NewConfig(configPath string) (*Config, error) {
 	// Create config structure
-	config := &Config{}
+	config := defaultConfig()
 
 	// Open config file
 	file, err := os.Open(configPath)
@@ -43,13 +259,133 @@ func NewConfig(configPath string) (*Config, error) {
 	d := yaml.NewDecoder(file)
 
 	// Start YAML decoding from file
-	if err := d.Decode(&config); err != nil {
+	if err := d.Decode(config); err != nil {
 		return nil, err
 	}
 
+	if err := applyEnvironment(config); err != nil {
+		return nil, err
+	}
+	if config.Database.DSN == "" && config.Database.Driver == "sqlite" {
+		config.Database.DSN = config.Sqlite.Filename
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
+// ConfigError All problems found in the config, one per line
+type ConfigError struct {
+	Problems []string
+}
+
+func (e ConfigError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate Check the settings make sense, and report all problems at once
+func (config *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	deepZoom := config.DeepZoom
+	check(deepZoom.TileSize > 0, "deepzoom.tile_size should be positive, not %d", deepZoom.TileSize)
+	check(deepZoom.TileOverlap >= 0 && 2*deepZoom.TileOverlap < deepZoom.TileSize,
+		"deepzoom.tile_overlap should be at least 0 and less than half of the tile size, not %d", deepZoom.TileOverlap)
+	check(deepZoom.Format == "jpeg" || deepZoom.Format == "png", "deepzoom.format should be jpeg or png, not %q", deepZoom.Format)
+	check(deepZoom.JPEGQuality >= 1 && deepZoom.JPEGQuality <= 100, "deepzoom.jpeg_quality should be from 1 to 100, not %d", deepZoom.JPEGQuality)
+	check(deepZoom.CacheSeconds > 0, "deepzoom.cache_seconds should be positive, not %d", deepZoom.CacheSeconds)
+	check(deepZoom.CacheMaxSlides >= 0, "deepzoom.cache_max_slides should be at least 0, not %d", deepZoom.CacheMaxSlides)
+
+	_, err := log.ParseLevel(config.Log.Level)
+	check(err == nil, "log.level should be debug, info, warning or error, not %q", config.Log.Level)
+
+	switch config.Database.Driver {
+	case "sqlite", "mysql", "postgres":
+	default:
+		check(false, "database.driver should be one of sqlite, mysql or postgres, not %q", config.Database.Driver)
+	}
+	check(config.Database.DSN != "", "database.dsn is required")
+	check(len(config.Storage.Roots) > 0, "storage.roots should name at least one directory")
+	for name, directory := range config.Storage.Roots {
+		check(name != "" && directory != "", "storage.roots should map names to directories, not %q to %q", name, directory)
+	}
+	port, err := strconv.Atoi(config.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port should be a port number, not %q", config.Server.Port)
+	check(!strings.ContainsAny(config.Server.BasePath, " ?#"), "server.base_path should be a path, not %q", config.Server.BasePath)
+	for _, proxy := range config.Server.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(cidrErr == nil || net.ParseIP(proxy) != nil, "server.trusted_proxies should be addresses or CIDR ranges, not %q", proxy)
+	}
+	for _, origin := range config.CORS.AllowOrigins {
+		// Browsers refuse credentials for any origin, and allowing them for every origin would defeat the CSRF checks
+		check(origin != "*" || !config.CORS.AllowCredentials, "cors.allow_credentials cannot be combined with the * origin")
+	}
+	check(config.CORS.MaxAgeSeconds >= 0, "cors.max_age_seconds should be at least 0, not %d", config.CORS.MaxAgeSeconds)
+
+	auth := config.Auth
+	check(auth.PasswordPolicy.MinLength >= 0, "auth.password_policy.min_length should be at least 0, not %d", auth.PasswordPolicy.MinLength)
+	check(auth.Lockout.MaxAttempts >= 0 && auth.Lockout.LockSeconds >= 0 && auth.Lockout.MaxLockSeconds >= 0,
+		"auth.lockout settings should be at least 0")
+	check(auth.Lockout.MaxAttempts == 0 || auth.Lockout.LockSeconds > 0, "auth.lockout.lock_seconds is required with max_attempts")
+
+	switch strings.ToLower(config.Session.SameSite) {
+	case "", "lax", "strict":
+	case "none":
+		check(config.Session.Secure, "session.same_site none requires session.secure")
+	default:
+		check(false, "session.same_site should be one of strict, lax or none, not %q", config.Session.SameSite)
+	}
+
+	check(config.Audit.RetentionDays >= 0, "audit.retention_days should be at least 0, not %d", config.Audit.RetentionDays)
+	check(config.Audit.ViewingSessionMinutes > 0 || !config.Audit.Enabled,
+		"audit.viewing_session_minutes should be positive, not %d", config.Audit.ViewingSessionMinutes)
+
+	switch config.Deidentification.Label {
+	case "", "show", "blur", "hide":
+	default:
+		check(false, "deidentification.label should be one of show, blur or hide, not %q", config.Deidentification.Label)
+	}
+	for _, expression := range config.Deidentification.RedactProperties {
+		_, err := regexp.Compile(expression)
+		check(err == nil, "deidentification.redact_properties has an invalid expression %q", expression)
+	}
+
+	if config.Ingest.Enabled {
+		ingest := config.Ingest
+		check(len(ingest.Folders) > 0, "ingest.folders should name at least one folder")
+		for _, folder := range ingest.Folders {
+			_, ok := config.Storage.Roots[folder.Root]
+			check(ok, "ingest.folders should be in one of the storage roots, not %q", folder.Root)
+		}
+		check(ingest.PollSeconds > 0, "ingest.poll_seconds should be positive, not %d", ingest.PollSeconds)
+		check(ingest.StableSeconds >= 0, "ingest.stable_seconds should be at least 0, not %d", ingest.StableSeconds)
+		pattern, err := regexp.Compile(ingest.IdentifierPattern)
+		check(err == nil && pattern.SubexpIndex("identifier") >= 0,
+			"ingest.identifier_pattern should be an expression with an identifier group, not %q", ingest.IdentifierPattern)
+		if ingest.MaskPattern != "" {
+			pattern, err := regexp.Compile(ingest.MaskPattern)
+			check(err == nil && pattern.SubexpIndex("identifier") >= 0 && pattern.SubexpIndex("mask") >= 0,
+				"ingest.mask_pattern should be an expression with identifier and mask groups, not %q", ingest.MaskPattern)
+		}
+	}
+
+	if config.LDAP.Enabled {
+		check(config.LDAP.URL != "" && config.LDAP.BaseDN != "", "ldap.url and ldap.base_dn are required")
+		check(strings.Contains(config.LDAP.UserFilter, "%s"), "ldap.user_filter should contain %%s for the username")
+	}
+
+	if len(problems) > 0 {
+		return ConfigError{Problems: problems}
+	}
+	return nil
+}
+
 // ValidateConfigPath just makes sure, that the path provided is a file,
 // that can be read
 func ValidateConfigPath(path string) error {
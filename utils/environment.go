@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// environmentPrefix Settings are overridden by environment variables with this prefix, followed by the yaml keys
+// joined by underscores, for instance SLIDESCOPE_DEEPZOOM_TILE_SIZE for deepzoom.tile_size
+const environmentPrefix = "SLIDESCOPE"
+
+// applyEnvironment Override the settings with the SLIDESCOPE_* environment variables that are set.
+// Values are parsed as yaml, lists can also be given separated by commas.
+func applyEnvironment(config *Config) error {
+	return applyEnvironmentTo(reflect.ValueOf(config).Elem(), environmentPrefix)
+}
+
+// applyEnvironmentTo Override the fields of the struct with the environment variables under the prefix
+func applyEnvironmentTo(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvironmentTo(value.Field(i), name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		target := value.Field(i)
+		switch {
+		case target.Kind() == reflect.String:
+			// Strings are taken as they are, so values such as "yes" or "0" stay strings
+			target.SetString(raw)
+			continue
+		case target.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(raw), "["):
+			if strings.TrimSpace(raw) == "" {
+				raw = "[]"
+			} else {
+				raw = "[" + raw + "]"
+			}
+		}
+		parsed := reflect.New(target.Type())
+		if err := yaml.Unmarshal([]byte(raw), parsed.Interface()); err != nil {
+			return fmt.Errorf("cannot parse %s: %w", name, err)
+		}
+		target.Set(parsed.Elem())
+	}
+	return nil
+}
+
+// secretFiles The contents of the files secrets were read from, so they are only read once
+var secretFiles = map[string]string{}
+var secretFilesMu sync.Mutex
+
+// Secret Read a secret from the environment variable, or from the file named in the variable with _FILE appended,
+// as used for Docker and Kubernetes secrets. The variable itself takes precedence.
+func Secret(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return ""
+	}
+
+	secretFilesMu.Lock()
+	defer secretFilesMu.Unlock()
+	if value, ok := secretFiles[path]; ok {
+		return value
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cannot read %s from %s: %s", name, path, err.Error()))
+		return ""
+	}
+	value := strings.TrimSpace(string(content))
+	secretFiles[path] = value
+	return value
+}
@@ -0,0 +1,35 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyHeader The header machine clients pass their API key in
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix Makes API keys recognizable, for instance for secret scanners
+const apiKeyPrefix = "ss_"
+
+// GenerateAPIKey Create a new random API key. Only its hash should be stored.
+func GenerateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// HashAPIKey Hash an API key for storage and lookup. The keys are random, so a plain SHA-256 suffices.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ExtractAPIKey Get the API key from the request header
+func ExtractAPIKey(c *gin.Context) string {
+	return c.Request.Header.Get(APIKeyHeader)
+}
@@ -0,0 +1,44 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"time"
+)
+
+// refreshTokenPrefix Makes refresh tokens recognizable, and distinct from API keys
+const refreshTokenPrefix = "ssr_"
+
+// defaultRefreshHourLifespan A session ends when it is not refreshed for two weeks
+const defaultRefreshHourLifespan = 14 * 24
+
+// RefreshTokenLifespan How long a refresh token is valid, from REFRESH_TOKEN_HOUR_LIFESPAN
+func RefreshTokenLifespan() (time.Duration, error) {
+	lifespan := defaultRefreshHourLifespan
+	if value := os.Getenv("REFRESH_TOKEN_HOUR_LIFESPAN"); value != "" {
+		var err error
+		lifespan, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Hour * time.Duration(lifespan), nil
+}
+
+// GenerateRefreshToken Create a new random refresh token. Only its hash should be stored.
+func GenerateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return refreshTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+// HashRefreshToken Hash a refresh token for storage and lookup
+func HashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
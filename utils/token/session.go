@@ -0,0 +1,25 @@
+package token
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"slidescope/utils"
+)
+
+// SessionSecret The key browser session cookies are signed with, falls back to API_SECRET
+func SessionSecret() []byte {
+	if secret := utils.Secret("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(utils.Secret("API_SECRET"))
+}
+
+// GenerateCSRFToken Create a new random token, stored in the session and sent along with state-changing requests
+func GenerateCSRFToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,62 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slidescope/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareSecret The key share links are signed with, falls back to API_SECRET
+func shareSecret() []byte {
+	if secret := utils.Secret("SHARE_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(utils.Secret("API_SECRET"))
+}
+
+// shareSignature HMAC-SHA256 over the link id and expiry
+func shareSignature(linkId uint, expiresAt int64) []byte {
+	mac := hmac.New(sha256.New, shareSecret())
+	mac.Write([]byte(fmt.Sprintf("share:%d:%d", linkId, expiresAt)))
+	return mac.Sum(nil)
+}
+
+// SignShareLink Create the token of a share link, formatted as <id>.<expiry>.<signature>
+func SignShareLink(linkId uint, expiresAt time.Time) string {
+	expires := expiresAt.Unix()
+	return fmt.Sprintf("%d.%d.%s", linkId, expires, hex.EncodeToString(shareSignature(linkId, expires)))
+}
+
+// ParseShareLink Verify the signature and expiry of a share token and return the link id
+func ParseShareLink(shareToken string) (uint, error) {
+	parts := strings.Split(shareToken, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("malformed share link")
+	}
+	linkId, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, errors.New("malformed share link")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, errors.New("malformed share link")
+	}
+	signature, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return 0, errors.New("malformed share link")
+	}
+
+	if !hmac.Equal(signature, shareSignature(uint(linkId), expires)) {
+		return 0, errors.New("invalid share link signature")
+	}
+	if time.Now().Unix() > expires {
+		return 0, errors.New("share link expired")
+	}
+	return uint(linkId), nil
+}
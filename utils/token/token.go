@@ -1,6 +1,7 @@
 package token
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -9,34 +10,99 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"slidescope/utils"
 )
 
-func GenerateToken(user_id uint) (string, error) {
+// defaultKeyID The key ID of API_SECRET when API_SECRET_KID is not set, also assumed for tokens without a key ID
+const defaultKeyID = "default"
 
-	token_lifespan, err := strconv.Atoi(os.Getenv("TOKEN_HOUR_LIFESPAN"))
+// defaultTokenMinuteLifespan Access tokens are short-lived, sessions are extended with a refresh token
+const defaultTokenMinuteLifespan = 15
+
+// Claims The part of the access token the server uses
+type Claims struct {
+	UserID    uint
+	SessionID uint
+}
+
+// signingKeys The key ID new tokens are signed with, and all keys tokens can be verified with.
+// API_SECRET signs new tokens. API_PREVIOUS_SECRETS ("kid:secret,kid:secret") holds the keys before a rotation,
+// these are only used to verify tokens issued before the rotation.
+func signingKeys() (string, map[string][]byte) {
+	kid := os.Getenv("API_SECRET_KID")
+	if kid == "" {
+		kid = defaultKeyID
+	}
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(utils.Secret("API_PREVIOUS_SECRETS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			keys[parts[0]] = []byte(parts[1])
+		}
+	}
+	keys[kid] = []byte(utils.Secret("API_SECRET"))
+	return kid, keys
+}
+
+// TokenLifespan How long access tokens are valid, from TOKEN_MINUTE_LIFESPAN
+func TokenLifespan() (time.Duration, error) {
+	token_lifespan := defaultTokenMinuteLifespan
+	if value := os.Getenv("TOKEN_MINUTE_LIFESPAN"); value != "" {
+		var err error
+		token_lifespan, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Minute * time.Duration(token_lifespan), nil
+}
+
+// GenerateToken Create an access token for a session of the user, signed with the current key
+func GenerateToken(user_id uint, session_id uint) (string, error) {
+
+	token_lifespan, err := TokenLifespan()
 
 	if err != nil {
 		return "", err
 	}
 
+	kid, keys := signingKeys()
+
 	claims := jwt.MapClaims{}
 	claims["authorized"] = true
 	claims["user_id"] = user_id
-	claims["exp"] = time.Now().Add(time.Hour * time.Duration(token_lifespan)).Unix()
+	claims["sid"] = session_id
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = time.Now().Add(token_lifespan).Unix()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
 
-	return token.SignedString([]byte(os.Getenv("API_SECRET")))
+	return token.SignedString(keys[kid])
 
 }
 
-func TokenValid(c *gin.Context) error {
-	tokenString := ExtractToken(c)
-	_, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+// parseToken Verify the token with the key its key ID refers to
+func parseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(os.Getenv("API_SECRET")), nil
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			kid = defaultKeyID
+		}
+		_, keys := signingKeys()
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown key id: %s", kid)
+		}
+		return key, nil
 	})
+}
+
+func TokenValid(c *gin.Context) error {
+	tokenString := ExtractToken(c)
+	_, err := parseToken(tokenString)
 	if err != nil {
 		return err
 	}
@@ -55,25 +121,26 @@ func ExtractToken(c *gin.Context) string {
 	return ""
 }
 
-func ExtractTokenID(c *gin.Context) (uint, error) {
+// ExtractTokenClaims Get the user and session of a valid access token
+func ExtractTokenClaims(c *gin.Context) (Claims, error) {
 
 	tokenString := ExtractToken(c)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("API_SECRET")), nil
-	})
+	token, err := parseToken(tokenString)
 	if err != nil {
-		return 0, err
+		return Claims{}, err
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		uid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["user_id"]), 10, 32)
-		if err != nil {
-			return 0, err
-		}
-		return uint(uid), nil
+	if !ok || !token.Valid {
+		return Claims{}, errors.New("invalid token")
+	}
+	uid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["user_id"]), 10, 32)
+	if err != nil {
+		return Claims{}, err
+	}
+	// Tokens without a session cannot be revoked, these are not accepted
+	sid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["sid"]), 10, 32)
+	if err != nil || sid == 0 {
+		return Claims{}, errors.New("token has no session")
 	}
-	return 0, nil
+	return Claims{UserID: uint(uid), SessionID: uint(sid)}, nil
 }
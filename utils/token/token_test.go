@@ -0,0 +1,175 @@
+package token
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// setSecrets Set the signing keys from the environment of the test
+func setSecrets(t *testing.T, secret string, kid string, previous string) {
+	t.Helper()
+	t.Setenv("API_SECRET", secret)
+	t.Setenv("API_SECRET_KID", kid)
+	t.Setenv("API_PREVIOUS_SECRETS", previous)
+}
+
+// claimsOf The claims of the token, as a request with it as bearer token
+func claimsOf(tokenString string) (Claims, error) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.Header.Set("Authorization", "Bearer "+tokenString)
+	return ExtractTokenClaims(c)
+}
+
+func TestKeyRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		// The keys when the token is signed, and when it is verified
+		signSecret, signKid                     string
+		verifySecret, verifyKid, verifyPrevious string
+		wantErr                                 string // Empty when the token is accepted
+	}{
+		{name: "current key",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "first", verifyKid: "2024"},
+		{name: "without key ids",
+			signSecret:   "first",
+			verifySecret: "first"},
+		{name: "previous key after a rotation",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "second", verifyKid: "2025", verifyPrevious: "2024:first"},
+		{name: "one of several previous keys",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "third", verifyKid: "2026", verifyPrevious: "2025:second, 2024:first"},
+		{name: "default key after a rotation to key ids",
+			signSecret:   "first",
+			verifySecret: "second", verifyKid: "2025", verifyPrevious: "default:first"},
+		{name: "previous secret containing a colon",
+			signSecret: "fi:rst", signKid: "2024",
+			verifySecret: "second", verifyKid: "2025", verifyPrevious: "2024:fi:rst"},
+		{name: "previous key removed",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "second", verifyKid: "2025",
+			wantErr: "Unknown key id: 2024"},
+		{name: "secret rotated without a new key id",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "second", verifyKid: "2024",
+			wantErr: "signature is invalid"},
+		{name: "previous key with another secret",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "second", verifyKid: "2025", verifyPrevious: "2024:other",
+			wantErr: "signature is invalid"},
+		{name: "current key id overrides a previous key with the same id",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "second", verifyKid: "2024", verifyPrevious: "2024:first",
+			wantErr: "signature is invalid"},
+		{name: "malformed previous keys are ignored",
+			signSecret: "first", signKid: "2024",
+			verifySecret: "second", verifyKid: "2025", verifyPrevious: "2024,:first,2024:",
+			wantErr: "Unknown key id: 2024"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setSecrets(t, test.signSecret, test.signKid, "")
+			tokenString, err := GenerateToken(3, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			setSecrets(t, test.verifySecret, test.verifyKid, test.verifyPrevious)
+			claims, err := claimsOf(tokenString)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claims != (Claims{UserID: 3, SessionID: 7}) {
+				t.Fatalf("got claims %+v, want user 3 and session 7", claims)
+			}
+		})
+	}
+}
+
+func TestGenerateTokenKeyID(t *testing.T) {
+	tests := []struct {
+		kid     string
+		wantKid string
+	}{
+		{"", defaultKeyID},
+		{"2025", "2025"},
+	}
+	for _, test := range tests {
+		t.Run(test.wantKid, func(t *testing.T) {
+			setSecrets(t, "second", test.kid, "2024:first")
+			tokenString, err := GenerateToken(3, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// New tokens are signed with the current key, never with a previous one
+			parsed, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+				return []byte("second"), nil
+			})
+			if err != nil {
+				t.Fatalf("token is not signed with the current secret: %v", err)
+			}
+			if kid := parsed.Header["kid"]; kid != test.wantKid {
+				t.Fatalf("got key id %v, want %s", kid, test.wantKid)
+			}
+		})
+	}
+}
+
+func TestKeyRotationFromFiles(t *testing.T) {
+	setSecrets(t, "first", "2024", "")
+	tokenString, err := GenerateToken(3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The current and previous keys are read from the files when the variables themselves are empty
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	previousFile := filepath.Join(dir, "previous")
+	if err := os.WriteFile(secretFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(previousFile, []byte("2024:first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setSecrets(t, "", "2025", "")
+	t.Setenv("API_SECRET_FILE", secretFile)
+	t.Setenv("API_PREVIOUS_SECRETS_FILE", previousFile)
+	if _, err := claimsOf(tokenString); err != nil {
+		t.Fatalf("token signed with the previous key is refused: %v", err)
+	}
+	rotated, err := GenerateToken(3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(rotated, func(token *jwt.Token) (interface{}, error) { return []byte("second"), nil }); err != nil {
+		t.Fatalf("token is not signed with the secret from the file: %v", err)
+	}
+}
+
+func TestTokenWithoutSession(t *testing.T) {
+	setSecrets(t, "first", "", "")
+	claims := jwt.MapClaims{"authorized": true, "user_id": 3, "exp": 4102444800}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tokens from before sessions cannot be revoked
+	if _, err := claimsOf(tokenString); err == nil || !strings.Contains(err.Error(), "no session") {
+		t.Fatalf("error %v, want the token to be refused", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slidescope/library"
+	"text/tabwriter"
+)
+
+// verifyUsage How the verify subcommand is used
+const verifyUsage = "usage: slidescope [-config config.yaml] verify [-unregistered]"
+
+// runVerify Run the verify subcommand: check the files of all images and masks, and print the ones with problems.
+// Slide files are recognized by the extensions of the ingest section. Any problem fails the command, so it can be
+// used for monitoring, unregistered files do not.
+func runVerify(args []string, extensions []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	unregistered := flags.Bool("unregistered", false, "also list slide files in the storage roots which are not registered")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errors.New(verifyUsage)
+	}
+
+	report, err := library.Verify(library.VerifyOptions{Unregistered: *unregistered, Extensions: extensions})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBLEM\tKIND\tIDENTIFIER\tPATH\tERROR")
+	for _, problems := range []struct {
+		name     string
+		problems []library.Problem
+	}{
+		{"missing", report.Missing},
+		{"unreadable", report.Unreadable},
+		{"changed", report.Changed},
+		{"orphaned", report.Orphaned},
+	} {
+		for _, problem := range problems.problems {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s/%s\t%s\n", problems.name, problem.Kind, problem.Identifier,
+				problem.StorageRoot, problem.Path, problem.Error)
+		}
+	}
+	for _, file := range report.Unregistered {
+		fmt.Fprintf(w, "unregistered\t\t\t%s\t\n", file)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d images and %d masks, %d healthy, %d missing, %d unreadable, %d changed, %d orphaned, %d without fingerprint",
+		report.Images, report.Masks, report.Healthy, len(report.Missing), len(report.Unreadable), len(report.Changed),
+		len(report.Orphaned), len(report.NoFingerprint))
+	if report.CheckedUnregistered {
+		fmt.Printf(", %d unregistered files", len(report.Unregistered))
+	}
+	fmt.Println()
+	if problems := len(report.Missing) + len(report.Unreadable) + len(report.Changed) + len(report.Orphaned); problems > 0 {
+		return fmt.Errorf("%d problems found in the library", problems)
+	}
+	return nil
+}